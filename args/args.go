@@ -28,6 +28,9 @@ const (
 	kernelCmdlineConf = "clri.descriptor"
 	kernelCmdlineDemo = "clri.demo"
 	logFileEnvironVar = "CLR_INSTALLER_LOG_FILE"
+
+	// cacheCommand pre-populates a directory with the swupd content of offline installations
+	cacheCommand = "cache"
 )
 
 var (
@@ -53,6 +56,12 @@ type Args struct {
 	Archive         bool
 	ArchiveSet      bool
 	DemoMode        bool
+	DryRun          bool
+	DryRunFormat    string
+	Cache           bool
+	CacheDir        string
+	CacheVersion    string
+	CacheBundles    []string
 }
 
 func (args *Args) setKernelArgs() (err error) {
@@ -151,6 +160,22 @@ func (args *Args) setCommandLineArgs() (err error) {
 		&args.Archive, "archive", true, "Archive data to target after finishing",
 	)
 
+	flag.BoolVar(
+		&args.DryRun, "dry-run", false, "Print the installation plan without changing the system",
+	)
+
+	flag.StringVar(
+		&args.DryRunFormat, "dry-run-format", "text", "The installation plan format: text or json",
+	)
+
+	flag.StringVar(
+		&args.CacheVersion, "cache-version", "", "The version cached by the cache command, the host's if not set",
+	)
+
+	flag.StringSliceVar(
+		&args.CacheBundles, "cache-bundles", nil, "The bundles cached by the cache command, in addition to the descriptor's",
+	)
+
 	flag.BoolVar(
 		&args.DemoMode, "demo", args.DemoMode, "Demonstration mode for documentation generation",
 	)
@@ -178,8 +203,28 @@ func (args *Args) setCommandLineArgs() (err error) {
 
 	flag.ErrHelp = errors.New("Clear Linux Installer program")
 
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s %s [flags] <dir>\n\n", os.Args[0], cacheCommand)
+		flag.PrintDefaults()
+	}
+
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		if flag.Arg(0) != cacheCommand {
+			return fmt.Errorf("Unknown command: %s", flag.Arg(0))
+		}
+
+		if flag.NArg() != 2 {
+			return errors.New("The cache command requires the cache directory")
+		}
+
+		args.Cache = true
+		args.CacheDir = flag.Arg(1)
+	}
+
 	fflag = flag.Lookup("telemetry")
 	if fflag != nil {
 		if fflag.Changed {
@@ -206,6 +251,10 @@ func (args *Args) setCommandLineArgs() (err error) {
 		return errors.New("Telemetry requires both --telemetry-url and --telemetry-tid")
 	}
 
+	if args.DryRunFormat != "text" && args.DryRunFormat != "json" {
+		return errors.New("Invalid --dry-run-format, valid formats are: text, json")
+	}
+
 	return nil
 }
 
@@ -18,15 +18,20 @@ import (
 	"github.com/clearlinux/clr-installer/args"
 	"github.com/clearlinux/clr-installer/cmd"
 	"github.com/clearlinux/clr-installer/conf"
+	"github.com/clearlinux/clr-installer/controller"
 	"github.com/clearlinux/clr-installer/crypt"
 	"github.com/clearlinux/clr-installer/frontend"
 	"github.com/clearlinux/clr-installer/keyboard"
 	"github.com/clearlinux/clr-installer/log"
 	"github.com/clearlinux/clr-installer/massinstall"
 	"github.com/clearlinux/clr-installer/model"
+	"github.com/clearlinux/clr-installer/plan"
+	"github.com/clearlinux/clr-installer/progress"
+	"github.com/clearlinux/clr-installer/storage"
 	"github.com/clearlinux/clr-installer/swupd"
 	"github.com/clearlinux/clr-installer/telemetry"
 	"github.com/clearlinux/clr-installer/tui"
+	"github.com/clearlinux/clr-installer/utils"
 )
 
 var (
@@ -96,6 +101,70 @@ func validateTelemetry(options args.Args, md *model.SystemInstall) error {
 	return nil
 }
 
+// dryRun walks the installation recording its actions instead of taking them
+// and prints the resulting installation plan
+func dryRun(options args.Args, md *model.SystemInstall, rootDir string) error {
+	// nothing is mounted in dry-run mode, rootDir is left empty
+	defer func() {
+		_ = os.RemoveAll(rootDir)
+	}()
+
+	plan.Enable(true)
+	progress.Set(plan.Progress{})
+
+	// the telemetry settings are not validated against the servers when planning
+	md.EnableTelemetry(md.IsTelemetryEnabled())
+
+	if err := controller.Install(rootDir, md); err != nil {
+		return err
+	}
+
+	plan.SetStep("images")
+	if err := storage.DetachImages(true); err != nil {
+		return err
+	}
+
+	if options.DryRunFormat == "json" {
+		return plan.WriteJSON(os.Stdout)
+	}
+
+	return plan.WriteText(os.Stdout)
+}
+
+// cache pre-populates the cache directory with the swupd content needed to install the
+// bundles of the descriptor, if one is given, and the requested ones offline
+func cache(options args.Args) error {
+	var err error
+
+	bundles := []string{}
+	url := options.SwupdMirror
+
+	if options.ConfigFile != "" {
+		var md *model.SystemInstall
+
+		if md, err = model.LoadFile(options.ConfigFile); err != nil {
+			return err
+		}
+
+		bundles = append(bundles, md.TargetBundles()...)
+
+		if url == "" && !swupd.IsLocalURL(md.SwupdMirror) {
+			url = md.SwupdMirror
+		}
+	}
+
+	bundles = append(bundles, options.CacheBundles...)
+
+	version := options.CacheVersion
+	if version == "" {
+		if version, err = swupd.HostVersion(); err != nil {
+			return err
+		}
+	}
+
+	return swupd.Cache(options.CacheDir, url, version, bundles)
+}
+
 func main() {
 	var options args.Args
 
@@ -137,6 +206,13 @@ func main() {
 	}()
 	log.Info(path.Base(os.Args[0]) + ": " + model.Version)
 
+	if options.Cache {
+		if err = cache(options); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
 	initFrontendList()
 
 	sigs := make(chan os.Signal, 1)
@@ -146,6 +222,13 @@ func main() {
 		syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGILL, syscall.SIGTRAP,
 		syscall.SIGABRT, syscall.SIGSTKFLT, syscall.SIGSYS)
 
+	// a previous installation may have crashed leaving its file systems mounted
+	if !options.DryRun && utils.VerifyRootUser() == nil {
+		if err = storage.CleanupStaleMounts(os.TempDir()); err != nil {
+			log.Warning("Failed to clean up leftover mounts: %v", err)
+		}
+	}
+
 	rootDir, err := ioutil.TempDir("", "install-")
 	if err != nil {
 		fatal(err)
@@ -177,6 +260,13 @@ func main() {
 	if options.SwupdMirror != "" {
 		md.SwupdMirror = options.SwupdMirror
 	}
+
+	if options.DryRun {
+		if err = dryRun(options, md, rootDir); err != nil {
+			fatal(err)
+		}
+		return
+	}
 	// Now validate the mirror from the config or command line
 	if md.SwupdMirror != "" {
 		var url string
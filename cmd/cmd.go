@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/clearlinux/clr-installer/log"
+	"github.com/clearlinux/clr-installer/plan"
 )
 
 type runLogger struct{}
@@ -37,14 +38,38 @@ func (rl runLogger) Write(p []byte) (n int, err error) {
 }
 
 // RunAndLog executes a command (similar to Run) but takes care of writing
-// the output to default logger
+// the output to default logger, in dry-run mode the command is only recorded
+// in the installation plan
 func RunAndLog(args ...string) error {
+	if plan.Enabled() {
+		plan.AddCommand(args...)
+		return nil
+	}
+
 	return Run(runLogger{}, args...)
 }
 
+// RunAndWatch executes a command similar to RunAndLog but also streams the output
+// to w as it's produced i.e to follow the command's progress, in dry-run mode the
+// command is only recorded in the installation plan
+func RunAndWatch(w io.Writer, args ...string) error {
+	if plan.Enabled() {
+		plan.AddCommand(args...)
+		return nil
+	}
+
+	return Run(io.MultiWriter(runLogger{}, w), args...)
+}
+
 // PipeRunAndLog is similar to RunAndLog runs a command and writes the output
-// to default logger and also writes in to the process stdin
+// to default logger and also writes in to the process stdin, in dry-run mode the
+// command is only recorded in the installation plan, in is never recorded
 func PipeRunAndLog(in string, args ...string) error {
+	if plan.Enabled() {
+		plan.AddCommand(args...)
+		return nil
+	}
+
 	return run(func(cmd *exec.Cmd) error {
 		stdin, err := cmd.StdinPipe()
 		if err != nil {
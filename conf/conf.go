@@ -32,6 +32,9 @@ const (
 	// KernelListFile is the file describing the available kernel bundles
 	KernelListFile = "kernels.json"
 
+	// PartitionSchemeFile is the file describing the available partition schemes
+	PartitionSchemeFile = "partition-schemes.json"
+
 	// SourcePath is the source path (within the .gopath)
 	SourcePath = "src/github.com/clearlinux/clr-installer"
 )
@@ -80,6 +83,14 @@ func LookupKernelListFile() (string, error) {
 	return lookupDefaultFile(KernelListFile)
 }
 
+// LookupPartitionSchemeFile looks up the partition scheme definitions
+// Guesses if we're running from source code or from system, if we're running from
+// source code directory then we load the source default file, otherwise load the system
+// installed file
+func LookupPartitionSchemeFile() (string, error) {
+	return lookupDefaultFile(PartitionSchemeFile)
+}
+
 // LookupDefaultConfig looks up the install descriptor
 // Guesses if we're running from source code our from system, if we're running from
 // source code directory then we loads the source default file, otherwise tried to load
@@ -5,13 +5,13 @@
 package controller
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -23,6 +23,7 @@ import (
 	"github.com/clearlinux/clr-installer/log"
 	"github.com/clearlinux/clr-installer/model"
 	"github.com/clearlinux/clr-installer/network"
+	"github.com/clearlinux/clr-installer/plan"
 	"github.com/clearlinux/clr-installer/progress"
 	"github.com/clearlinux/clr-installer/storage"
 	"github.com/clearlinux/clr-installer/swupd"
@@ -30,6 +31,20 @@ import (
 	"github.com/clearlinux/clr-installer/utils"
 )
 
+var (
+	// installPhases weights the installation phases in the overall progress after
+	// the time each one usually takes, the content installation being the longest
+	installPhases = []progress.Phase{
+		{Name: "network", Weight: 2},
+		{Name: "storage", Weight: 8},
+		{Name: "swupd", Weight: 40},
+		{Name: "update", Weight: 15},
+		{Name: "bundles", Weight: 28},
+		{Name: "bootloader", Weight: 5},
+		{Name: "users", Weight: 2},
+	}
+)
+
 func sortMountPoint(bds []*storage.BlockDevice) []*storage.BlockDevice {
 	sort.Slice(bds[:], func(i, j int) bool {
 		return filepath.HasPrefix(bds[j].MountPoint, bds[i].MountPoint)
@@ -39,19 +54,24 @@ func sortMountPoint(bds []*storage.BlockDevice) []*storage.BlockDevice {
 }
 
 // Install is the main install controller, this is the entry point for a full
-// installation
+// installation, in dry-run mode the destructive actions are recorded in the
+// installation plan instead of being taken
 func Install(rootDir string, model *model.SystemInstall) error {
 	var err error
 	var version string
-	var versionBuf []byte
 
 	// First verify we are running as 'root' user which is required
 	// for most of the Installation commands
-	if err = utils.VerifyRootUser(); err != nil {
+	if err = utils.VerifyRootUser(); err != nil && !plan.Enabled() {
 		return err
 	}
 
-	if model.Telemetry.Enabled {
+	progress.SetPhases(installPhases)
+
+	plan.SetStep("telemetry")
+	if model.Telemetry.Enabled && plan.Enabled() {
+		plan.Add("enable telemetry on the installer host")
+	} else if model.Telemetry.Enabled {
 		if err = model.Telemetry.CreateLocalTelemetryConf(); err != nil {
 			return err
 		}
@@ -70,48 +90,140 @@ func Install(rootDir string, model *model.SystemInstall) error {
 	// in order to avoid issues raised by format bumps between installers image
 	// version and the latest released we assume the installers host version
 	// in other words we use the same version swupd is based on
-	if versionBuf, err = ioutil.ReadFile("/usr/lib/os-release"); err != nil {
-		return errors.Errorf("Read version file /usr/lib/os-release: %v", err)
+	if version, err = swupd.HostVersion(); err != nil {
+		return err
 	}
-	versionExp := regexp.MustCompile(`VERSION_ID=([0-9][0-9]*)`)
-	match := versionExp.FindSubmatch(versionBuf)
+	log.Debug("Clear Linux version: %s", version)
 
-	if len(match) < 2 {
-		return errors.Errorf("Version not found in /usr/lib/os-release")
+	// disks selected by serial, wwn, device path or rules are only known now
+	if err = model.ResolveTargetMedias(); err != nil {
+		return err
 	}
 
-	version = string(match[1])
-	log.Debug("Clear Linux version: %s", version)
+	if err = model.ApplyPartitionScheme(); err != nil {
+		return err
+	}
+
+	storage.NormalizeRaidArrays(model.TargetMedias, model.RaidArrays)
+
+	// the shrunk partitions are validated against their actual used space
+	if err = storage.ProbeShrunkPartitions(model.TargetMedias); err != nil {
+		return err
+	}
 
 	// do we have the minimum required to install a system?
 	if err = model.Validate(); err != nil {
 		return err
 	}
 
+	plan.SetStep("network")
+	progress.StartPhase("network")
 	if err = ConfigureNetwork(model); err != nil {
 		return err
 	}
 
+	plan.SetStep("storage")
+	progress.StartPhase("storage")
+
 	mountPoints := []*storage.BlockDevice{}
+	swaps := []*storage.BlockDevice{}
+
+	// resolve the layout of every target disk before touching any of them, a
+	// problem with the second disk must not leave the first one half installed
+	for _, curr := range model.TargetMedias {
+		// image backed disks are installed through a loop device
+		if err = curr.AttachImage(); err != nil {
+			return err
+		}
+
+		// relative partition sizes depend on the actual disk size
+		if err = curr.ResolveSizes(); err != nil {
+			return err
+		}
+	}
 
 	// prepare all the target block devices
 	for _, curr := range model.TargetMedias {
+		// stale signatures would otherwise confuse the following mkfs steps
+		if err = curr.WipeDisk(); err != nil {
+			return err
+		}
+
 		// based on the description given, write the partition table
-		if err = curr.WritePartitionTable(); err != nil {
+		if err = curr.WritePartitionTable(model.LegacyBoot()); err != nil {
 			return err
 		}
 
 		// prepare the blockdevice's partitions filesystem
 		for _, ch := range curr.Children {
+			// existing partitions may be kept untouched or reused as they are
+			if !ch.ShouldFormat() {
+				mountPoints = append(mountPoints, ch.MountTargets()...)
+				continue
+			}
+
+			if ch.Encrypted {
+				prg := progress.NewLoop("Encrypting %s", ch.Name)
+				if err = ch.MapEncrypted(); err != nil {
+					prg.Failure()
+					return err
+				}
+				prg.Success()
+			}
+
 			prg := progress.NewLoop("Writing %s file system to %s", ch.FsType, ch.Name)
 			if err = ch.MakeFs(); err != nil {
 				return err
 			}
 			prg.Success()
 
-			// if we have a mount point set it for future mounting
-			if ch.MountPoint != "" {
-				mountPoints = append(mountPoints, ch)
+			// if we have mount points set them for future mounting
+			mountPoints = append(mountPoints, ch.MountTargets()...)
+
+			if ch.FsType == "swap" {
+				swaps = append(swaps, ch)
+			}
+		}
+	}
+
+	// assemble the raid arrays with the prepared members
+	for _, arr := range model.RaidArrays {
+		prg := progress.NewLoop("Assembling raid array %s", arr.Name)
+		if err = arr.MakeRaidArray(model.TargetMedias); err != nil {
+			prg.Failure()
+			return err
+		}
+		prg.Success()
+
+		prg = progress.NewLoop("Writing %s file system to %s", arr.FsType, arr.Name)
+		if err = arr.MakeFs(); err != nil {
+			return err
+		}
+		prg.Success()
+
+		mountPoints = append(mountPoints, arr.MountTargets()...)
+	}
+
+	// create the volume groups on top of the prepared physical volumes
+	for _, vg := range model.VolumeGroups {
+		prg := progress.NewLoop("Creating volume group %s", vg.Name)
+		if err = vg.MakeVolumeGroup(model.TargetMedias); err != nil {
+			prg.Failure()
+			return err
+		}
+		prg.Success()
+
+		for _, lv := range vg.Children {
+			prg = progress.NewLoop("Writing %s file system to %s", lv.FsType, lv.Name)
+			if err = lv.MakeFs(); err != nil {
+				return err
+			}
+			prg.Success()
+
+			mountPoints = append(mountPoints, lv.MountTargets()...)
+
+			if lv.FsType == "swap" {
+				swaps = append(swaps, lv)
 			}
 		}
 	}
@@ -134,16 +246,42 @@ func Install(rootDir string, model *model.SystemInstall) error {
 		model.AddBundle("telemetrics")
 	}
 
-	if model.KernelCMDLine != "" {
+	if err = storage.WriteCrypttab(rootDir, model.TargetMedias); err != nil {
+		return err
+	}
+
+	if err = storage.WriteMdadmConf(rootDir); err != nil {
+		return err
+	}
+
+	if model.Swap != nil {
+		if err = model.Swap.Setup(rootDir, storage.FindMountPoint(mountPoints, "/")); err != nil {
+			return err
+		}
+	}
+
+	err = storage.WriteFstab(rootDir, append(mountPoints, swaps...), model.Swap.FstabEntries()...)
+	if err != nil {
+		return err
+	}
+
+	cmdline := strings.TrimSpace(strings.Join([]string{model.KernelCMDLine,
+		storage.EncryptionKernelCmdline(model.TargetMedias, model.VolumeGroups, model.RaidArrays),
+		storage.VolumeGroupKernelCmdline(model.VolumeGroups),
+		storage.RaidKernelCmdline(model.RaidArrays),
+		storage.SubvolumeKernelCmdline(model.TargetMedias),
+		storage.SubvolumeKernelCmdline(model.VolumeGroups),
+		storage.SubvolumeKernelCmdline(model.RaidArrays)}, " "))
+
+	if cmdline != "" {
 		cmdlineDir := filepath.Join(rootDir, "etc", "kernel")
 		cmdlineFile := filepath.Join(cmdlineDir, "cmdline")
-		cmdline := model.KernelCMDLine
 
 		if err = utils.MkdirAll(cmdlineDir, 0755); err != nil {
 			return err
 		}
 
-		if err = ioutil.WriteFile(cmdlineFile, []byte(cmdline), 0644); err != nil {
+		if err = plan.WriteFile(cmdlineFile, []byte(cmdline), 0644); err != nil {
 			return err
 		}
 	}
@@ -154,22 +292,28 @@ func Install(rootDir string, model *model.SystemInstall) error {
 		return err
 	}
 
+	plan.SetStep("users")
+	progress.StartPhase("users")
 	if err := cuser.Apply(rootDir, model.Users); err != nil {
 		return err
 	}
 
+	plan.SetStep("hostname")
 	if model.Hostname != "" {
 		if err := hostname.SetTargetHostname(rootDir, model.Hostname); err != nil {
 			return err
 		}
 	}
 
+	plan.SetStep("telemetry")
 	if model.Telemetry.URL != "" {
 		if err := model.Telemetry.CreateTelemetryConf(rootDir); err != nil {
 			return err
 		}
 	}
 
+	progress.Complete()
+
 	return nil
 }
 
@@ -181,13 +325,33 @@ func contentInstall(rootDir string, version string, model *model.SystemInstall)
 
 	sw := swupd.New(rootDir)
 
-	prg := progress.NewLoop("Installing the base system")
-	if err := sw.Verify(version, model.SwupdMirror); err != nil {
+	plan.SetStep("swupd")
+	progress.StartPhase("swupd")
+	prg := progress.MultiStep(100, "Installing the base system")
+	if model.Offline() {
+		url, err := contentURL(rootDir, model)
+		if err != nil {
+			return prg, err
+		}
+
+		log.Info("Installing offline from: %s", url)
+		sw = swupd.NewOffline(rootDir, url)
+	}
+
+	if err := sw.Verify(version, model.SwupdMirror, prg); err != nil {
 		return prg, err
 	}
 
-	if model.AutoUpdate {
-		if err := sw.Update(); err != nil {
+	if model.AutoUpdate && sw.IsOffline() {
+		// the local content only holds the host's version, updates are left to
+		// the installed system
+		log.Info("Skipping initial swupd update for the offline installation")
+	} else if model.AutoUpdate {
+		prg.Success()
+
+		progress.StartPhase("update")
+		prg = progress.MultiStep(100, "Updating the base system")
+		if err := sw.Update(prg); err != nil {
 			return prg, err
 		}
 	} else {
@@ -200,30 +364,28 @@ func contentInstall(rootDir string, version string, model *model.SystemInstall)
 	}
 	prg.Success()
 
-	bundles := model.Bundles
-	bundles = append(bundles, model.Kernel.Bundle)
-	for _, bundle := range bundles {
+	bundles := []string{}
+	for _, bundle := range model.TargetBundles() {
 		// swupd will fail (return exit code 18) if we try to "re-install" a bundle
 		// already installed - with that we need to prevent doing bundle-add for bundles
 		// previously installed by verify operation
 		if swupd.IsCoreBundle(bundle) {
-			log.Debug("Bundle %s was already installed with the core bundles, skipping")
+			log.Debug("Bundle %s was already installed with the core bundles, skipping", bundle)
 			continue
 		}
 
-		prg = progress.NewLoop("Installing bundle: %s", bundle)
-		if err := sw.BundleAdd(bundle); err != nil {
-			// Attempt to continue the installation for non-core bundles
-			if errLog := model.Telemetry.LogRecord("swupd", 2, "Failed to install bundle: "+bundle); errLog != nil {
-				log.Error("Failed to log Telemetry record for failed bundled: " + bundle)
-			}
-			log.Error("Failed to install bundle: %s", bundle)
-			prg.Failure()
-		} else {
-			prg.Success()
+		bundles = append(bundles, bundle)
+	}
+
+	progress.StartPhase("bundles")
+	if len(bundles) > 0 {
+		if prg, err := installBundles(sw, bundles, model); err != nil {
+			return prg, err
 		}
 	}
 
+	plan.SetStep("bootloader")
+	progress.StartPhase("bootloader")
 	prg = progress.NewLoop("Installing boot loader")
 	args := []string{
 		fmt.Sprintf("%s/usr/bin/clr-boot-manager", rootDir),
@@ -231,6 +393,13 @@ func contentInstall(rootDir string, version string, model *model.SystemInstall)
 		fmt.Sprintf("--path=%s", rootDir),
 	}
 
+	// a forced boot mode may not match the running firmware and images boot on other
+	// machines, clr-boot-manager must then detect the bootloader from the target disk
+	// instead of the host
+	if model.BootMode != storage.BootModeAuto || model.ImageInstall() {
+		args = append(args, "--image")
+	}
+
 	err := cmd.RunAndLog(args...)
 	if err != nil {
 		return prg, errors.Wrap(err)
@@ -240,6 +409,98 @@ func contentInstall(rootDir string, version string, model *model.SystemInstall)
 	return nil, nil
 }
 
+// installBundles adds all the bundles in a single swupd operation, the installation
+// is aborted if a required bundle fails while the optional bundles failures are
+// recorded in the model's FailedBundles
+func installBundles(sw *swupd.SoftwareUpdater, bundles []string,
+	model *model.SystemInstall) (progress.Progress, error) {
+	model.FailedBundles = nil
+
+	log.Info("Installing bundles: %s", strings.Join(bundles, ", "))
+	prg := progress.MultiStep(100, "Installing %d bundles", len(bundles))
+
+	failed, err := sw.BundleAdd(bundles, prg)
+	if err != nil {
+		return prg, err
+	}
+
+	required := []string{}
+	for _, bundle := range failed {
+		if errLog := model.Telemetry.LogRecord("swupd", 2, "Failed to install bundle: "+bundle); errLog != nil {
+			log.Error("Failed to log Telemetry record for failed bundled: " + bundle)
+		}
+		log.Error("Failed to install bundle: %s", bundle)
+
+		if model.IsRequiredBundle(bundle) {
+			required = append(required, bundle)
+		} else {
+			model.FailedBundles = append(model.FailedBundles, bundle)
+		}
+	}
+
+	if len(required) > 0 {
+		return prg, errors.Errorf("Failed to install the required bundles: %s",
+			strings.Join(required, ", "))
+	}
+
+	// the optional bundles failures don't stop the installation
+	if len(failed) > 0 {
+		prg.Failure()
+		return nil, nil
+	}
+
+	prg.Partial(100)
+	prg.Success()
+
+	return nil, nil
+}
+
+// contentDir returns where the content partition of the installation rootDir is mounted
+func contentDir(rootDir string) string {
+	return filepath.Clean(rootDir) + "-content"
+}
+
+// contentURL returns the url of the local content of an offline installation, a
+// content partition is mounted read only next to rootDir
+func contentURL(rootDir string, model *model.SystemInstall) (string, error) {
+	if model.SwupdContent == "" {
+		return model.SwupdMirror, nil
+	}
+
+	if swupd.IsLocalURL(model.SwupdContent) {
+		return model.SwupdContent, nil
+	}
+
+	dir := model.SwupdContent
+
+	if strings.HasPrefix(model.SwupdContent, "/dev/") {
+		dir = contentDir(rootDir)
+		fsType := ""
+
+		// the device is not probed in dry-run mode, it may not even exist
+		if !plan.Enabled() {
+			w := bytes.NewBuffer(nil)
+
+			err := cmd.Run(w, "blkid", "-s", "TYPE", "-o", "value", model.SwupdContent)
+			if err != nil {
+				return "", errors.Errorf("Could not probe the content partition %s: %v",
+					model.SwupdContent, err)
+			}
+			fsType = strings.TrimSpace(w.String())
+		}
+
+		err := storage.GetMountManager(dir).Mount(model.SwupdContent, dir, fsType,
+			syscall.MS_RDONLY, "")
+		if err != nil {
+			return "", err
+		}
+	} else if _, err := os.Stat(dir); err != nil && !plan.Enabled() {
+		return "", errors.Errorf("Local content not found: %s", dir)
+	}
+
+	return swupd.ContentURL(dir)
+}
+
 // ConfigureNetwork applies the model/configured network interfaces
 func ConfigureNetwork(model *model.SystemInstall) error {
 	prg, err := configureNetwork(model)
@@ -269,6 +530,17 @@ func configureNetwork(model *model.SystemInstall) (progress.Progress, error) {
 		prg.Success()
 	}
 
+	// the network settings were not applied in dry-run mode
+	if plan.Enabled() {
+		return nil, nil
+	}
+
+	// offline installations don't need to reach the swupd mirror
+	if model.Offline() {
+		log.Info("Offline installation, skipping the connectivity test")
+		return nil, nil
+	}
+
 	prg := progress.NewLoop("Testing connectivity")
 	ok := false
 
@@ -311,10 +583,11 @@ func SaveInstallResults(rootDir string, md *model.SystemInstall) error {
 	}
 	// Sanitize the config data to remove any potential
 	// Personal Information from the data set
-	cleanModel.Users = nil      // Remove User Info
-	cleanModel.Hostname = ""    // Remove user defined hostname
-	cleanModel.HTTPSProxy = ""  // Remove user defined Proxy
-	cleanModel.SwupdMirror = "" // Remove user defined Swupd Mirror
+	cleanModel.Users = nil       // Remove User Info
+	cleanModel.Hostname = ""     // Remove user defined hostname
+	cleanModel.HTTPSProxy = ""   // Remove user defined Proxy
+	cleanModel.SwupdMirror = ""  // Remove user defined Swupd Mirror
+	cleanModel.SwupdContent = "" // Remove the installer media content source
 
 	var payload string
 	confBytes, bytesErr = yaml.Marshal(cleanModel)
@@ -376,8 +649,9 @@ func SaveInstallResults(rootDir string, md *model.SystemInstall) error {
 }
 
 // Cleanup executes post-install cleanups i.e unmount partition, remove
-// temporary directory etc.
-func Cleanup(rootDir string, umount bool) error {
+// temporary directory etc. The disk images are only finalized if installed,
+// i.e the installation succeeded
+func Cleanup(rootDir string, umount bool, installed bool) error {
 	var err error
 
 	log.Info("Cleaning up %s", rootDir)
@@ -385,9 +659,36 @@ func Cleanup(rootDir string, umount bool) error {
 	// we'll fail to umount only if a device is not mounted
 	// then, just log it and move cleaning up
 	if umount {
-		if storage.UmountAll() != nil {
+		if storage.GetMountManager(rootDir).UmountAll() != nil {
 			log.Warning("Failed to umount volumes")
 		}
+
+		if storage.GetMountManager(contentDir(rootDir)).UmountAll() != nil {
+			log.Warning("Failed to umount the content partition")
+		}
+
+		if storage.DeactivateVolumeGroups() != nil {
+			log.Warning("Failed to deactivate volume groups")
+		}
+
+		if storage.StopRaidArrays() != nil {
+			log.Warning("Failed to stop raid arrays")
+		}
+
+		if storage.UnmapAll() != nil {
+			log.Warning("Failed to close encrypted volumes")
+		}
+
+		if storage.DetachImages(installed) != nil {
+			log.Warning("Failed to finalize disk images")
+		}
+	}
+
+	// only the content partition's mount point is removed, never a content directory
+	if _, err = os.Stat(contentDir(rootDir)); err == nil {
+		if err = os.Remove(contentDir(rootDir)); err != nil {
+			log.Warning("Failed to remove %s: %v", contentDir(rootDir), err)
+		}
 	}
 
 	log.Info("Removing rootDir: %s", rootDir)
@@ -5,12 +5,12 @@
 package hostname
 
 import (
-	"io/ioutil"
 	"path/filepath"
 	"regexp"
 
 	"github.com/clearlinux/clr-installer/errors"
 	"github.com/clearlinux/clr-installer/log"
+	"github.com/clearlinux/clr-installer/plan"
 	"github.com/clearlinux/clr-installer/utils"
 )
 
@@ -49,7 +49,7 @@ func SetTargetHostname(rootDir string, hostname string) error {
 	hostBytes := []byte(hostname)
 
 	var err error
-	if err = ioutil.WriteFile(hostFile, hostBytes, 0644); err != nil {
+	if err = plan.WriteFile(hostFile, hostBytes, 0644); err != nil {
 		log.Error("Failed to create hostname file (%v) %q", err, hostFile)
 	}
 
@@ -19,8 +19,9 @@ import (
 // MassInstall is the frontend implementation for the "mass installer" it also
 // implements the progress interface: progress.Client
 type MassInstall struct {
-	prgDesc  string
-	prgIndex int
+	prgDesc    string
+	prgIndex   int
+	prgOverall string
 }
 
 // New creates a new instance of MassInstall frontend implementation
@@ -32,7 +33,7 @@ func New() *MassInstall {
 func (mi *MassInstall) Step() {
 	elms := []string{"|", "-", "\\", "|", "/", "-", "\\"}
 
-	fmt.Printf("%s [%s]\r", mi.prgDesc, elms[mi.prgIndex])
+	fmt.Printf("%s%s [%s]\r", mi.prgOverall, mi.prgDesc, elms[mi.prgIndex])
 
 	if mi.prgIndex+1 == len(elms) {
 		mi.prgIndex = 0
@@ -56,22 +57,29 @@ func (mi *MassInstall) Desc(desc string) {
 // Partial is part of the progress.Client implementation and sets the progress bar based
 // on actual progression
 func (mi *MassInstall) Partial(total int, step int) {
-	line := fmt.Sprintf("%s %.0f%%\r", mi.prgDesc, (float64(step)/float64(total))*100)
+	line := fmt.Sprintf("%s%s %.0f%%\r", mi.prgOverall, mi.prgDesc,
+		(float64(step)/float64(total))*100)
 	fmt.Printf("%s", line)
 }
 
+// Overall is part of the progress.Client implementation and prefixes the following
+// progress lines with the completion of the whole installation
+func (mi *MassInstall) Overall(total int, step int) {
+	mi.prgOverall = fmt.Sprintf("[%3.0f%%] ", (float64(step)/float64(total))*100)
+}
+
 // Success is part of the progress.Client implementation and represents the
 // successful progress completion of a task
 func (mi *MassInstall) Success() {
 	mi.prgIndex = 0
-	fmt.Printf("%s [success]\n", mi.prgDesc)
+	fmt.Printf("%s%s [success]\n", mi.prgOverall, mi.prgDesc)
 }
 
 // Failure is part of the progress.Client implementation and represents the
 // unsuccessful progress completion of a task
 func (mi *MassInstall) Failure() {
 	mi.prgIndex = 0
-	fmt.Printf("%s [*failed*]\n", mi.prgDesc)
+	fmt.Printf("%s%s [*failed*]\n", mi.prgOverall, mi.prgDesc)
 }
 
 // MustRun is part of the Frontend implementation and tells the core implementation that this
@@ -122,6 +130,12 @@ func (mi *MassInstall) Run(md *model.SystemInstall, rootDir string) (bool, error
 	instError = controller.Install(rootDir, md)
 	if instError != nil {
 		fmt.Printf("ERROR: Installation has failed!\n")
+
+		// release the target disks, a partially installed image is not finalized
+		if err := controller.Cleanup(rootDir, true, false); err != nil {
+			log.ErrorError(err)
+		}
+
 		return false, instError
 	}
 
@@ -132,11 +146,16 @@ func (mi *MassInstall) Run(md *model.SystemInstall, rootDir string) (bool, error
 	prg.Success()
 
 	prg = progress.NewLoop("Cleaning up install environment")
-	if err := controller.Cleanup(rootDir, true); err != nil {
+	if err := controller.Cleanup(rootDir, true, true); err != nil {
 		log.ErrorError(err)
 	}
 	prg.Success()
 
+	if len(md.FailedBundles) > 0 {
+		fmt.Printf("WARNING: The following bundles could not be installed: %s\n",
+			strings.Join(md.FailedBundles, ", "))
+	}
+
 	var reboot bool
 
 	if instError != nil {
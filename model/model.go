@@ -16,6 +16,7 @@ import (
 	"github.com/clearlinux/clr-installer/language"
 	"github.com/clearlinux/clr-installer/network"
 	"github.com/clearlinux/clr-installer/storage"
+	"github.com/clearlinux/clr-installer/swupd"
 	"github.com/clearlinux/clr-installer/telemetry"
 	"github.com/clearlinux/clr-installer/timezone"
 	"github.com/clearlinux/clr-installer/user"
@@ -31,10 +32,17 @@ var Version = "0.8.0"
 // medias, bundles to install and whatever state a install may require
 type SystemInstall struct {
 	TargetMedias      []*storage.BlockDevice `yaml:"targetMedia"`
+	VolumeGroups      []*storage.BlockDevice `yaml:"volumeGroups,omitempty"`
+	RaidArrays        []*storage.BlockDevice `yaml:"raidArrays,omitempty"`
+	PartitionScheme   string                 `yaml:"partitionScheme,omitempty"`
+	Swap              *storage.SwapConfig    `yaml:"swap,omitempty"`
+	BootMode          string                 `yaml:"bootMode,omitempty"`
+	AllowRemovable    bool                   `yaml:"allowRemovableMedia,omitempty"`
 	NetworkInterfaces []*network.Interface   `yaml:"networkInterfaces"`
 	Keyboard          *keyboard.Keymap       `yaml:"keyboard,omitempty,flow"`
 	Language          *language.Language     `yaml:"language,omitempty,flow"`
 	Bundles           []string               `yaml:"bundles,omitempty,flow"`
+	RequiredBundles   []string               `yaml:"requiredBundles,omitempty,flow"`
 	HTTPSProxy        string                 `yaml:"httpsProxy,omitempty,flow"`
 	Telemetry         *telemetry.Telemetry   `yaml:"telemetry,omitempty,flow"`
 	Timezone          *timezone.TimeZone     `yaml:"timezone,omitempty,flow"`
@@ -43,12 +51,14 @@ type SystemInstall struct {
 	Kernel            *kernel.Kernel         `yaml:"kernel,omitempty,flow"`
 	PostReboot        bool                   `yaml:"postReboot,omitempty,flow"`
 	SwupdMirror       string                 `yaml:"swupdMirror,omitempty,flow"`
+	SwupdContent      string                 `yaml:"swupdContent,omitempty,flow"`
 	PostArchive       bool                   `yaml:"postArchive,omitempty,flow"`
 	Hostname          string                 `yaml:"hostname,omitempty,flow"`
 	AutoUpdate        bool                   `yaml:"autoUpdate,omitempty,flow"`
 	TelemetryURL      string                 `yaml:"telemetryURL,omitempty,flow"`
 	TelemetryTID      string                 `yaml:"telemetryTID,omitempty,flow"`
 	TelemetryPolicy   string                 `yaml:"telemetryPolicy,omitempty,flow"`
+	FailedBundles     []string               `yaml:"-"` // optional bundles not installed
 }
 
 // ContainsBundle returns true if the data model has a bundle and false otherwise
@@ -62,6 +72,46 @@ func (si *SystemInstall) ContainsBundle(bundle string) bool {
 	return false
 }
 
+// IsRequiredBundle returns true if failing to install bundle aborts the installation,
+// the kernel bundle is always required
+func (si *SystemInstall) IsRequiredBundle(bundle string) bool {
+	if si.Kernel != nil && si.Kernel.Bundle == bundle {
+		return true
+	}
+
+	for _, curr := range si.RequiredBundles {
+		if curr == bundle {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TargetBundles returns all the bundles to install without duplicates: the required
+// ones, the kernel bundle and the optional ones
+func (si *SystemInstall) TargetBundles() []string {
+	bundles := append([]string{}, si.RequiredBundles...)
+	if si.Kernel != nil && si.Kernel.Bundle != "" {
+		bundles = append(bundles, si.Kernel.Bundle)
+	}
+	bundles = append(bundles, si.Bundles...)
+
+	res := []string{}
+	found := map[string]bool{}
+
+	for _, curr := range bundles {
+		if curr == "" || found[curr] {
+			continue
+		}
+
+		found[curr] = true
+		res = append(res, curr)
+	}
+
+	return res
+}
+
 // RemoveBundle removes a bundle from the data model
 func (si *SystemInstall) RemoveBundle(bundle string) {
 	bundles := []string{}
@@ -102,6 +152,12 @@ func (si *SystemInstall) AddUser(usr *user.User) {
 	si.Users = append(si.Users, usr)
 }
 
+// Offline returns true if the content is installed from a local directory or
+// content partition instead of the network
+func (si *SystemInstall) Offline() bool {
+	return si.SwupdContent != "" || swupd.IsLocalURL(si.SwupdMirror)
+}
+
 // Validate checks the model for possible inconsistencies or "minimum required"
 // information
 func (si *SystemInstall) Validate() error {
@@ -114,12 +170,26 @@ func (si *SystemInstall) Validate() error {
 		return errors.Errorf("System Installation must provide a target media")
 	}
 
-	for _, curr := range si.TargetMedias {
-		if err := curr.Validate(); err != nil {
+	// all the storage problems are reported at once
+	err := storage.ValidateLayout(si.TargetMedias, si.VolumeGroups, si.RaidArrays,
+		si.AllowRemovable, si.LegacyBoot())
+	if err != nil {
+		return err
+	}
+
+	if si.Swap != nil {
+		bds := append(append(append([]*storage.BlockDevice{}, si.TargetMedias...),
+			si.VolumeGroups...), si.RaidArrays...)
+
+		if err := si.Swap.Validate(bds); err != nil {
 			return err
 		}
 	}
 
+	if !storage.IsValidBootMode(si.BootMode) {
+		return errors.Errorf("Invalid boot mode: %s", si.BootMode)
+	}
+
 	if si.Keyboard == nil {
 		return errors.Errorf("Keyboard not set")
 	}
@@ -153,6 +223,51 @@ func (si *SystemInstall) AddTargetMedia(bd *storage.BlockDevice) {
 	si.TargetMedias = nList
 }
 
+// ResolveTargetMedias binds the target medias selected by stable identifiers or
+// rules to the disks currently found in the system
+func (si *SystemInstall) ResolveTargetMedias() error {
+	selectors := false
+	for _, curr := range si.TargetMedias {
+		if curr.HasSelector() {
+			selectors = true
+			break
+		}
+	}
+
+	if !selectors {
+		return nil
+	}
+
+	bds, err := storage.ListBlockDevices(nil)
+	if err != nil {
+		return err
+	}
+
+	return storage.ResolveTargetMedias(si.TargetMedias, bds)
+}
+
+// LegacyBoot returns true if the target system boots from legacy BIOS firmware, unless
+// forced by the descriptor the boot mode of the running system is used
+func (si *SystemInstall) LegacyBoot() bool {
+	mode := si.BootMode
+	if mode == storage.BootModeAuto {
+		mode = storage.DetectBootMode()
+	}
+
+	return mode == storage.BootModeBIOS
+}
+
+// ImageInstall returns true if any of the target medias is backed by an image file
+func (si *SystemInstall) ImageInstall() bool {
+	for _, curr := range si.TargetMedias {
+		if curr.IsImage() {
+			return true
+		}
+	}
+
+	return false
+}
+
 // AddNetworkInterface adds an Interface instance to the list of NetworkInterfaces
 func (si *SystemInstall) AddNetworkInterface(iface *network.Interface) {
 	if si.NetworkInterfaces == nil {
@@ -187,6 +302,32 @@ func LoadFile(path string) (*SystemInstall, error) {
 	return &result, nil
 }
 
+// ApplyPartitionScheme partitions the first target media according to the model's
+// partition scheme, if any, unless it was declared with partitions. The other target
+// medias are left as declared. Target medias selected by identifiers or rules must be
+// resolved first, see ResolveTargetMedias()
+func (si *SystemInstall) ApplyPartitionScheme() error {
+	if si.PartitionScheme == "" || len(si.TargetMedias) == 0 {
+		return nil
+	}
+
+	disk := si.TargetMedias[0]
+	if len(disk.Children) > 0 {
+		return nil
+	}
+
+	scheme, err := storage.FindPartitionScheme(si.PartitionScheme)
+	if err != nil {
+		return err
+	}
+
+	if !si.Swap.UsesPartitions() {
+		scheme = scheme.WithoutSwap()
+	}
+
+	return scheme.Apply(disk)
+}
+
 // EnableTelemetry operates on the telemetry flag and enables or disables the target
 // systems telemetry support based in enable argument
 func (si *SystemInstall) EnableTelemetry(enable bool) {
@@ -5,11 +5,13 @@
 package model
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/clearlinux/clr-installer/storage"
 	"github.com/clearlinux/clr-installer/user"
 	"github.com/clearlinux/clr-installer/utils"
 )
@@ -29,13 +31,30 @@ func TestLoadFile(t *testing.T) {
 	}{
 		{"basic-invalid-descriptor.yaml", false},
 		{"basic-valid-descriptor.yaml", true},
+		{"encrypted-descriptor.yaml", true},
 		{"invalid-no-keyboard.yaml", false},
 		{"invalid-no-language.yaml", false},
+		{"lvm-descriptor.yaml", true},
 		{"malformed-descriptor.yaml", false},
 		{"no-bootable-descriptor.yaml", false},
 		{"no-root-partition-descriptor.yaml", false},
 		{"no-telemetry.yaml", false},
+		{"raid-descriptor.yaml", true},
+		{"btrfs-subvolumes-descriptor.yaml", true},
+		{"existing-partitions-descriptor.yaml", true},
+		{"mount-options-descriptor.yaml", true},
+		{"relative-sizes-descriptor.yaml", true},
+		{"partition-scheme-descriptor.yaml", true},
+		{"swap-file-descriptor.yaml", true},
+		{"legacy-boot-descriptor.yaml", true},
+		{"invalid-boot-mode-descriptor.yaml", false},
+		{"image-descriptor.yaml", true},
+		{"disk-selector-descriptor.yaml", true},
+		{"mkfs-options-descriptor.yaml", true},
+		{"multi-disk-descriptor.yaml", true},
+		{"offline-descriptor.yaml", true},
 		{"real-example.yaml", true},
+		{"required-bundles-descriptor.yaml", true},
 		{"valid-network.yaml", true},
 	}
 
@@ -47,6 +66,14 @@ func TestLoadFile(t *testing.T) {
 			t.Fatalf("%s is a valid tests and shouldn't return an error: %v", curr.file, err)
 		}
 
+		if err == nil {
+			err = model.ApplyPartitionScheme()
+		}
+
+		if curr.valid && err != nil {
+			t.Fatalf("%s is a valid tests and shouldn't return an error: %v", curr.file, err)
+		}
+
 		err = model.Validate()
 		if curr.valid && err != nil {
 			t.Fatalf("%s is a valid tests and shouldn't return an error: %v", curr.file, err)
@@ -72,6 +99,57 @@ func TestEnableTelemetry(t *testing.T) {
 	}
 }
 
+func TestTargetBundles(t *testing.T) {
+	path := filepath.Join(testsDir, "required-bundles-descriptor.yaml")
+	model, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[os-core os-core-update sysadmin-basic kernel-native editors git]"
+	if bundles := model.TargetBundles(); fmt.Sprint(bundles) != expected {
+		t.Fatalf("Invalid target bundles for %s: %v, expected %s", path, bundles, expected)
+	}
+
+	for _, curr := range []string{"sysadmin-basic", "kernel-native"} {
+		if !model.IsRequiredBundle(curr) {
+			t.Fatalf("Bundle %s should be required", curr)
+		}
+	}
+
+	if model.IsRequiredBundle("editors") {
+		t.Fatal("Bundle editors should be optional")
+	}
+}
+
+func TestOffline(t *testing.T) {
+	si := &SystemInstall{}
+
+	if si.Offline() {
+		t.Fatal("Installations should not be offline by default")
+	}
+
+	si.SwupdMirror = "https://download.clearlinux.org/update/"
+	if si.Offline() {
+		t.Fatal("Installations from a remote mirror should not be offline")
+	}
+
+	si.SwupdMirror = "file:///run/media/content"
+	if !si.Offline() {
+		t.Fatal("Installations from a local mirror should be offline")
+	}
+
+	path := filepath.Join(testsDir, "offline-descriptor.yaml")
+	model, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !model.Offline() || model.SwupdContent != "/dev/sdb3" {
+		t.Fatalf("Invalid content source for %s: %q", path, model.SwupdContent)
+	}
+}
+
 func TestUnreadable(t *testing.T) {
 	file, err := ioutil.TempFile("", "test-")
 	if err != nil {
@@ -159,6 +237,34 @@ func TestAddTargetMedia(t *testing.T) {
 	}
 }
 
+func TestApplyPartitionScheme(t *testing.T) {
+	path := filepath.Join(testsDir, "partition-scheme-descriptor.yaml")
+	loaded, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded.TargetMedias[0].Children) != 0 {
+		t.Fatal("The partition scheme should not be applied when loading")
+	}
+
+	second := &storage.BlockDevice{Name: "sdb", Type: storage.BlockDeviceTypeDisk, Size: 20 << 30}
+	loaded.TargetMedias = append(loaded.TargetMedias, second)
+
+	if err = loaded.ApplyPartitionScheme(); err != nil {
+		t.Fatalf("Should have applied the partition scheme: %v", err)
+	}
+
+	disk := loaded.TargetMedias[0]
+	if len(disk.Children) == 0 || disk.Children[0].Name != "sda1" {
+		t.Fatal("The partition scheme should be applied to the first target media")
+	}
+
+	if len(second.Children) != 0 {
+		t.Fatal("The partition scheme should only be applied to the first target media")
+	}
+}
+
 func TestAddNetworkInterface(t *testing.T) {
 	path := filepath.Join(testsDir, "valid-network.yaml")
 	loaded, err := LoadFile(path)
@@ -7,6 +7,7 @@ package network
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -19,6 +20,7 @@ import (
 	"github.com/clearlinux/clr-installer/cmd"
 	"github.com/clearlinux/clr-installer/errors"
 	"github.com/clearlinux/clr-installer/log"
+	"github.com/clearlinux/clr-installer/plan"
 )
 
 // Interface is a network interface representation and wraps the net' package Interface struct
@@ -279,7 +281,7 @@ func netMaskToCIDR(mask string) (num int, err error) {
 	return bits, nil
 }
 
-func (i *Interface) applyStatic(root string, file *os.File) error {
+func (i *Interface) applyStatic(root string, file io.Writer) error {
 	config := `[Match]
 Name={{.Name}}
 
@@ -334,6 +336,11 @@ func (i *Interface) Apply(root string) error {
 			return nil
 		}
 
+		if plan.Enabled() {
+			plan.Add("remove %s", filePath)
+			return nil
+		}
+
 		if err := os.Remove(filePath); err != nil {
 			return err
 		}
@@ -341,12 +348,16 @@ func (i *Interface) Apply(root string) error {
 		return nil
 	}
 
-	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
+	w := bytes.NewBuffer(nil)
+	if err := i.applyStatic(root, w); err != nil {
+		return err
+	}
+
+	if err := plan.WriteFile(filePath, w.Bytes(), 0644); err != nil {
 		return errors.Wrap(err)
 	}
 
-	return i.applyStatic(root, f)
+	return nil
 }
 
 // Apply does apply the configurations of a set of interfaces to the running system
@@ -355,7 +366,7 @@ func Apply(root string, ifaces []*Interface) error {
 		return errors.Errorf("Could not apply network settings, Invalid root directory: %s", root)
 	}
 
-	if _, err := os.Stat(configDir); os.IsNotExist(err) {
+	if _, err := os.Stat(configDir); os.IsNotExist(err) && !plan.Enabled() {
 		if err = os.MkdirAll(configDir, 0777); err != nil {
 			return errors.Wrap(err)
 		}
@@ -0,0 +1,168 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/log"
+)
+
+// Entry is a single action the installation would take
+type Entry struct {
+	Step    string   `json:"step"`
+	Action  string   `json:"action"`
+	Command []string `json:"command,omitempty"`
+}
+
+// Progress is a progress.Client implementation which only logs the progress
+// descriptions, it's meant to be used while planning
+type Progress struct{}
+
+var (
+	enabled bool
+	step    string
+	entries []*Entry
+	mutex   sync.Mutex
+)
+
+// Enable turns the dry-run mode on or off, when on the destructive actions are
+// recorded as plan entries instead of being executed
+func Enable(enable bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	enabled = enable
+	step = ""
+	entries = []*Entry{}
+}
+
+// Enabled returns true if running in dry-run mode
+func Enabled() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return enabled
+}
+
+// SetStep sets the installation step the following entries belong to
+func SetStep(name string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	step = name
+}
+
+func add(action string, command []string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !enabled {
+		return
+	}
+
+	entries = append(entries, &Entry{Step: step, Action: action, Command: command})
+}
+
+// Add records an action in the plan, no-op if not running in dry-run mode
+func Add(format string, a ...interface{}) {
+	add(fmt.Sprintf(format, a...), nil)
+}
+
+// AddCommand records the execution of a command in the plan, no-op if not
+// running in dry-run mode
+func AddCommand(args ...string) {
+	add("run", args)
+}
+
+// WriteFile writes data to the file path, in dry-run mode the write is
+// recorded in the plan instead
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	if Enabled() {
+		Add("write %s", path)
+		return nil
+	}
+
+	return ioutil.WriteFile(path, data, perm)
+}
+
+// Entries returns the recorded plan entries
+func Entries() []*Entry {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return append([]*Entry{}, entries...)
+}
+
+// String returns the text representation of the entry
+func (e *Entry) String() string {
+	if len(e.Command) > 0 {
+		return fmt.Sprintf("[%s] %s: %s", e.Step, e.Action, strings.Join(e.Command, " "))
+	}
+
+	return fmt.Sprintf("[%s] %s", e.Step, e.Action)
+}
+
+// WriteText writes the recorded plan to w, one entry per line
+func WriteText(w io.Writer) error {
+	for _, curr := range Entries() {
+		if _, err := fmt.Fprintln(w, curr.String()); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// WriteJSON writes the recorded plan to w in JSON format
+func WriteJSON(w io.Writer) error {
+	root := struct {
+		Plan []*Entry `json:"plan"`
+	}{Entries()}
+
+	data, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	if _, err = fmt.Fprintln(w, string(data)); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+// Desc is part of the progress.Client implementation
+func (p Progress) Desc(desc string) {
+	log.Debug("Planning: %s", desc)
+}
+
+// Partial is part of the progress.Client implementation
+func (p Progress) Partial(total int, step int) {}
+
+// Step is part of the progress.Client implementation
+func (p Progress) Step() {}
+
+// Overall is part of the progress.Client implementation
+func (p Progress) Overall(total int, step int) {}
+
+// Success is part of the progress.Client implementation
+func (p Progress) Success() {}
+
+// Failure is part of the progress.Client implementation
+func (p Progress) Failure() {}
+
+// LoopWaitDuration is part of the progress.Client implementation
+func (p Progress) LoopWaitDuration() time.Duration {
+	return time.Second
+}
@@ -0,0 +1,94 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package plan
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDisabled(t *testing.T) {
+	Enable(false)
+
+	Add("mount %s", "/dev/sda1")
+	AddCommand("mkfs.ext4", "/dev/sda1")
+
+	if len(Entries()) != 0 {
+		t.Fatalf("Entries should not be recorded if not in dry-run mode")
+	}
+
+	dir, err := ioutil.TempDir("", "plan-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "file")
+	if err = WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatalf("Should have written the file: %v", err)
+	}
+
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("File should exist: %v", err)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	Enable(true)
+	defer Enable(false)
+
+	SetStep("storage")
+	AddCommand("mkfs.ext4", "/dev/sda1")
+	Add("mount %s at %s", "/dev/sda1", "/tmp/install")
+
+	path := filepath.Join(os.TempDir(), "plan-test-not-written")
+	if err := WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatalf("Should have recorded the file: %v", err)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		t.Fatalf("File should not be written in dry-run mode")
+	}
+
+	entries := Entries()
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+
+	if entries[0].String() != "[storage] run: mkfs.ext4 /dev/sda1" {
+		t.Fatalf("Wrong entry: %s", entries[0].String())
+	}
+
+	w := bytes.NewBuffer(nil)
+	if err := WriteText(w); err != nil {
+		t.Fatalf("Should have written the plan: %v", err)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(w.String()), "\n"); len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got: %s", w.String())
+	}
+
+	w.Reset()
+	if err := WriteJSON(w); err != nil {
+		t.Fatalf("Should have written the plan: %v", err)
+	}
+
+	root := struct {
+		Plan []*Entry `json:"plan"`
+	}{}
+
+	if err := json.Unmarshal(w.Bytes(), &root); err != nil {
+		t.Fatalf("Should have produced valid JSON: %v", err)
+	}
+
+	if len(root.Plan) != 3 || root.Plan[1].Step != "storage" {
+		t.Fatalf("Wrong JSON plan: %s", w.String())
+	}
+}
@@ -6,6 +6,7 @@ package progress
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -32,6 +33,10 @@ type Client interface {
 	// LoopWaitDuration gives the implementation the opportunity configure the loop progress
 	// step period
 	LoopWaitDuration() time.Duration
+
+	// Overall is called whenever the completion of the whole installation changes, it's
+	// based on the weights of the phases set with SetPhases
+	Overall(total int, step int)
 }
 
 // Progress is the internal interface for the progress subsystem, currently we have
@@ -53,8 +58,19 @@ type Loop struct {
 	done chan bool
 }
 
+// Phase is a step of the whole installation, its weight is relative to the other
+// phases' and should reflect the time it takes
+type Phase struct {
+	Name   string
+	Weight int
+}
+
 var (
 	impl Client
+
+	phases     []Phase
+	phaseIdx   = -1
+	phaseMutex sync.Mutex
 )
 
 // Set defines the default progress client implementation
@@ -62,6 +78,87 @@ func Set(pi Client) {
 	impl = pi
 }
 
+// SetPhases defines the weighted phases of the overall progress, no phase is started
+func SetPhases(p []Phase) {
+	phaseMutex.Lock()
+	defer phaseMutex.Unlock()
+
+	phases = p
+	phaseIdx = -1
+}
+
+// phasesTotal returns the sum of the weights of all phases
+func phasesTotal() int {
+	total := 0
+
+	for _, curr := range phases {
+		total = total + curr.Weight
+	}
+
+	return total
+}
+
+// reportOverall notifies the implementation of the overall completion, the current
+// phase is completed by total/step
+func reportOverall(total int, step int) {
+	phaseMutex.Lock()
+	defer phaseMutex.Unlock()
+
+	sum := phasesTotal()
+	if impl == nil || phaseIdx < 0 || phaseIdx >= len(phases) || total <= 0 || sum <= 0 {
+		return
+	}
+
+	if step > total {
+		step = total
+	}
+
+	done := 0
+	for _, curr := range phases[:phaseIdx] {
+		done = done + curr.Weight
+	}
+
+	// the weights are scaled so the partial completion of a phase is not lost
+	scaled := done*total + phases[phaseIdx].Weight*step
+	impl.Overall(sum*total, scaled)
+}
+
+// StartPhase starts the phase name, the previous phases are considered completed
+// and the phases not set with SetPhases are ignored
+func StartPhase(name string) {
+	phaseMutex.Lock()
+	idx := -1
+	for i, curr := range phases {
+		if curr.Name == name {
+			idx = i
+			break
+		}
+	}
+
+	// phases never go back i.e a step repeated later in the installation
+	if idx <= phaseIdx {
+		phaseMutex.Unlock()
+		return
+	}
+
+	phaseIdx = idx
+	phaseMutex.Unlock()
+
+	reportOverall(1, 0)
+}
+
+// Complete notifies the implementation the whole installation is completed
+func Complete() {
+	phaseMutex.Lock()
+	ok := impl != nil && len(phases) > 0
+	phaseIdx = len(phases)
+	phaseMutex.Unlock()
+
+	if ok {
+		impl.Overall(1, 1)
+	}
+}
+
 // MultiStep creates a new MultiStep implementation
 func MultiStep(total int, format string, a ...interface{}) Progress {
 	if impl == nil {
@@ -120,6 +217,7 @@ func (prg *Loop) Failure() {
 // set of steps for the MultiStep progress implementation
 func (prg *BaseProgress) Partial(step int) {
 	impl.Partial(prg.total, step)
+	reportOverall(prg.total, step)
 }
 
 // Success is the common BaseProgress implementation and simply notify the actual
@@ -0,0 +1,78 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package progress
+
+import (
+	"testing"
+	"time"
+)
+
+// testClient records the overall completion percentages
+type testClient struct {
+	overall []int
+}
+
+func (tc *testClient) Desc(desc string) {}
+
+func (tc *testClient) Partial(total int, step int) {}
+
+func (tc *testClient) Step() {}
+
+func (tc *testClient) Success() {}
+
+func (tc *testClient) Failure() {}
+
+func (tc *testClient) LoopWaitDuration() time.Duration {
+	return time.Millisecond
+}
+
+func (tc *testClient) Overall(total int, step int) {
+	tc.overall = append(tc.overall, 100*step/total)
+}
+
+func TestOverall(t *testing.T) {
+	tc := &testClient{}
+	Set(tc)
+	defer Set(nil)
+
+	SetPhases([]Phase{
+		{Name: "storage", Weight: 10},
+		{Name: "swupd", Weight: 60},
+		{Name: "bundles", Weight: 30},
+	})
+	defer SetPhases(nil)
+
+	// no phase is started yet
+	prg := MultiStep(100, "Wiping")
+	prg.Partial(50)
+
+	StartPhase("storage")
+	prg.Partial(50)
+
+	StartPhase("swupd")
+	prg = MultiStep(100, "Installing the base system")
+	prg.Partial(50)
+
+	// unknown and past phases are ignored
+	StartPhase("unknown")
+	StartPhase("storage")
+
+	StartPhase("bundles")
+	prg = MultiStep(4, "Installing bundles")
+	prg.Partial(1)
+
+	Complete()
+
+	expected := []int{0, 5, 10, 40, 70, 77, 100}
+	if len(tc.overall) != len(expected) {
+		t.Fatalf("Reported overall progress %v, expected %v", tc.overall, expected)
+	}
+
+	for idx, curr := range expected {
+		if tc.overall[idx] != curr {
+			t.Fatalf("Reported overall progress %v, expected %v", tc.overall, expected)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"os"
+)
+
+const (
+	// BootModeAuto uses the boot mode the installer itself was booted with
+	BootModeAuto = ""
+
+	// BootModeUEFI installs a system booted by UEFI firmware from the EFI partition
+	BootModeUEFI = "uefi"
+
+	// BootModeBIOS installs a system booted by legacy BIOS firmware, the /boot
+	// partition is flagged as the legacy boot partition
+	BootModeBIOS = "bios"
+)
+
+var (
+	// efiFirmwareDir only exists if the running system was booted by UEFI firmware
+	efiFirmwareDir = "/sys/firmware/efi"
+
+	// legacyBootFileSystems are the /boot file systems the legacy BIOS boot loader
+	// installed by clr-boot-manager, extlinux, is able to boot from
+	legacyBootFileSystems = []string{"vfat", "ext2", "ext3", "ext4"}
+)
+
+// DetectBootMode returns the boot mode of the running system
+func DetectBootMode() string {
+	if _, err := os.Stat(efiFirmwareDir); err == nil {
+		return BootModeUEFI
+	}
+
+	return BootModeBIOS
+}
+
+// IsValidBootMode returns true if mode is a known boot mode
+func IsValidBootMode(mode string) bool {
+	return mode == BootModeAuto || mode == BootModeUEFI || mode == BootModeBIOS
+}
+
+// isLegacyBootPartition returns true if bd is the partition legacy BIOS boots from
+func (bd *BlockDevice) isLegacyBootPartition() bool {
+	return bd.MountPoint == "/boot"
+}
+
+// isLegacyBootFileSystem returns true if legacy BIOS can boot from a /boot partition
+// formatted with fsType
+func isLegacyBootFileSystem(fsType string) bool {
+	for _, curr := range legacyBootFileSystems {
+		if fsType == curr {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,210 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/plan"
+)
+
+// A Subvolume describes a btrfs subvolume and where it's mounted
+type Subvolume struct {
+	Name       string `yaml:"name"`
+	MountPoint string `yaml:"mountpoint,omitempty"`
+	Options    string `yaml:"options,omitempty"`
+}
+
+// mountData returns the mount data used to mount the subvolume
+func (sv *Subvolume) mountData() string {
+	data := fmt.Sprintf("subvol=%s", sv.Name)
+
+	if sv.Options != "" {
+		data = data + "," + sv.Options
+	}
+
+	return data
+}
+
+// mainMountPoint returns the mount point representing bd, for btrfs partitions
+// mounted only by its subvolumes that's the top most subvolume's mount point
+func (bd *BlockDevice) mainMountPoint() string {
+	if bd.MountPoint != "" || len(bd.Subvolumes) == 0 {
+		return bd.MountPoint
+	}
+
+	res := ""
+	for _, sv := range bd.Subvolumes {
+		if sv.MountPoint == "" {
+			continue
+		}
+
+		if res == "" || len(sv.MountPoint) < len(res) {
+			res = sv.MountPoint
+		}
+	}
+
+	return res
+}
+
+// MountTargets returns the list of block devices to be mounted for bd, for btrfs
+// partitions with subvolumes one block device is returned for each mounted subvolume
+func (bd *BlockDevice) MountTargets() []*BlockDevice {
+	res := []*BlockDevice{}
+
+	if bd.MountPoint != "" {
+		res = append(res, bd)
+	}
+
+	for _, sv := range bd.Subvolumes {
+		if sv.MountPoint == "" {
+			continue
+		}
+
+		target := *bd
+		target.MountPoint = sv.MountPoint
+		target.Subvolumes = nil
+		target.subvolume = sv
+
+		res = append(res, &target)
+	}
+
+	return res
+}
+
+// withBtrfsMounted temporarily mounts the btrfs top level volume of bd and calls fn
+// with the mount directory, the volume is not tracked by UmountAll()
+func (bd *BlockDevice) withBtrfsMounted(fn func(dir string) error) error {
+	if plan.Enabled() {
+		dir := filepath.Join(os.TempDir(), "btrfs-"+bd.Name)
+		plan.Add("mount %s at %s", bd.GetMappedDeviceFile(), dir)
+		return fn(dir)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "btrfs-")
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	defer func() {
+		_ = os.Remove(tmpDir)
+	}()
+
+	if err = syscall.Mount(bd.GetMappedDeviceFile(), tmpDir, "btrfs", 0, ""); err != nil {
+		return errors.Errorf("mount %s: %v", tmpDir, err)
+	}
+
+	defer func() {
+		_ = syscall.Unmount(tmpDir, 0)
+	}()
+
+	return fn(tmpDir)
+}
+
+// createSubvolumes temporarily mounts the btrfs top level volume and creates the
+// configured subvolumes
+func (bd *BlockDevice) createSubvolumes() error {
+	if len(bd.Subvolumes) == 0 {
+		return nil
+	}
+
+	// create parents before nested subvolumes
+	names := []string{}
+	for _, sv := range bd.Subvolumes {
+		names = append(names, sv.Name)
+	}
+	sort.Strings(names)
+
+	return bd.withBtrfsMounted(func(dir string) error {
+		for _, name := range names {
+			args := []string{
+				"btrfs",
+				"subvolume",
+				"create",
+				filepath.Join(dir, name),
+			}
+
+			if err := cmd.RunAndLog(args...); err != nil {
+				return errors.Wrap(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// validateSubvolumes checks the subvolumes are only defined for btrfs partitions,
+// are named and have valid and unique mount points
+func (bd *BlockDevice) validateSubvolumes() error {
+	if len(bd.Subvolumes) == 0 {
+		return nil
+	}
+
+	if bd.FsType != "btrfs" {
+		return errors.Errorf("Subvolumes are only supported by btrfs, %s is %s",
+			bd.Name, bd.FsType)
+	}
+
+	names := map[string]bool{}
+	mounts := map[string]bool{}
+
+	for _, sv := range bd.Subvolumes {
+		if sv.Name == "" || strings.HasPrefix(sv.Name, "/") {
+			return errors.Errorf("Invalid subvolume name for %s: %q", bd.Name, sv.Name)
+		}
+
+		if names[sv.Name] {
+			return errors.Errorf("Duplicated subvolume for %s: %s", bd.Name, sv.Name)
+		}
+		names[sv.Name] = true
+
+		if sv.MountPoint == "" {
+			continue
+		}
+
+		if msg := IsValidMount(sv.MountPoint); msg != "" {
+			return errors.Errorf("%s: %s", msg, sv.MountPoint)
+		}
+
+		if mounts[sv.MountPoint] || sv.MountPoint == bd.MountPoint {
+			return errors.Errorf("Duplicated mount point for %s: %s", bd.Name, sv.MountPoint)
+		}
+		mounts[sv.MountPoint] = true
+	}
+
+	return nil
+}
+
+// SubvolumeKernelCmdline returns the kernel command line arguments required to
+// boot from a root file system in a btrfs subvolume, bds are searched as well as
+// their children
+func SubvolumeKernelCmdline(bds []*BlockDevice) string {
+	devices := []*BlockDevice{}
+
+	for _, bd := range bds {
+		devices = append(devices, bd)
+		devices = append(devices, bd.Children...)
+	}
+
+	for _, curr := range devices {
+		for _, sv := range curr.Subvolumes {
+			if sv.MountPoint != "/" {
+				continue
+			}
+
+			return fmt.Sprintf("rootflags=%s", sv.mountData())
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,150 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+)
+
+// FileSystem describes how a file system is created and resized,
+// file systems are made available to the installer with RegisterFileSystem()
+type FileSystem struct {
+	// Name is the file system type as used by the descriptors, mount(2) and fstab
+	Name string
+
+	// MakeFsCommand is the mkfs command and its arguments, the label option, the
+	// partition's mkfsOptions and its device file are appended to it
+	MakeFsCommand []string
+
+	// LabelOption is the mkfs option setting the file system label
+	LabelOption string
+
+	// MaxLabelLength is the longest label supported, 0 if labels are not supported
+	MaxLabelLength int
+
+	// MakeFs creates the file system instead of MakeFsCommand if set
+	MakeFs func(bd *BlockDevice) error
+
+	// PostMakeFs is called once the file system is created, may be nil
+	PostMakeFs func(bd *BlockDevice) error
+
+	// GUID is the partition type guid, the mount point based one is used if empty
+	GUID string
+
+	// MinSize and Resize are required to shrink existing partitions, may be nil
+	MinSize func(bd *BlockDevice) (uint64, error)
+	Resize  func(bd *BlockDevice, size uint64) error
+}
+
+var (
+	fileSystems = map[string]*FileSystem{}
+)
+
+// RegisterFileSystem makes fs available to the installer, it's an error to register
+// a file system twice or without a way of creating it
+func RegisterFileSystem(fs *FileSystem) error {
+	if fs == nil || fs.Name == "" {
+		return errors.Errorf("File systems must be named")
+	}
+
+	if fs.MakeFs == nil && len(fs.MakeFsCommand) == 0 {
+		return errors.Errorf("No mkfs command for file system: %s", fs.Name)
+	}
+
+	if _, ok := fileSystems[fs.Name]; ok {
+		return errors.Errorf("File system already registered: %s", fs.Name)
+	}
+
+	fileSystems[fs.Name] = fs
+	return nil
+}
+
+// LookupFileSystem returns the registered file system named name
+func LookupFileSystem(name string) (*FileSystem, bool) {
+	fs, ok := fileSystems[name]
+	return fs, ok
+}
+
+// IsAvailable returns true if the tools creating fs exist in the host
+func (fs *FileSystem) IsAvailable() bool {
+	if len(fs.MakeFsCommand) == 0 {
+		return true
+	}
+
+	_, err := exec.LookPath(fs.MakeFsCommand[0])
+	return err == nil
+}
+
+// makeFs creates the file system in bd
+func (fs *FileSystem) makeFs(bd *BlockDevice) error {
+	if fs.MakeFs != nil {
+		if err := fs.MakeFs(bd); err != nil {
+			return err
+		}
+	} else {
+		args := append([]string{}, fs.MakeFsCommand...)
+
+		if bd.Label != "" && fs.LabelOption != "" {
+			args = append(args, fs.LabelOption, bd.Label)
+		}
+
+		args = append(args, strings.Fields(bd.MkfsOptions)...)
+		args = append(args, bd.GetMappedDeviceFile())
+
+		if err := cmd.RunAndLog(args...); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+
+	if fs.PostMakeFs != nil {
+		return fs.PostMakeFs(bd)
+	}
+
+	return nil
+}
+
+// SupportedFileSystems exposes the currently registered file systems
+func SupportedFileSystems() []string {
+	res := []string{}
+
+	for key := range fileSystems {
+		res = append(res, key)
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+// AvailableFileSystems returns the registered file systems whose tools exist in the host
+func AvailableFileSystems() []string {
+	res := []string{}
+
+	for _, curr := range SupportedFileSystems() {
+		if fileSystems[curr].IsAvailable() {
+			res = append(res, curr)
+		}
+	}
+
+	return res
+}
+
+// LargestFileSystemName returns the lengh of the largest supported file system name
+func LargestFileSystemName() int {
+	res := 0
+
+	for key := range fileSystems {
+		fsl := len(key)
+		if fsl > res {
+			res = fsl
+		}
+	}
+
+	return res
+}
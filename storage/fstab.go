@@ -0,0 +1,198 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/plan"
+	"github.com/clearlinux/clr-installer/utils"
+)
+
+var (
+	// mountFlags maps the mount options handled by the kernel as mount flags
+	mountFlags = map[string]uintptr{
+		"noatime":     syscall.MS_NOATIME,
+		"nodiratime":  syscall.MS_NODIRATIME,
+		"relatime":    syscall.MS_RELATIME,
+		"strictatime": syscall.MS_STRICTATIME,
+		"sync":        syscall.MS_SYNCHRONOUS,
+		"dirsync":     syscall.MS_DIRSYNC,
+	}
+
+	// skippedMountOptions are not passed to the kernel during the installation, they
+	// are only written to fstab. Those are either only meaningful to mount(8) and
+	// systemd, the kernel's default behavior, i.e exec, or would restrict what the
+	// installation can do in the target, i.e ro, noexec, nosuid or nodev
+	skippedMountOptions = []string{"defaults", "rw", "auto", "noauto", "nofail",
+		"user", "nouser", "users", "_netdev", "x-", "ro", "noexec", "nosuid", "nodev",
+		"exec", "suid", "dev", "async", "atime", "diratime", "nostrictatime", "lazytime",
+		"nolazytime", "mand", "nomand", "iversion", "noiversion", "silent", "loud"}
+)
+
+func isSkippedMountOption(opt string) bool {
+	for _, curr := range skippedMountOptions {
+		if opt == curr || (strings.HasSuffix(curr, "-") && strings.HasPrefix(opt, curr)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseMountOptions splits a fstab like comma separated list of options in the
+// mount flags and the file system specific data passed to mount(2), relatime
+// is used unless an access time option is given
+func parseMountOptions(options string) (uintptr, string) {
+	var flags uintptr
+	data := []string{}
+	atime := false
+
+	for _, opt := range strings.Split(options, ",") {
+		if opt == "" || isSkippedMountOption(opt) {
+			continue
+		}
+
+		if flag, ok := mountFlags[opt]; ok {
+			flags = flags | flag
+
+			if strings.HasSuffix(opt, "atime") {
+				atime = true
+			}
+			continue
+		}
+
+		data = append(data, opt)
+	}
+
+	if !atime {
+		flags = flags | syscall.MS_RELATIME
+	}
+
+	return flags, strings.Join(data, ",")
+}
+
+// fstabOptions returns the options column of bd's fstab entry
+func (bd *BlockDevice) fstabOptions() string {
+	opts := []string{}
+
+	if bd.subvolume != nil {
+		opts = append(opts, bd.subvolume.mountData())
+	}
+
+	if bd.MountOptions != "" {
+		opts = append(opts, bd.MountOptions)
+	}
+
+	if len(opts) == 0 {
+		return "defaults"
+	}
+
+	return strings.Join(opts, ",")
+}
+
+// fstabDevice returns the device column of bd's fstab entry, encrypted partitions
+// and logical volumes are referred by their device path while partitions are
+// referred by their file system UUID, or PARTUUID if the file system has none
+func (bd *BlockDevice) fstabDevice() (string, error) {
+	// the file systems don't exist in dry-run mode
+	if bd.Encrypted || bd.Type == BlockDeviceTypeLVM2Volume || plan.Enabled() {
+		return bd.GetMappedDeviceFile(), nil
+	}
+
+	for _, tag := range []string{"UUID", "PARTUUID"} {
+		w := bytes.NewBuffer(nil)
+
+		err := cmd.Run(w, "blkid", "-s", tag, "-o", "value", bd.GetMappedDeviceFile())
+		if err == nil && strings.TrimSpace(w.String()) != "" {
+			return fmt.Sprintf("%s=%s", tag, strings.TrimSpace(w.String())), nil
+		}
+	}
+
+	return "", errors.Errorf("Could not determine the UUID of: %s", bd.GetMappedDeviceFile())
+}
+
+// fstabEntry formats bd's fstab line using dev as the device column
+func (bd *BlockDevice) fstabEntry(dev string) string {
+	if bd.FsType == "swap" {
+		return fmt.Sprintf("%s none swap %s 0 0", dev, bd.fstabOptions())
+	}
+
+	// btrfs is not checked at boot, fsck.btrfs does nothing
+	pass := 0
+	if bd.MountPoint == "/" && bd.FsType != "btrfs" {
+		pass = 1
+	} else if strings.HasPrefix(bd.FsType, "ext") {
+		pass = 2
+	}
+
+	return fmt.Sprintf("%s %s %s %s 0 %d", dev, bd.MountPoint, bd.FsType, bd.fstabOptions(), pass)
+}
+
+// WriteFstab writes the target's /etc/fstab with an entry for every target, targets
+// are the mount targets as returned by MountTargets() and the swap devices, extra
+// entries are appended as is
+func WriteFstab(rootDir string, targets []*BlockDevice, extra ...string) error {
+	lines := []string{}
+
+	for _, curr := range targets {
+		if curr.MountPoint == "" && curr.FsType != "swap" {
+			continue
+		}
+
+		dev, err := curr.fstabDevice()
+		if err != nil {
+			return err
+		}
+
+		lines = append(lines, curr.fstabEntry(dev))
+	}
+
+	lines = append(lines, extra...)
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	etcDir := filepath.Join(rootDir, "etc")
+	if err := utils.MkdirAll(etcDir, 0755); err != nil {
+		return err
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	if err := plan.WriteFile(filepath.Join(etcDir, "fstab"), []byte(content), 0644); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+// validateMountOptions checks the label fits the file system and the mount
+// options can be written to fstab
+func (bd *BlockDevice) validateMountOptions() error {
+	if bd.Label != "" {
+		fs, ok := LookupFileSystem(bd.FsType)
+		if !ok || fs.MaxLabelLength == 0 {
+			return errors.Errorf("Labels are not supported by the file system of %s: %s",
+				bd.Name, bd.FsType)
+		}
+
+		if len(bd.Label) > fs.MaxLabelLength {
+			return errors.Errorf("Invalid label for %s: %q", bd.Name, bd.Label)
+		}
+	}
+
+	if strings.ContainsAny(bd.MountOptions, " \t\n") {
+		return errors.Errorf("Invalid mount options for %s: %q", bd.Name, bd.MountOptions)
+	}
+
+	return nil
+}
@@ -0,0 +1,704 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unicode/utf16"
+
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/log"
+	"github.com/clearlinux/clr-installer/plan"
+	"github.com/clearlinux/clr-installer/progress"
+)
+
+const (
+	gptSignature     = "EFI PART"
+	gptRevision      = 0x00010000
+	gptHeaderSize    = 92
+	gptEntrySize     = 128
+	gptEntryCount    = 128
+	gptNameLength    = 36
+	mbrSize          = 512
+	mbrProtectiveGPT = 0xEE
+
+	// defaultSectorSize is assumed when the logical sector size can't be queried,
+	// i.e for image files
+	defaultSectorSize = 512
+
+	// partitionAlignment is the boundary the partitions are aligned to
+	partitionAlignment = 1 << 20
+
+	// gptAttrLegacyBIOSBootable marks the partition legacy BIOS boots from
+	gptAttrLegacyBIOSBootable = 1 << 2
+
+	// blkRRPart is the BLKRRPART ioctl, it asks the kernel to re-read the partition table
+	blkRRPart = 0x125F
+)
+
+// guid is a GUID in its on-disk mixed endian representation
+type guid [16]byte
+
+// gptPartition is a GPT partition entry, firstLBA and lastLBA are inclusive
+type gptPartition struct {
+	number     int // position in the partition entries array, starting at 1
+	typeGUID   guid
+	partGUID   guid
+	firstLBA   uint64
+	lastLBA    uint64
+	attributes uint64
+	name       string
+}
+
+// gptTable is a GPT partition table of a disk with sectors logical sectors
+// of sectorSize bytes
+type gptTable struct {
+	sectorSize uint64
+	sectors    uint64
+	diskGUID   guid
+	partitions []*gptPartition
+	legacyBoot bool // mark the protective MBR partition as active
+}
+
+// parseGUID parses the textual representation of a GUID
+func parseGUID(str string) (guid, error) {
+	var res guid
+
+	data, err := hex.DecodeString(strings.Replace(str, "-", "", -1))
+	if err != nil || len(data) != len(res) {
+		return res, errors.Errorf("Invalid GUID: %s", str)
+	}
+
+	// the first 3 fields are stored in little endian
+	for i, j := range []int{3, 2, 1, 0, 5, 4, 7, 6} {
+		res[i] = data[j]
+	}
+	copy(res[8:], data[8:])
+
+	return res, nil
+}
+
+// String returns the textual representation of the GUID
+func (g guid) String() string {
+	data := make([]byte, len(g))
+
+	for i, j := range []int{3, 2, 1, 0, 5, 4, 7, 6} {
+		data[j] = g[i]
+	}
+	copy(data[8:], g[8:])
+
+	str := strings.ToUpper(hex.EncodeToString(data))
+	return fmt.Sprintf("%s-%s-%s-%s-%s", str[0:8], str[8:12], str[12:16], str[16:20], str[20:])
+}
+
+// randomGUID generates a random, version 4, GUID
+func randomGUID() (guid, error) {
+	var res guid
+
+	if _, err := rand.Read(res[:]); err != nil {
+		return res, errors.Wrap(err)
+	}
+
+	// version 4 and RFC 4122 variant, the version is in the little endian 3rd field
+	res[7] = (res[7] & 0x0f) | 0x40
+	res[8] = (res[8] & 0x3f) | 0x80
+
+	return res, nil
+}
+
+// newGPTTable creates an empty partition table for a disk of size bytes
+func newGPTTable(sectorSize uint64, size uint64) (*gptTable, error) {
+	if sectorSize < mbrSize || sectorSize%mbrSize != 0 {
+		return nil, errors.Errorf("Invalid sector size: %d", sectorSize)
+	}
+
+	diskGUID, err := randomGUID()
+	if err != nil {
+		return nil, err
+	}
+
+	table := &gptTable{
+		sectorSize: sectorSize,
+		sectors:    size / sectorSize,
+		diskGUID:   diskGUID,
+		partitions: []*gptPartition{},
+	}
+
+	if table.sectors <= 2*(table.entriesSectors()+1)+1 {
+		return nil, errors.Errorf("Disk too small for a partition table: %d bytes", size)
+	}
+
+	return table, nil
+}
+
+// entriesSectors returns the number of sectors used by the partition entries array
+func (t *gptTable) entriesSectors() uint64 {
+	return (gptEntryCount*gptEntrySize + t.sectorSize - 1) / t.sectorSize
+}
+
+// firstUsableLBA returns the first sector partitions may use
+func (t *gptTable) firstUsableLBA() uint64 {
+	return 2 + t.entriesSectors()
+}
+
+// lastUsableLBA returns the last sector partitions may use, the end of the disk
+// holds the backup entries array and header
+func (t *gptTable) lastUsableLBA() uint64 {
+	return t.sectors - 2 - t.entriesSectors()
+}
+
+// alignmentSectors returns the partition alignment in sectors
+func (t *gptTable) alignmentSectors() uint64 {
+	return partitionAlignment / t.sectorSize
+}
+
+// nextNumber returns the lowest partition number not in use, 0 if the partition
+// entries array is full
+func (t *gptTable) nextNumber() int {
+	used := map[int]bool{}
+	for _, curr := range t.partitions {
+		used[curr.number] = true
+	}
+
+	for num := 1; num <= gptEntryCount; num++ {
+		if !used[num] {
+			return num
+		}
+	}
+
+	return 0
+}
+
+// partition returns the partition numbered num, nil if there's none
+func (t *gptTable) partition(num int) *gptPartition {
+	for _, curr := range t.partitions {
+		if curr.number == num {
+			return curr
+		}
+	}
+
+	return nil
+}
+
+// removePartition removes the partition numbered num, its number becomes unused
+func (t *gptTable) removePartition(num int) {
+	res := []*gptPartition{}
+
+	for _, curr := range t.partitions {
+		if curr.number != num {
+			res = append(res, curr)
+		}
+	}
+
+	t.partitions = res
+}
+
+// newPartition adds a partition spanning the sectors first to last with the lowest
+// unused partition number
+func (t *gptTable) newPartition(first uint64, last uint64, typeGUID guid, name string,
+	attributes uint64) (*gptPartition, error) {
+	num := t.nextNumber()
+	if num == 0 {
+		return nil, errors.Errorf("Too many partitions")
+	}
+
+	partGUID, err := randomGUID()
+	if err != nil {
+		return nil, err
+	}
+
+	part := &gptPartition{
+		number:     num,
+		typeGUID:   typeGUID,
+		partGUID:   partGUID,
+		firstLBA:   first,
+		lastLBA:    last,
+		attributes: attributes,
+		name:       name,
+	}
+
+	t.partitions = append(t.partitions, part)
+	return part, nil
+}
+
+// insertPartition adds a partition of size bytes starting at the byte offset start,
+// the caller makes sure the space is free and start aligned
+func (t *gptTable) insertPartition(start uint64, size uint64, typeGUID guid, name string,
+	attributes uint64) (*gptPartition, error) {
+	first := start / t.sectorSize
+	count := size / t.sectorSize / t.alignmentSectors() * t.alignmentSectors()
+
+	if count == 0 {
+		return nil, errors.Errorf("Partition %s is too small: %d bytes", name, size)
+	}
+
+	if first < t.firstUsableLBA() || first+count-1 > t.lastUsableLBA() {
+		return nil, errors.Errorf("Partition %s doesn't fit in the disk", name)
+	}
+
+	return t.newPartition(first, first+count-1, typeGUID, name, attributes)
+}
+
+// addPartition adds a partition of size bytes right after the last one, the
+// partition is aligned and its size rounded down to the alignment, the last
+// partition is shrunk to the end of the disk if it goes no further than the
+// space reserved when resolving relative sizes
+func (t *gptTable) addPartition(size uint64, typeGUID guid, name string, attributes uint64) (*gptPartition, error) {
+	align := t.alignmentSectors()
+	first := t.alignmentSectors()
+
+	if len(t.partitions) > 0 {
+		first = t.partitions[len(t.partitions)-1].lastLBA + 1
+	}
+
+	first = (first + align - 1) / align * align
+	count := size / t.sectorSize / align * align
+
+	if count == 0 {
+		return nil, errors.Errorf("Partition %s is too small: %d bytes", name, size)
+	}
+
+	last := first + count - 1
+	if last > t.lastUsableLBA() {
+		if (last-t.lastUsableLBA())*t.sectorSize > reservedDiskSpace {
+			return nil, errors.Errorf("Partition %s doesn't fit in the disk", name)
+		}
+
+		last = t.lastUsableLBA()
+	}
+
+	return t.newPartition(first, last, typeGUID, name, attributes)
+}
+
+// entries returns the partition entries array
+func (t *gptTable) entries() []byte {
+	data := make([]byte, t.entriesSectors()*t.sectorSize)
+
+	for _, curr := range t.partitions {
+		entry := data[(curr.number-1)*gptEntrySize : curr.number*gptEntrySize]
+
+		copy(entry[0:16], curr.typeGUID[:])
+		copy(entry[16:32], curr.partGUID[:])
+		binary.LittleEndian.PutUint64(entry[32:40], curr.firstLBA)
+		binary.LittleEndian.PutUint64(entry[40:48], curr.lastLBA)
+		binary.LittleEndian.PutUint64(entry[48:56], curr.attributes)
+
+		name := utf16.Encode([]rune(curr.name))
+		if len(name) > gptNameLength {
+			name = name[:gptNameLength]
+		}
+
+		for i, r := range name {
+			binary.LittleEndian.PutUint16(entry[56+i*2:], r)
+		}
+	}
+
+	return data
+}
+
+// header returns the primary or backup header sector
+func (t *gptTable) header(primary bool, entriesCRC uint32) []byte {
+	data := make([]byte, t.sectorSize)
+
+	myLBA, alternateLBA := uint64(1), t.sectors-1
+	entriesLBA := uint64(2)
+
+	if !primary {
+		myLBA, alternateLBA = alternateLBA, myLBA
+		entriesLBA = t.lastUsableLBA() + 1
+	}
+
+	copy(data[0:8], gptSignature)
+	binary.LittleEndian.PutUint32(data[8:12], gptRevision)
+	binary.LittleEndian.PutUint32(data[12:16], gptHeaderSize)
+	binary.LittleEndian.PutUint64(data[24:32], myLBA)
+	binary.LittleEndian.PutUint64(data[32:40], alternateLBA)
+	binary.LittleEndian.PutUint64(data[40:48], t.firstUsableLBA())
+	binary.LittleEndian.PutUint64(data[48:56], t.lastUsableLBA())
+	copy(data[56:72], t.diskGUID[:])
+	binary.LittleEndian.PutUint64(data[72:80], entriesLBA)
+	binary.LittleEndian.PutUint32(data[80:84], gptEntryCount)
+	binary.LittleEndian.PutUint32(data[84:88], gptEntrySize)
+	binary.LittleEndian.PutUint32(data[88:92], entriesCRC)
+
+	binary.LittleEndian.PutUint32(data[16:20], crc32.ChecksumIEEE(data[:gptHeaderSize]))
+
+	return data
+}
+
+// protectiveMBR returns the first sector with a protective MBR covering the whole disk
+func (t *gptTable) protectiveMBR() []byte {
+	data := make([]byte, t.sectorSize)
+	entry := data[446:462]
+
+	if t.legacyBoot {
+		entry[0] = 0x80
+	}
+
+	// CHS addresses are meaningless, use the values mandated by the UEFI spec
+	copy(entry[1:4], []byte{0x00, 0x02, 0x00})
+	entry[4] = mbrProtectiveGPT
+	copy(entry[5:8], []byte{0xff, 0xff, 0xff})
+
+	size := t.sectors - 1
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+
+	binary.LittleEndian.PutUint32(entry[8:12], 1)
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(size))
+
+	data[510] = 0x55
+	data[511] = 0xaa
+
+	return data
+}
+
+// write writes the protective MBR, the primary and the backup partition tables to w
+func (t *gptTable) write(w io.WriterAt) error {
+	entries := t.entries()
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	sectors := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, t.protectiveMBR()},
+		{1, t.header(true, entriesCRC)},
+		{2, entries},
+		{t.lastUsableLBA() + 1, entries},
+		{t.sectors - 1, t.header(false, entriesCRC)},
+	}
+
+	for _, curr := range sectors {
+		if _, err := w.WriteAt(curr.data, int64(curr.lba*t.sectorSize)); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// readGPT reads and validates the primary partition table of a disk of size bytes
+func readGPT(r io.ReaderAt, sectorSize uint64, size uint64) (*gptTable, error) {
+	table := &gptTable{sectorSize: sectorSize, sectors: size / sectorSize, partitions: []*gptPartition{}}
+
+	mbr := make([]byte, sectorSize)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	if mbr[510] != 0x55 || mbr[511] != 0xaa || mbr[446+4] != mbrProtectiveGPT {
+		return nil, errors.Errorf("Invalid protective MBR")
+	}
+
+	table.legacyBoot = mbr[446] == 0x80
+
+	header := make([]byte, sectorSize)
+	if _, err := r.ReadAt(header, int64(sectorSize)); err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	if string(header[0:8]) != gptSignature {
+		return nil, errors.Errorf("Invalid GPT signature")
+	}
+
+	crc := binary.LittleEndian.Uint32(header[16:20])
+	binary.LittleEndian.PutUint32(header[16:20], 0)
+
+	if crc32.ChecksumIEEE(header[:gptHeaderSize]) != crc {
+		return nil, errors.Errorf("Invalid GPT header checksum")
+	}
+
+	copy(table.diskGUID[:], header[56:72])
+
+	if binary.LittleEndian.Uint32(header[80:84]) != gptEntryCount ||
+		binary.LittleEndian.Uint32(header[84:88]) != gptEntrySize {
+		return nil, errors.Errorf("Unsupported GPT partition entries array")
+	}
+
+	entries := make([]byte, table.entriesSectors()*sectorSize)
+	entriesLBA := binary.LittleEndian.Uint64(header[72:80])
+
+	if _, err := r.ReadAt(entries, int64(entriesLBA*sectorSize)); err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:92]) {
+		return nil, errors.Errorf("Invalid GPT entries checksum")
+	}
+
+	for idx := 0; idx < gptEntryCount; idx++ {
+		entry := entries[idx*gptEntrySize : (idx+1)*gptEntrySize]
+		part := &gptPartition{number: idx + 1}
+
+		copy(part.typeGUID[:], entry[0:16])
+		if part.typeGUID == (guid{}) {
+			continue
+		}
+
+		copy(part.partGUID[:], entry[16:32])
+		part.firstLBA = binary.LittleEndian.Uint64(entry[32:40])
+		part.lastLBA = binary.LittleEndian.Uint64(entry[40:48])
+		part.attributes = binary.LittleEndian.Uint64(entry[48:56])
+
+		name := []uint16{}
+		for i := 0; i < gptNameLength; i++ {
+			r := binary.LittleEndian.Uint16(entry[56+i*2:])
+			if r == 0 {
+				break
+			}
+			name = append(name, r)
+		}
+		part.name = string(utf16.Decode(name))
+
+		table.partitions = append(table.partitions, part)
+	}
+
+	return table, nil
+}
+
+// partitionLabel returns the GPT partition name of bd
+func (bd *BlockDevice) partitionLabel() string {
+	if bd.VolumeGroup != "" {
+		return bd.VolumeGroup
+	}
+
+	if bd.RaidArray != "" {
+		return bd.RaidArray
+	}
+
+	switch bd.FsType {
+	case "vfat":
+		return "EFI"
+	case "swap":
+		return "linux-swap"
+	}
+
+	return bd.mainMountPoint()
+}
+
+// partitionType returns the GPT partition type guid and attributes of bd, if legacyBoot
+// the /boot partition is flagged as legacy BIOS bootable
+func (bd *BlockDevice) partitionType(legacyBoot bool) (guid, uint64, error) {
+	str, err := bd.getGUID()
+	if err != nil {
+		return guid{}, 0, err
+	}
+
+	typeGUID, err := parseGUID(str)
+	if err != nil {
+		return guid{}, 0, err
+	}
+
+	var attributes uint64
+	if legacyBoot && bd.isLegacyBootPartition() {
+		attributes = gptAttrLegacyBIOSBootable
+	}
+
+	return typeGUID, attributes, nil
+}
+
+// gptTable builds the partition table describing bd's partitions for a disk of size bytes,
+// if legacyBoot the /boot partition is flagged as legacy BIOS bootable
+func (bd *BlockDevice) gptTable(sectorSize uint64, size uint64, legacyBoot bool) (*gptTable, error) {
+	table, err := newGPTTable(sectorSize, size)
+	if err != nil {
+		return nil, err
+	}
+
+	table.legacyBoot = legacyBoot
+
+	for _, curr := range bd.Children {
+		typeGUID, attributes, err := curr.partitionType(legacyBoot)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = table.addPartition(curr.Size, typeGUID, curr.partitionLabel(), attributes); err != nil {
+			return nil, err
+		}
+	}
+
+	return table, nil
+}
+
+// logicalSectorSize returns the logical sector size of the disk bd
+func (bd *BlockDevice) logicalSectorSize() uint64 {
+	if bd.LogSectorSize != 0 {
+		return bd.LogSectorSize
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(sysBlockDir, bd.Name, "queue", "logical_block_size"))
+	if err != nil {
+		return defaultSectorSize
+	}
+
+	size, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil || size == 0 {
+		return defaultSectorSize
+	}
+
+	return size
+}
+
+// readPartitionTableFile reads the GPT partition table of path, either a block device
+// or an image file
+func readPartitionTableFile(path string, sectorSize uint64) (*gptTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	return readGPT(f, sectorSize, uint64(size))
+}
+
+// fileSize returns the size of path, either a block device or an image file
+func fileSize(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+
+	return uint64(size), nil
+}
+
+// writePartitionTableFile writes a new GPT partition table with bd's partitions to path,
+// either bd's block device or an image file
+func (bd *BlockDevice) writePartitionTableFile(path string, sectorSize uint64, legacyBoot bool) error {
+	size, err := fileSize(path)
+	if err != nil {
+		return err
+	}
+
+	table, err := bd.gptTable(sectorSize, size, legacyBoot)
+	if err != nil {
+		return err
+	}
+
+	return bd.writeTableFile(path, table)
+}
+
+// writeTableFile writes table to path, either bd's block device or an image file, the
+// kernel is asked to re-read the partition table of block devices
+func (bd *BlockDevice) writeTableFile(path string, table *gptTable) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	if err = table.write(f); err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		return errors.Wrap(err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	if fi.Mode()&os.ModeDevice == 0 {
+		return nil
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkRRPart, 0); errno != 0 {
+		log.Debug("BLKRRPART %s: %v, falling back to partprobe", path, errno)
+		return bd.partProbe()
+	}
+
+	return nil
+}
+
+// planPartitionTable records the partition table bd would be written in the installation plan
+func (bd *BlockDevice) planPartitionTable(legacyBoot bool) error {
+	size, err := bd.diskSize()
+	if err != nil {
+		size = bd.Size
+	}
+
+	table, err := bd.gptTable(bd.logicalSectorSize(), size, legacyBoot)
+	if err != nil {
+		return err
+	}
+
+	bd.planTable(table)
+	return nil
+}
+
+// planTable records writing table to bd in the installation plan
+func (bd *BlockDevice) planTable(table *gptTable) {
+	plan.Add("write gpt partition table to %s", bd.GetDeviceFile())
+
+	for _, curr := range table.partitions {
+		plan.Add("partition %d: sectors %d-%d type %s name %q attributes %#x", curr.number,
+			curr.firstLBA, curr.lastLBA, curr.typeGUID, curr.name, curr.attributes)
+	}
+}
+
+// writePartitionTable writes a new GPT partition table with bd's partitions to
+// its block device, the partitions are named after their number in the table
+func (bd *BlockDevice) writePartitionTable(legacyBoot bool) error {
+	prg := progress.NewLoop("Writing partition table to: %s", bd.Name)
+
+	var err error
+	if plan.Enabled() {
+		err = bd.planPartitionTable(legacyBoot)
+	} else {
+		err = bd.writePartitionTableFile(bd.GetDeviceFile(), bd.logicalSectorSize(), legacyBoot)
+	}
+
+	if err != nil {
+		prg.Failure()
+		return err
+	}
+
+	for idx, curr := range bd.Children {
+		curr.Name = bd.partitionName(idx + 1)
+	}
+
+	if err = bd.settlePartitions(); err != nil {
+		prg.Failure()
+		return err
+	}
+
+	prg.Success()
+	return nil
+}
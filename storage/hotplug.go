@@ -0,0 +1,195 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/log"
+)
+
+const (
+	// kernelUeventGroup is the netlink group the kernel sends its uevents to
+	kernelUeventGroup = 1
+
+	// udevUeventGroup is the netlink group udev sends the processed uevents to
+	udevUeventGroup = 2
+
+	// udevControlSocket exists when udev is running
+	udevControlSocket = "/run/udev/control"
+
+	// udevMonitorPrefix prefixes the udev netlink messages
+	udevMonitorPrefix = "libudev\x00"
+
+	// hotplugSettleTime is how long the block devices must be quiet after an event
+	// before the listeners are notified, plugging a disk triggers an event for the
+	// disk and for each of its partitions
+	hotplugSettleTime = 500 * time.Millisecond
+)
+
+// uevent is a kernel or udev device event
+type uevent struct {
+	action     string
+	properties map[string]string
+}
+
+// HotplugMonitor watches the block devices being added, removed or changed through
+// the udev netlink socket, or the kernel's if udev is not running
+type HotplugMonitor struct {
+	fd   int
+	done chan struct{}
+}
+
+// parseUevent parses a netlink uevent message, either sent by the kernel i.e
+// add@/devices/...\0ACTION=add\0... or by udev prefixed by its own header
+func parseUevent(data []byte) (*uevent, error) {
+	if bytes.HasPrefix(data, []byte(udevMonitorPrefix)) {
+		// the properties offset and length follow the prefix, magic and header size,
+		// udev writes them in host byte order
+		if len(data) < 24 {
+			return nil, errors.Errorf("Invalid udev message header")
+		}
+
+		off := binary.LittleEndian.Uint32(data[16:20])
+		length := binary.LittleEndian.Uint32(data[20:24])
+		if uint64(off)+uint64(length) > uint64(len(data)) {
+			return nil, errors.Errorf("Invalid udev message properties")
+		}
+
+		data = data[off : off+length]
+	}
+
+	ev := &uevent{properties: map[string]string{}}
+
+	for _, curr := range strings.Split(string(data), "\x00") {
+		kv := strings.SplitN(curr, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		ev.properties[kv[0]] = kv[1]
+	}
+
+	ev.action = ev.properties["ACTION"]
+	if ev.action == "" {
+		return nil, errors.Errorf("Invalid uevent, no action")
+	}
+
+	return ev, nil
+}
+
+// isBlockDevice returns true if ev is about a disk or a partition
+func (ev *uevent) isBlockDevice() bool {
+	return ev.properties["SUBSYSTEM"] == "block"
+}
+
+// NewHotplugMonitor creates a monitor subscribed to the block devices events
+func NewHotplugMonitor() (*HotplugMonitor, error) {
+	group := uint32(kernelUeventGroup)
+	if _, err := os.Stat(udevControlSocket); err == nil {
+		group = udevUeventGroup
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: group}
+	if err = syscall.Bind(fd, addr); err != nil {
+		_ = syscall.Close(fd)
+		return nil, errors.Wrap(err)
+	}
+
+	// reads time out so pending events are delivered once the devices settle
+	tv := syscall.NsecToTimeval(int64(hotplugSettleTime))
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		_ = syscall.Close(fd)
+		return nil, errors.Wrap(err)
+	}
+
+	return &HotplugMonitor{fd: fd, done: make(chan struct{})}, nil
+}
+
+// closed returns true once the monitor is closed
+func (hm *HotplugMonitor) closed() bool {
+	select {
+	case <-hm.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// readEvent waits for the next uevent, nil is returned if none is received
+// within hotplugSettleTime
+func (hm *HotplugMonitor) readEvent(buf []byte) (*uevent, error) {
+	n, _, err := syscall.Recvfrom(hm.fd, buf, 0)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	return parseUevent(buf[:n])
+}
+
+// Watch calls changed from its own goroutine every time the block devices settle after
+// a disk or partition is added, removed or changed, the list of available block devices
+// is invalidated before calling changed
+func (hm *HotplugMonitor) Watch(changed func()) {
+	go func() {
+		buf := make([]byte, os.Getpagesize()*2)
+		pending := false
+
+		for !hm.closed() {
+			ev, err := hm.readEvent(buf)
+			if err != nil {
+				if !hm.closed() {
+					log.Debug("Ignoring uevent: %s", err)
+				}
+				continue
+			}
+
+			if ev != nil {
+				if ev.isBlockDevice() {
+					log.Debug("Block device %s: %s", ev.action, ev.properties["DEVNAME"])
+					pending = true
+				}
+				continue
+			}
+
+			if pending {
+				pending = false
+				InvalidateBlockDevices()
+				changed()
+			}
+		}
+	}()
+}
+
+// Close stops watching the block devices
+func (hm *HotplugMonitor) Close() error {
+	if hm.closed() {
+		return nil
+	}
+
+	close(hm.done)
+
+	if err := syscall.Close(hm.fd); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
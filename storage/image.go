@@ -0,0 +1,196 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/log"
+	"github.com/clearlinux/clr-installer/plan"
+)
+
+const (
+	// ImageFormatRaw leaves the installed image as a raw disk image
+	ImageFormatRaw = "raw"
+
+	// ImageFormatQcow2 converts the installed image to qcow2 once detached
+	ImageFormatQcow2 = "qcow2"
+)
+
+var (
+	// attachedImages are the image backed disks attached to a loop device
+	attachedImages []*BlockDevice
+)
+
+// IsImage returns true if bd is a disk backed by an image file
+func (bd *BlockDevice) IsImage() bool {
+	return bd.Image != ""
+}
+
+// rawImagePath returns the path of the raw image the installation is written to,
+// qcow2 images are only created from it once the installation is finished
+func (bd *BlockDevice) rawImagePath() string {
+	if bd.ImageFormat == ImageFormatQcow2 {
+		return bd.Image + ".raw"
+	}
+
+	return bd.Image
+}
+
+// validateImage checks an image backed disk has an absolute size and a known format
+func (bd *BlockDevice) validateImage() error {
+	if !bd.IsImage() {
+		return nil
+	}
+
+	if bd.ImageFormat != "" && bd.ImageFormat != ImageFormatRaw && bd.ImageFormat != ImageFormatQcow2 {
+		return errors.Errorf("Invalid image format for %s: %s", bd.Image, bd.ImageFormat)
+	}
+
+	if bd.Size == 0 || bd.RelativeSize != "" {
+		return errors.Errorf("Image %s requires an absolute size", bd.Image)
+	}
+
+	if _, err := os.Stat(filepath.Dir(bd.Image)); err != nil {
+		return errors.Errorf("Invalid image directory: %s", filepath.Dir(bd.Image))
+	}
+
+	if bd.ImageOverwrite {
+		return nil
+	}
+
+	for _, curr := range []string{bd.Image, bd.rawImagePath()} {
+		if _, err := os.Stat(curr); err == nil {
+			return errors.Errorf("Image %s already exists, set imageOverwrite to replace it", curr)
+		}
+	}
+
+	return nil
+}
+
+// AttachImage creates the sparse image file of an image backed disk and attaches
+// it to a loop device, bd then refers to the loop device. An existing image file
+// is only replaced if bd.ImageOverwrite is set. No-op for regular disks
+func (bd *BlockDevice) AttachImage() error {
+	if !bd.IsImage() {
+		return nil
+	}
+
+	path := bd.rawImagePath()
+
+	if plan.Enabled() {
+		plan.Add("create sparse image %s of %d bytes", path, bd.Size)
+		plan.AddCommand("losetup", "--find", "--show", "--partscan", path)
+
+		// the loop device is only known once attached
+		bd.Name = "loopN"
+		bd.Type = BlockDeviceTypeLoop
+		attachedImages = append(attachedImages, bd)
+		return nil
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if bd.ImageOverwrite {
+		flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if os.IsExist(err) {
+		return errors.Errorf("Image %s already exists, set imageOverwrite to replace it", path)
+	} else if err != nil {
+		return errors.Wrap(err)
+	}
+
+	if err = f.Truncate(int64(bd.Size)); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err)
+	}
+
+	if err = f.Close(); err != nil {
+		return errors.Wrap(err)
+	}
+
+	w := bytes.NewBuffer(nil)
+	if err = cmd.Run(w, "losetup", "--find", "--show", "--partscan", path); err != nil {
+		return errors.Errorf("losetup %s: %s", path, w.String())
+	}
+
+	dev := strings.TrimSpace(w.String())
+	log.Debug("Attached image %s to %s", path, dev)
+
+	bd.Name = filepath.Base(dev)
+	bd.Type = BlockDeviceTypeLoop
+	attachedImages = append(attachedImages, bd)
+
+	return nil
+}
+
+// finalizeImage converts the detached raw image to the requested image format
+func (bd *BlockDevice) finalizeImage() error {
+	if bd.ImageFormat != ImageFormatQcow2 {
+		return nil
+	}
+
+	raw := bd.rawImagePath()
+
+	err := cmd.RunAndLog("qemu-img", "convert", "-f", ImageFormatRaw, "-O", ImageFormatQcow2,
+		raw, bd.Image)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	if plan.Enabled() {
+		plan.Add("remove %s", raw)
+		return nil
+	}
+
+	if err = os.Remove(raw); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+// DetachImages detaches the loop devices of all the previously attached images,
+// they're finalized to their requested format only if finalize is set. The raw
+// images of a failed installation are left as is
+func DetachImages(finalize bool) error {
+	fails := []string{}
+
+	for i := len(attachedImages) - 1; i >= 0; i-- {
+		bd := attachedImages[i]
+
+		if err := cmd.RunAndLog("losetup", "--detach", bd.GetDeviceFile()); err != nil {
+			log.ErrorError(fmt.Errorf("losetup --detach %s: %v", bd.GetDeviceFile(), err))
+			fails = append(fails, bd.Image)
+			continue
+		}
+
+		log.Debug("Detached ok: %s", bd.GetDeviceFile())
+
+		if !finalize {
+			continue
+		}
+
+		if err := bd.finalizeImage(); err != nil {
+			log.ErrorError(err)
+			fails = append(fails, bd.Image)
+		}
+	}
+
+	attachedImages = nil
+
+	if len(fails) > 0 {
+		return errors.Errorf("Failed to finalize: %v", fails)
+	}
+
+	return nil
+}
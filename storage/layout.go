@@ -0,0 +1,432 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"sort"
+
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/plan"
+	"github.com/clearlinux/clr-installer/progress"
+)
+
+// layoutEntry is either a partition or a free space region of a disk, start and end
+// are inclusive byte offsets
+type layoutEntry struct {
+	number int
+	start  uint64
+	end    uint64
+	free   bool
+}
+
+// KeepsPartitionTable returns true if the disk's current partition table is
+// preserved, that's the case when any of its partitions is an existing one
+func (bd *BlockDevice) KeepsPartitionTable() bool {
+	for _, curr := range bd.Children {
+		if curr.Existing {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DestroyedPartitions returns the partitions found in the disk when it was listed
+// which will be destroyed when writing the partition table
+func (bd *BlockDevice) DestroyedPartitions() []*BlockDevice {
+	res := []*BlockDevice{}
+	keep := bd.KeepsPartitionTable()
+
+	for _, loaded := range bd.loadedChildren {
+		kept := false
+
+		for _, curr := range bd.Children {
+			if keep && curr.Existing && curr.Name == loaded.Name {
+				kept = true
+				break
+			}
+		}
+
+		if !kept {
+			res = append(res, loaded)
+		}
+	}
+
+	return res
+}
+
+// ShouldFormat returns true if bd's file system must be created, new partitions are
+// always formatted while existing ones only if used by the installation and not
+// explicitly kept with format: false
+func (bd *BlockDevice) ShouldFormat() bool {
+	if !bd.Existing {
+		return true
+	}
+
+	if !bd.Format {
+		return false
+	}
+
+	return len(bd.MountTargets()) > 0 || bd.VolumeGroup != "" || bd.RaidArray != ""
+}
+
+// validateExisting checks an existing partition can be reused as configured
+func (bd *BlockDevice) validateExisting() error {
+	if !bd.Existing {
+		return nil
+	}
+
+	if bd.partitionNumber() == 0 {
+		return errors.Errorf("Could not determine the partition number of: %s", bd.Name)
+	}
+
+	if err := bd.validateShrink(); err != nil {
+		return err
+	}
+
+	if bd.Format {
+		return nil
+	}
+
+	if bd.Encrypted || bd.VolumeGroup != "" || bd.RaidArray != "" {
+		return errors.Errorf("Partition %s must be formatted to be encrypted or assembled", bd.Name)
+	}
+
+	if len(bd.MountTargets()) > 0 && bd.FsType == "" {
+		return errors.Errorf("Unknown file system of existing partition: %s", bd.Name)
+	}
+
+	return nil
+}
+
+// validateShrink checks an existing partition is not shrunk below its used space
+func (bd *BlockDevice) validateShrink() error {
+	if !bd.IsShrunk() {
+		return nil
+	}
+
+	if !bd.CanShrink() {
+		return errors.Errorf("File system of %s can not be shrunk: %s", bd.Name, bd.FsType)
+	}
+
+	if bd.Size < bd.minSize {
+		return errors.Errorf("Can not shrink %s below its used space", bd.Name)
+	}
+
+	return nil
+}
+
+// tableLayout returns the partitions and the free space regions of table ordered by
+// their position in the disk
+func tableLayout(table *gptTable) []*layoutEntry {
+	parts := append([]*gptPartition{}, table.partitions...)
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].firstLBA < parts[j].firstLBA
+	})
+
+	res := []*layoutEntry{}
+	next := table.firstUsableLBA()
+
+	for _, curr := range parts {
+		if curr.firstLBA > next {
+			res = append(res, &layoutEntry{start: next * table.sectorSize,
+				end: curr.firstLBA*table.sectorSize - 1, free: true})
+		}
+
+		res = append(res, &layoutEntry{number: curr.number, start: curr.firstLBA * table.sectorSize,
+			end: (curr.lastLBA+1)*table.sectorSize - 1})
+		next = curr.lastLBA + 1
+	}
+
+	if next <= table.lastUsableLBA() {
+		res = append(res, &layoutEntry{start: next * table.sectorSize,
+			end: (table.lastUsableLBA()+1)*table.sectorSize - 1, free: true})
+	}
+
+	return res
+}
+
+// readPartitionTable reads the current partition table of bd, the table is read in
+// dry-run mode too as the new partitions are placed in its free space
+func (bd *BlockDevice) readPartitionTable() (*gptTable, error) {
+	plan.Add("read gpt partition table from %s", bd.GetDeviceFile())
+
+	table, err := readPartitionTableFile(bd.GetDeviceFile(), bd.logicalSectorSize())
+	if err != nil {
+		return nil, errors.Errorf("Could not read the GPT partition table of %s: %v",
+			bd.GetDeviceFile(), err)
+	}
+
+	return table, nil
+}
+
+// mergeFree merges the adjacent free space regions of layout
+func mergeFree(layout []*layoutEntry) []*layoutEntry {
+	res := []*layoutEntry{}
+
+	for _, curr := range layout {
+		if len(res) > 0 && curr.free && res[len(res)-1].free {
+			res[len(res)-1].end = curr.end
+			continue
+		}
+
+		res = append(res, curr)
+	}
+
+	return res
+}
+
+// freePartitions returns a copy of layout with the partitions not in kept turned
+// into free space, it's how the layout looks like once those are removed
+func freePartitions(layout []*layoutEntry, kept map[int]bool) []*layoutEntry {
+	res := []*layoutEntry{}
+
+	for _, curr := range layout {
+		entry := *curr
+
+		if !entry.free && !kept[entry.number] {
+			entry.number = 0
+			entry.free = true
+		}
+
+		res = append(res, &entry)
+	}
+
+	return mergeFree(res)
+}
+
+// shrinkEntry returns a copy of layout with the partition num shrunk to size bytes,
+// the released space becomes free
+func shrinkEntry(layout []*layoutEntry, num int, size uint64) []*layoutEntry {
+	res := []*layoutEntry{}
+
+	for _, curr := range layout {
+		entry := *curr
+		res = append(res, &entry)
+
+		if entry.free || entry.number != num || entry.end-entry.start+1 <= size {
+			continue
+		}
+
+		res = append(res, &layoutEntry{start: entry.start + size, end: entry.end, free: true})
+		entry.end = entry.start + size - 1
+	}
+
+	return mergeFree(res)
+}
+
+// placePartitions assigns each of parts a start position, in MiB, within the free
+// space regions of layout, partitions are placed in the first region they fit
+func placePartitions(layout []*layoutEntry, parts []*BlockDevice) (map[*BlockDevice]uint64, error) {
+	regions := []*layoutEntry{}
+
+	for _, curr := range layout {
+		if !curr.free {
+			continue
+		}
+
+		// align the regions to MiB boundaries
+		start := (curr.start + (1 << 20) - 1) >> 20
+		end := (curr.end + 1) >> 20
+
+		if end > start {
+			regions = append(regions, &layoutEntry{start: start, end: end, free: true})
+		}
+	}
+
+	res := map[*BlockDevice]uint64{}
+
+	for _, part := range parts {
+		size := part.Size >> 20
+		placed := false
+
+		for _, region := range regions {
+			if region.end-region.start < size {
+				continue
+			}
+
+			res[part] = region.start
+			region.start = region.start + size
+			placed = true
+			break
+		}
+
+		if !placed {
+			return nil, errors.Errorf("Not enough contiguous free space for partition: %s", part.Name)
+		}
+	}
+
+	return res, nil
+}
+
+// layoutPlan is the target layout of a disk whose partition table is preserved
+type layoutPlan struct {
+	removed  []int                   // the numbers of the partitions not declared anymore
+	shrunk   []*BlockDevice          // the existing partitions to shrink
+	newParts []*BlockDevice          // the partitions to create
+	starts   map[*BlockDevice]uint64 // the start of the new partitions, in MiB
+}
+
+// planLayout computes the changes needed to turn the current layout of bd into
+// its defined partitions, an error is returned if they can't be applied so nothing is
+// changed in the disk. The shrunk partitions are checked against their used space
+func (bd *BlockDevice) planLayout(layout []*layoutEntry) (*layoutPlan, error) {
+	lp := &layoutPlan{}
+
+	kept := map[int]bool{}
+	for _, curr := range bd.Children {
+		if curr.Existing {
+			kept[curr.partitionNumber()] = true
+		}
+	}
+
+	for _, curr := range layout {
+		if !curr.free && !kept[curr.number] {
+			lp.removed = append(lp.removed, curr.number)
+		}
+	}
+
+	planned := freePartitions(layout, kept)
+
+	for _, curr := range bd.Children {
+		if !curr.Existing {
+			lp.newParts = append(lp.newParts, curr)
+			continue
+		}
+
+		for _, entry := range planned {
+			if entry.free || entry.number != curr.partitionNumber() {
+				continue
+			}
+
+			size := entry.end - entry.start + 1
+			if curr.Size > size+(1<<20) {
+				return nil, errors.Errorf("Growing existing partitions is not supported: %s", curr.Name)
+			} else if curr.Size+(1<<20) > size {
+				break
+			}
+
+			if err := curr.checkShrink(); err != nil {
+				return nil, err
+			}
+
+			lp.shrunk = append(lp.shrunk, curr)
+			planned = shrinkEntry(planned, entry.number, curr.shrunkSize())
+			break
+		}
+	}
+
+	for _, curr := range lp.newParts {
+		if _, found := curr.getOps(); !found {
+			return nil, errors.Errorf("Unknown file system for partition %s: %s", curr.Name, curr.FsType)
+		}
+	}
+
+	starts, err := placePartitions(planned, lp.newParts)
+	if err != nil {
+		return nil, err
+	}
+	lp.starts = starts
+
+	return lp, nil
+}
+
+// updatePartitionTable writes the defined partitions to the actual block device
+// preserving the existing partitions, the partitions not declared anymore are
+// removed, the ones configured smaller are shrunk and the new ones are placed in
+// the free space, if legacyBoot the /boot partition is flagged as legacy BIOS bootable
+func (bd *BlockDevice) updatePartitionTable(legacyBoot bool) error {
+	prg := progress.NewLoop("Updating partition table of: %s", bd.Name)
+
+	table, err := bd.readPartitionTable()
+	if err != nil {
+		prg.Failure()
+		return err
+	}
+
+	lp, err := bd.planLayout(tableLayout(table))
+	if err != nil {
+		prg.Failure()
+		return err
+	}
+
+	// the existing partitions configured smaller are shrunk before the partition
+	// table is written, a file system failing to shrink leaves it untouched
+	for _, curr := range lp.shrunk {
+		if err = curr.shrinkPartition(); err != nil {
+			prg.Failure()
+			return err
+		}
+	}
+
+	if err = bd.updateTable(table, lp, legacyBoot); err != nil {
+		prg.Failure()
+		return err
+	}
+
+	if plan.Enabled() {
+		bd.planTable(table)
+	} else if err = bd.writeTableFile(bd.GetDeviceFile(), table); err != nil {
+		prg.Failure()
+		return err
+	}
+
+	if err = bd.settlePartitions(); err != nil {
+		prg.Failure()
+		return err
+	}
+
+	prg.Success()
+
+	return nil
+}
+
+// updateTable applies the layout plan lp to table, the new partitions are named
+// after the numbers they're given in the table
+func (bd *BlockDevice) updateTable(table *gptTable, lp *layoutPlan, legacyBoot bool) error {
+	for _, num := range lp.removed {
+		table.removePartition(num)
+	}
+
+	for _, curr := range bd.Children {
+		if !curr.Existing {
+			continue
+		}
+
+		part := table.partition(curr.partitionNumber())
+		if part == nil {
+			return errors.Errorf("Could not find the existing partition: %s", curr.Name)
+		}
+
+		for _, shrunk := range lp.shrunk {
+			if shrunk == curr {
+				part.lastLBA = part.firstLBA + curr.shrunkSize()/table.sectorSize - 1
+			}
+		}
+
+		if legacyBoot && curr.isLegacyBootPartition() {
+			part.attributes = part.attributes | gptAttrLegacyBIOSBootable
+		}
+	}
+
+	table.legacyBoot = table.legacyBoot || legacyBoot
+
+	for _, curr := range lp.newParts {
+		typeGUID, attributes, err := curr.partitionType(legacyBoot)
+		if err != nil {
+			return err
+		}
+
+		part, err := table.insertPartition(lp.starts[curr]<<20, curr.Size, typeGUID,
+			curr.partitionLabel(), attributes)
+		if err != nil {
+			return err
+		}
+
+		curr.Name = bd.partitionName(part.number)
+	}
+
+	return nil
+}
@@ -0,0 +1,300 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/log"
+	"github.com/clearlinux/clr-installer/plan"
+	"github.com/clearlinux/clr-installer/utils"
+)
+
+const (
+	// luksMapperPrefix is prepended to the partition name to compose the mapper name
+	luksMapperPrefix = "luks-"
+
+	// luksKeyDir is the target directory where the provided key files are copied to
+	luksKeyDir = "/etc/cryptsetup-keys.d"
+
+	// MinimumPassphraseLength is the shortest accepted luks passphrase
+	MinimumPassphraseLength = 8
+)
+
+var (
+	mappedDevices []string
+)
+
+// GetMappedDeviceFile returns the file path used to access the block device's
+// content, for encrypted partitions that's the device mapper node
+func (bd BlockDevice) GetMappedDeviceFile() string {
+	if bd.Encrypted {
+		return filepath.Join("/dev/mapper/", bd.getMapperName())
+	}
+
+	return bd.GetDeviceFile()
+}
+
+func (bd BlockDevice) getMapperName() string {
+	return luksMapperPrefix + bd.Name
+}
+
+// unlockedAtBoot returns true if bd is unlocked by the initrd at boot where only a
+// passphrase can be typed in, that's the case of the root partition, the physical
+// volumes which may back the root logical volume and the members of the raid arrays
+// which may hold the root file system
+func (bd *BlockDevice) unlockedAtBoot() bool {
+	return bd.mainMountPoint() == "/" || bd.VolumeGroup != "" || bd.RaidArray != ""
+}
+
+// luksKeyArgs returns the cryptsetup key arguments and the content to be written
+// to cryptsetup's stdin, the partitions unlocked at boot are always formatted with
+// their passphrase
+func (bd *BlockDevice) luksKeyArgs() ([]string, string) {
+	if bd.KeyFile != "" && !bd.unlockedAtBoot() {
+		return []string{fmt.Sprintf("--key-file=%s", bd.KeyFile)}, ""
+	}
+
+	return []string{"--key-file=-"}, bd.Passphrase
+}
+
+// MapEncrypted formats bd as a luks volume and opens it, from then on the file
+// system operations will target the mapped device, no-op for non encrypted devices
+func (bd *BlockDevice) MapEncrypted() error {
+	if !bd.Encrypted {
+		return nil
+	}
+
+	if bd.Type == BlockDeviceTypeDisk {
+		return errors.Errorf("Trying to run MapEncrypted() against a disk, partition required")
+	}
+
+	keyArgs, in := bd.luksKeyArgs()
+
+	args := []string{
+		"cryptsetup",
+		"--batch-mode",
+		"luksFormat",
+		"--type",
+		"luks2",
+		bd.GetDeviceFile(),
+	}
+	args = append(args, keyArgs...)
+
+	if err := cmd.PipeRunAndLog(in, args...); err != nil {
+		return errors.Wrap(err)
+	}
+
+	// the key file of a partition unlocked at boot is an additional key
+	if bd.KeyFile != "" && bd.unlockedAtBoot() {
+		args = []string{
+			"cryptsetup",
+			"--batch-mode",
+			"luksAddKey",
+			bd.GetDeviceFile(),
+			bd.KeyFile,
+		}
+		args = append(args, keyArgs...)
+
+		if err := cmd.PipeRunAndLog(in, args...); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+
+	args = []string{
+		"cryptsetup",
+		"open",
+		bd.GetDeviceFile(),
+		bd.getMapperName(),
+	}
+	args = append(args, keyArgs...)
+
+	if err := cmd.PipeRunAndLog(in, args...); err != nil {
+		return errors.Wrap(err)
+	}
+
+	// Store the mapper name for later closing
+	mappedDevices = append(mappedDevices, bd.getMapperName())
+
+	// the header doesn't exist in dry-run mode, refer to the device instead
+	if plan.Enabled() {
+		bd.luksUUID = bd.GetDeviceFile()
+		return nil
+	}
+
+	w := bytes.NewBuffer(nil)
+	if err := cmd.Run(w, "cryptsetup", "luksUUID", bd.GetDeviceFile()); err != nil {
+		return errors.Errorf("cryptsetup luksUUID %s: %s", bd.GetDeviceFile(), w.String())
+	}
+
+	bd.luksUUID = strings.TrimSpace(w.String())
+
+	return nil
+}
+
+// UnmapAll closes all the previously opened encrypted devices
+func UnmapAll() error {
+	fails := []string{}
+
+	for i := len(mappedDevices) - 1; i >= 0; i-- {
+		name := mappedDevices[i]
+
+		if err := cmd.RunAndLog("cryptsetup", "close", name); err != nil {
+			log.ErrorError(fmt.Errorf("cryptsetup close %s: %v", name, err))
+			fails = append(fails, name)
+		} else {
+			log.Debug("Closed ok: %s", name)
+		}
+	}
+
+	mappedDevices = nil
+
+	if len(fails) > 0 {
+		return errors.Errorf("Failed to close: %v", fails)
+	}
+
+	return nil
+}
+
+// IsValidPassphrase returns an empty string if the passphrase is acceptable
+// for encrypting a partition
+func IsValidPassphrase(str string) string {
+	if len(str) < MinimumPassphraseLength {
+		return fmt.Sprintf("Passphrase must have at least %d characters", MinimumPassphraseLength)
+	}
+
+	return ""
+}
+
+func encryptedPartitions(medias []*BlockDevice) []*BlockDevice {
+	res := []*BlockDevice{}
+
+	for _, bd := range medias {
+		for _, ch := range bd.Children {
+			if ch.Encrypted {
+				res = append(res, ch)
+			}
+		}
+	}
+
+	return res
+}
+
+// WriteCrypttab writes the target's /etc/crypttab describing every encrypted
+// partition in medias, provided key files are copied into the target for all
+// but the partitions unlocked with a passphrase at boot
+func WriteCrypttab(rootDir string, medias []*BlockDevice) error {
+	parts := encryptedPartitions(medias)
+
+	if len(parts) == 0 {
+		return nil
+	}
+
+	lines := []string{}
+
+	for _, curr := range parts {
+		key := "none"
+
+		if curr.KeyFile != "" && !curr.unlockedAtBoot() {
+			key = filepath.Join(luksKeyDir, curr.getMapperName()+".key")
+			keyDir := filepath.Join(rootDir, luksKeyDir)
+
+			if err := utils.MkdirAll(keyDir, 0700); err != nil {
+				return err
+			}
+
+			keyPath := filepath.Join(rootDir, key)
+
+			if plan.Enabled() {
+				plan.Add("copy %s to %s", curr.KeyFile, keyPath)
+				plan.Add("chmod 0400 %s", keyPath)
+			} else {
+				if err := utils.CopyFile(curr.KeyFile, keyPath); err != nil {
+					return err
+				}
+
+				if err := os.Chmod(keyPath, 0400); err != nil {
+					return errors.Wrap(err)
+				}
+			}
+		}
+
+		lines = append(lines, fmt.Sprintf("%s UUID=%s %s luks", curr.getMapperName(),
+			curr.luksUUID, key))
+	}
+
+	etcDir := filepath.Join(rootDir, "etc")
+	if err := utils.MkdirAll(etcDir, 0755); err != nil {
+		return err
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	if err := plan.WriteFile(filepath.Join(etcDir, "crypttab"), []byte(content), 0600); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+// rootPartitions returns the partitions of medias the root file system lives on, either
+// the root partition itself, the physical volumes of the root logical volume's group or
+// the members of the root raid array
+func rootPartitions(medias []*BlockDevice, groups []*BlockDevice, arrays []*BlockDevice) []*BlockDevice {
+	rootGroups := map[string]bool{}
+	for _, vg := range groups {
+		for _, lv := range vg.Children {
+			if lv.mainMountPoint() == "/" {
+				rootGroups[vg.Name] = true
+			}
+		}
+	}
+
+	rootArrays := map[string]bool{}
+	for _, arr := range arrays {
+		if arr.mainMountPoint() == "/" {
+			rootArrays[arr.Name] = true
+		}
+	}
+
+	res := []*BlockDevice{}
+
+	for _, bd := range medias {
+		for _, ch := range bd.Children {
+			if ch.mainMountPoint() == "/" || (ch.VolumeGroup != "" && rootGroups[ch.VolumeGroup]) ||
+				(ch.RaidArray != "" && rootArrays[ch.RaidArray]) {
+				res = append(res, ch)
+			}
+		}
+	}
+
+	return res
+}
+
+// EncryptionKernelCmdline returns the kernel command line arguments required to
+// unlock the encrypted partitions the root file system lives on at boot time, i.e
+// the root partition or the physical volumes and raid members backing it
+func EncryptionKernelCmdline(medias []*BlockDevice, groups []*BlockDevice, arrays []*BlockDevice) string {
+	args := []string{}
+
+	for _, curr := range rootPartitions(medias, groups, arrays) {
+		if !curr.Encrypted {
+			continue
+		}
+
+		args = append(args, fmt.Sprintf("rd.luks.name=%s=%s", curr.luksUUID, curr.getMapperName()))
+
+		if curr.mainMountPoint() == "/" {
+			args = append(args, fmt.Sprintf("root=%s", curr.GetMappedDeviceFile()))
+		}
+	}
+
+	return strings.Join(args, " ")
+}
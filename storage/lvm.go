@@ -0,0 +1,303 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/log"
+)
+
+const (
+	// lvmExtentSize is the physical extent size of the created volume groups, the
+	// logical volumes sizes are rounded down to a multiple of it
+	lvmExtentSize = 4 << 20
+)
+
+var (
+	lvmPhysicalVolumeOps = &FileSystem{Name: "lvm2", MakeFs: lvmMakeFs}
+
+	activeGroups []string
+)
+
+func lvmMakeFs(bd *BlockDevice) error {
+	args := []string{
+		"pvcreate",
+		"-ff",
+		"-y",
+		bd.GetMappedDeviceFile(),
+	}
+
+	err := cmd.RunAndLog(args...)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+// normalizeVolumeGroup adjusts the types and parent references of a volume group
+// and its logical volumes as loaded from a descriptor
+func (bd *BlockDevice) normalizeVolumeGroup() {
+	bd.Type = BlockDeviceTypeLVM2Group
+
+	for _, lv := range bd.Children {
+		lv.Type = BlockDeviceTypeLVM2Volume
+		lv.Parent = bd
+	}
+}
+
+// physicalVolumes returns the partitions in medias declared as physical volumes of
+// the volume group bd
+func (bd *BlockDevice) physicalVolumes(medias []*BlockDevice) []*BlockDevice {
+	res := []*BlockDevice{}
+
+	for _, curr := range medias {
+		for _, ch := range curr.Children {
+			if ch.VolumeGroup == bd.Name {
+				res = append(res, ch)
+			}
+		}
+	}
+
+	return res
+}
+
+// MakeVolumeGroup creates the volume group bd on top of its physical volumes found in
+// medias and creates all of its logical volumes, the physical volumes must have been
+// previously initialized with MakeFs()
+func (bd *BlockDevice) MakeVolumeGroup(medias []*BlockDevice) error {
+	bd.normalizeVolumeGroup()
+
+	pvs := bd.physicalVolumes(medias)
+	if len(pvs) == 0 {
+		return errors.Errorf("No physical volumes found for volume group: %s", bd.Name)
+	}
+
+	args := []string{
+		"vgcreate",
+		"-y",
+		"-s",
+		fmt.Sprintf("%db", lvmExtentSize),
+		bd.Name,
+	}
+
+	for _, curr := range pvs {
+		args = append(args, curr.GetMappedDeviceFile())
+	}
+
+	if err := cmd.RunAndLog(args...); err != nil {
+		return errors.Wrap(err)
+	}
+
+	// Store the volume group for later deactivation
+	activeGroups = append(activeGroups, bd.Name)
+
+	for _, lv := range bd.orderedVolumes() {
+		args = []string{
+			"lvcreate",
+			"-y",
+			"-n",
+			lv.Name,
+		}
+
+		percent, err := lv.volumePercent()
+		if err != nil {
+			return err
+		}
+
+		// a logical volume with no size takes whatever is left in the group
+		if percent > 0 {
+			args = append(args, "-l", fmt.Sprintf("%d%%VG", uint64(percent)))
+		} else if lv.Size == 0 {
+			args = append(args, "-l", "100%FREE")
+		} else {
+			args = append(args, "-l", fmt.Sprintf("%d", lv.Size/lvmExtentSize))
+		}
+
+		args = append(args, bd.Name)
+
+		if err := cmd.RunAndLog(args...); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// orderedVolumes returns the logical volumes of the volume group bd in creation order,
+// the one taking whatever is left in the group is created last
+func (bd *BlockDevice) orderedVolumes() []*BlockDevice {
+	res := []*BlockDevice{}
+	fill := []*BlockDevice{}
+
+	for _, lv := range bd.Children {
+		if lv.RelativeSize == "" && lv.Size == 0 {
+			fill = append(fill, lv)
+		} else {
+			res = append(res, lv)
+		}
+	}
+
+	return append(res, fill...)
+}
+
+// volumePercent returns the percentage of the volume group taken by the logical volume
+// bd, 0 if bd has an absolute size or takes whatever is left in the group
+func (bd *BlockDevice) volumePercent() (float64, error) {
+	if bd.RelativeSize == "" {
+		return 0, nil
+	}
+
+	rs, err := parseRelativeSize(bd.RelativeSize)
+	if err != nil {
+		return 0, err
+	}
+
+	if rs.min != 0 || rs.max != 0 {
+		return 0, errors.Errorf("Size bounds are not supported by logical volumes: %s", bd.Name)
+	}
+
+	return rs.percent, nil
+}
+
+// DeactivateVolumeGroups deactivates all the previously created volume groups
+func DeactivateVolumeGroups() error {
+	fails := []string{}
+
+	for _, name := range activeGroups {
+		if err := cmd.RunAndLog("vgchange", "-an", name); err != nil {
+			log.ErrorError(fmt.Errorf("vgchange %s: %v", name, err))
+			fails = append(fails, name)
+		} else {
+			log.Debug("Deactivated ok: %s", name)
+		}
+	}
+
+	activeGroups = nil
+
+	if len(fails) > 0 {
+		return errors.Errorf("Failed to deactivate: %v", fails)
+	}
+
+	return nil
+}
+
+// ValidateVolumeGroups checks the volume groups are consistent with the physical
+// volumes declared in medias and that the logical volumes fit in their groups, all
+// the problems found are returned as a ValidationError
+func ValidateVolumeGroups(medias []*BlockDevice, groups []*BlockDevice) error {
+	ve := &ValidationError{}
+	ve.validateVolumeGroups(medias, groups)
+	return ve.err()
+}
+
+// validateVolumeGroups records the problems of the volume groups, see ValidateVolumeGroups()
+func (ve *ValidationError) validateVolumeGroups(medias []*BlockDevice, groups []*BlockDevice) {
+	names := map[string]bool{}
+
+	for _, vg := range groups {
+		if vg.Name == "" {
+			ve.add(nil, "Volume groups must be named")
+			continue
+		}
+
+		if names[vg.Name] {
+			ve.add(nil, "Duplicated volume group: %s", vg.Name)
+			continue
+		}
+		names[vg.Name] = true
+
+		var available uint64
+		for _, pv := range vg.physicalVolumes(medias) {
+			available = available + pv.Size
+		}
+
+		if available == 0 {
+			ve.add(nil, "No physical volumes found for volume group: %s", vg.Name)
+			continue
+		}
+
+		var required uint64
+		lvNames := map[string]bool{}
+		fill := false
+
+		for _, lv := range vg.Children {
+			if lv.Name == "" {
+				ve.add(nil, "Logical volumes of %s must be named", vg.Name)
+				continue
+			}
+
+			if lvNames[lv.Name] {
+				ve.add(nil, "Duplicated logical volume: %s/%s", vg.Name, lv.Name)
+				continue
+			}
+			lvNames[lv.Name] = true
+
+			if _, ok := LookupFileSystem(lv.FsType); !ok || lv.FsType == "vfat" {
+				ve.add(nil, "Unsupported file system for logical volume %s/%s: %s",
+					vg.Name, lv.Name, lv.FsType)
+			}
+
+			ve.addError(nil, lv.validateSubvolumes())
+			ve.addError(nil, lv.validateMountOptions())
+
+			percent, err := lv.volumePercent()
+			if err != nil {
+				ve.addError(nil, err)
+				continue
+			}
+
+			if percent > 0 {
+				required = required + uint64(float64(available)*percent/100)
+			} else if lv.Size > 0 && lv.Size < lvmExtentSize {
+				ve.add(nil, "Logical volume %s/%s is smaller than an extent of %d bytes",
+					vg.Name, lv.Name, lvmExtentSize)
+			} else if lv.Size == 0 && fill {
+				ve.add(nil, "Only one logical volume of %s may omit its size", vg.Name)
+			} else if lv.Size == 0 {
+				fill = true
+			}
+
+			required = required + lv.Size
+		}
+
+		if required > available {
+			ve.add(nil, "Logical volumes of %s don't fit in its physical volumes", vg.Name)
+		}
+	}
+
+	for _, bd := range medias {
+		for _, ch := range bd.Children {
+			if ch.VolumeGroup != "" && !names[ch.VolumeGroup] {
+				ve.add(nil, "Partition %s references an unknown volume group: %s",
+					ch.Name, ch.VolumeGroup)
+			}
+		}
+	}
+}
+
+// VolumeGroupKernelCmdline returns the kernel command line arguments required to
+// boot from a root file system in a logical volume
+func VolumeGroupKernelCmdline(groups []*BlockDevice) string {
+	for _, vg := range groups {
+		for _, lv := range vg.Children {
+			if lv.mainMountPoint() != "/" {
+				continue
+			}
+
+			// groups not yet created are not normalized
+			dev := *lv
+			dev.Type = BlockDeviceTypeLVM2Volume
+			dev.Parent = vg
+
+			return fmt.Sprintf("rd.lvm.vg=%s root=%s", vg.Name, dev.GetMappedDeviceFile())
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,457 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/log"
+	"github.com/clearlinux/clr-installer/plan"
+)
+
+const (
+	// umountRetries is how many times a busy mount point is unmounted before
+	// falling back to a lazy unmount
+	umountRetries = 5
+
+	// umountRetryDelay is the time waited between unmount attempts
+	umountRetryDelay = 500 * time.Millisecond
+
+	// installDirPrefix is the prefix of the installation root directories
+	installDirPrefix = "install-"
+
+	// ownerFileSuffix is appended to an installation root directory to name the file,
+	// next to it, holding the pid of the installer process owning its mounts
+	ownerFileSuffix = ".owner"
+)
+
+// mountEntry is a mount point recorded by a MountManager
+type mountEntry struct {
+	device string
+	path   string
+	fsType string
+	parent *mountEntry // the recorded mount the mount point lives in, nil for the top level
+}
+
+// MountManager records the mount tree of an installation root directory and tears
+// it down in dependency order. Every installation root has its own manager so
+// multiple installations can be handled by the same process
+type MountManager struct {
+	root   string
+	mutex  sync.Mutex
+	mounts []*mountEntry
+}
+
+var (
+	managers      = map[string]*MountManager{}
+	managersMutex sync.Mutex
+
+	// mountInfoFile lists the mount points of the installer's mount namespace
+	mountInfoFile = "/proc/self/mountinfo"
+)
+
+// GetMountManager returns the mount manager of the installation root directory
+// root, it's created on first use
+func GetMountManager(root string) *MountManager {
+	managersMutex.Lock()
+	defer managersMutex.Unlock()
+
+	root = filepath.Clean(root)
+
+	if mm, ok := managers[root]; ok {
+		return mm
+	}
+
+	mm := &MountManager{root: root}
+	managers[root] = mm
+
+	return mm
+}
+
+// Root returns the installation root directory managed by mm
+func (mm *MountManager) Root() string {
+	return mm.root
+}
+
+// MountPoints returns the mount points recorded by mm in mount order
+func (mm *MountManager) MountPoints() []string {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	res := []string{}
+	for _, curr := range mm.mounts {
+		res = append(res, curr.path)
+	}
+
+	return res
+}
+
+// parentOf returns the recorded mount path lives in, the deepest one if nested
+func (mm *MountManager) parentOf(path string) *mountEntry {
+	var res *mountEntry
+
+	for _, curr := range mm.mounts {
+		if path == curr.path || !filepath.HasPrefix(path, curr.path+"/") {
+			continue
+		}
+
+		if res == nil || len(curr.path) > len(res.path) {
+			res = curr
+		}
+	}
+
+	return res
+}
+
+// Mount mounts device at path, creating the mount point if needed, and records it
+func (mm *MountManager) Mount(device string, path string, fsType string, flags uintptr,
+	data string) error {
+	path = filepath.Clean(path)
+
+	if plan.Enabled() {
+		plan.Add("mount %s at %s", device, path)
+		return nil
+	}
+
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err = os.MkdirAll(path, 0777); err != nil {
+			return errors.Errorf("mkdir %s: %v", path, err)
+		}
+	}
+
+	if len(mm.mounts) == 0 {
+		if err := mm.claimRoot(); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Mount(device, path, fsType, flags, data); err != nil {
+		return errors.Errorf("mount %s: %v", path, err)
+	}
+	log.Debug("Mounted ok: %s", path)
+
+	mm.mounts = append(mm.mounts, &mountEntry{
+		device: device,
+		path:   path,
+		fsType: fsType,
+		parent: mm.parentOf(path),
+	})
+
+	return nil
+}
+
+// ownerFile returns the path of the file recording the owner process of root
+func ownerFile(root string) string {
+	return filepath.Clean(root) + ownerFileSuffix
+}
+
+// claimRoot records the current process as the owner of the mounts of mm, the file
+// is written next to the root directory since the root itself gets mounted over
+func (mm *MountManager) claimRoot() error {
+	pid := []byte(strconv.Itoa(os.Getpid()))
+
+	if err := ioutil.WriteFile(ownerFile(mm.root), pid, 0644); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+// ownerAlive returns true if the installer process owning the mounts of root is
+// still running, roots with a missing or invalid owner file are considered orphans
+func ownerAlive(root string) bool {
+	content, err := ioutil.ReadFile(ownerFile(root))
+	if err != nil {
+		return false
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+
+	if err = syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+
+	return true
+}
+
+// MountMetaFs mounts proc, sysfs and devfs in the installation root directory
+func (mm *MountManager) MountMetaFs() error {
+	meta := []struct {
+		device string
+		dir    string
+		fsType string
+	}{
+		{"/proc", "proc", "proc"},
+		{"/sys", "sys", "sysfs"},
+		{"/dev", "dev", "devtmpfs"},
+	}
+
+	for _, curr := range meta {
+		err := mm.Mount(curr.device, filepath.Join(mm.root, curr.dir), curr.fsType,
+			syscall.MS_BIND, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// umount unmounts path retrying while busy, a lazy unmount is used as last resort
+func umount(path string) error {
+	var err error
+
+	for i := 0; i < umountRetries; i++ {
+		if err = syscall.Unmount(path, 0); err == nil {
+			return nil
+		}
+
+		if err != syscall.EBUSY {
+			break
+		}
+
+		time.Sleep(umountRetryDelay)
+	}
+
+	log.Warning("umount %s: %v, falling back to a lazy unmount", path, err)
+
+	if err = syscall.Unmount(path, syscall.MNT_DETACH); err != nil {
+		return errors.Errorf("umount %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// umountOrder returns mounts sorted so nested mounts come before the mounts they
+// live in, mounts at the same level are unmounted in reverse mount order
+func umountOrder(mounts []*mountEntry) []*mountEntry {
+	depth := func(me *mountEntry) int {
+		res := 0
+		for curr := me.parent; curr != nil; curr = curr.parent {
+			res++
+		}
+		return res
+	}
+
+	res := make([]*mountEntry, len(mounts))
+	for i, curr := range mounts {
+		res[len(mounts)-1-i] = curr
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return depth(res[i]) > depth(res[j])
+	})
+
+	return res
+}
+
+// UmountAll unmounts all the mounts recorded by mm, children first, and forgets mm
+func (mm *MountManager) UmountAll() error {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	fails := []string{}
+
+	for _, curr := range umountOrder(mm.mounts) {
+		if err := umount(curr.path); err != nil {
+			log.ErrorError(err)
+			fails = append(fails, curr.path)
+		} else {
+			log.Debug("Unmounted ok: %s", curr.path)
+		}
+	}
+
+	mm.mounts = nil
+
+	if len(fails) == 0 {
+		if err := os.Remove(ownerFile(mm.root)); err != nil && !os.IsNotExist(err) {
+			log.ErrorError(errors.Wrap(err))
+		}
+	}
+
+	managersMutex.Lock()
+	delete(managers, mm.root)
+	managersMutex.Unlock()
+
+	if len(fails) > 0 {
+		return errors.Errorf("Failed to unmount: %v", fails)
+	}
+
+	return nil
+}
+
+// MountMetaFs mounts proc, sysfs and devfs in the target installation directory
+func MountMetaFs(rootDir string) error {
+	return GetMountManager(rootDir).MountMetaFs()
+}
+
+// UmountAll unmounts all previously mounted devices of every installation
+func UmountAll() error {
+	managersMutex.Lock()
+	all := []*MountManager{}
+	for _, mm := range managers {
+		all = append(all, mm)
+	}
+	managersMutex.Unlock()
+
+	fails := []string{}
+	for _, mm := range all {
+		if err := mm.UmountAll(); err != nil {
+			fails = append(fails, mm.root)
+		}
+	}
+
+	if len(fails) > 0 {
+		return errors.Errorf("Failed to unmount: %v", fails)
+	}
+
+	return nil
+}
+
+// unescapeMountInfo decodes the octal escapes of the mountinfo paths i.e \040
+func unescapeMountInfo(str string) string {
+	res := strings.Builder{}
+
+	for i := 0; i < len(str); i++ {
+		if str[i] == '\\' && i+3 < len(str) {
+			if c, err := strconv.ParseUint(str[i+1:i+4], 8, 8); err == nil {
+				res.WriteByte(byte(c))
+				i = i + 3
+				continue
+			}
+		}
+
+		res.WriteByte(str[i])
+	}
+
+	return res.String()
+}
+
+// parseMountInfo returns the mount points listed in a mountinfo file
+func parseMountInfo(r io.Reader) ([]string, error) {
+	res := []string{}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		res = append(res, unescapeMountInfo(fields[4]))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	return res, nil
+}
+
+// staleMountPoints returns the mount points under installation root directories of
+// tmpDir whose owner process is gone, deepest first. The roots managed by this
+// process or owned by another running installer are skipped
+func staleMountPoints(mountPoints []string, tmpDir string) []string {
+	res := []string{}
+	prefix := filepath.Join(filepath.Clean(tmpDir), installDirPrefix)
+
+	managersMutex.Lock()
+	defer managersMutex.Unlock()
+
+	for _, curr := range mountPoints {
+		if !strings.HasPrefix(curr, prefix) {
+			continue
+		}
+
+		rel, err := filepath.Rel(tmpDir, curr)
+		if err != nil {
+			continue
+		}
+
+		root := filepath.Join(tmpDir, strings.Split(rel, "/")[0])
+		if _, ok := managers[root]; ok || ownerAlive(root) {
+			continue
+		}
+
+		res = append(res, curr)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return strings.Count(res[i], "/") > strings.Count(res[j], "/")
+	})
+
+	return res
+}
+
+// CleanupStaleMounts unmounts the leftovers of a previous installation which didn't
+// finish, i.e crashed, under the install-* root directories of tmpDir and removes
+// those directories. The mounts of the installations of this process, and of the
+// other installers still running, are kept
+func CleanupStaleMounts(tmpDir string) error {
+	f, err := os.Open(mountInfoFile)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	mountPoints, err := parseMountInfo(f)
+	if err != nil {
+		return err
+	}
+
+	stale := staleMountPoints(mountPoints, tmpDir)
+	roots := map[string]bool{}
+	fails := []string{}
+
+	for _, curr := range stale {
+		log.Warning("Unmounting leftover mount point: %s", curr)
+
+		rel, _ := filepath.Rel(tmpDir, curr)
+		roots[filepath.Join(tmpDir, strings.Split(rel, "/")[0])] = true
+
+		if err = syscall.Unmount(curr, syscall.MNT_DETACH); err != nil {
+			log.ErrorError(fmt.Errorf("umount %s: %v", curr, err))
+			fails = append(fails, curr)
+		}
+	}
+
+	if len(fails) > 0 {
+		return errors.Errorf("Failed to unmount: %v", fails)
+	}
+
+	for root := range roots {
+		log.Debug("Removing leftover root directory: %s", root)
+
+		if err = os.RemoveAll(root); err != nil {
+			return errors.Wrap(err)
+		}
+
+		if err = os.Remove(ownerFile(root)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,307 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/log"
+	"github.com/clearlinux/clr-installer/plan"
+	"github.com/clearlinux/clr-installer/utils"
+)
+
+const (
+	// DefaultRaidMetadata is the superblock version used when none is provided
+	DefaultRaidMetadata = "1.2"
+
+	// raidSizeTolerance is the maximum size difference accepted between members
+	// of the same array, partitions are aligned to MiB boundaries
+	raidSizeTolerance = 1 << 20
+)
+
+var (
+	raidMemberOps = &FileSystem{Name: "raid", MakeFs: raidMakeFs}
+
+	// raidMinMembers maps the supported raid levels to their minimum member count
+	raidMinMembers = map[string]int{
+		"0":  2,
+		"1":  2,
+		"5":  3,
+		"6":  4,
+		"10": 4,
+	}
+
+	raidMetadataVersions = []string{"0.90", "1.0", "1.1", "1.2"}
+
+	activeArrays []string
+)
+
+// raidMakeFs clears any stale raid superblock, members are assembled later
+// by MakeRaidArray()
+func raidMakeFs(bd *BlockDevice) error {
+	args := []string{
+		"mdadm",
+		"--zero-superblock",
+		"--force",
+		bd.GetMappedDeviceFile(),
+	}
+
+	err := cmd.RunAndLog(args...)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+// raidMembers returns the partitions in medias declared as members of the raid
+// array bd
+func (bd *BlockDevice) raidMembers(medias []*BlockDevice) []*BlockDevice {
+	res := []*BlockDevice{}
+
+	for _, curr := range medias {
+		for _, ch := range curr.Children {
+			if ch.RaidArray == bd.Name {
+				res = append(res, ch)
+			}
+		}
+	}
+
+	return res
+}
+
+// normalizeRaidArray adjusts the type, metadata and size of a raid array as loaded
+// from a descriptor, the size is calculated based on the level and its members
+func (bd *BlockDevice) normalizeRaidArray(members []*BlockDevice) {
+	bd.Type = BlockDeviceTypeRaid
+
+	if bd.RaidMetadata == "" {
+		bd.RaidMetadata = DefaultRaidMetadata
+	}
+
+	if len(members) == 0 {
+		return
+	}
+
+	smallest := members[0].Size
+	var total uint64
+
+	for _, curr := range members {
+		if curr.Size < smallest {
+			smallest = curr.Size
+		}
+		total = total + curr.Size
+	}
+
+	cnt := uint64(len(members))
+
+	switch bd.RaidLevel {
+	case "0":
+		bd.Size = total
+	case "1":
+		bd.Size = smallest
+	case "5":
+		bd.Size = smallest * (cnt - 1)
+	case "6":
+		bd.Size = smallest * (cnt - 2)
+	case "10":
+		bd.Size = smallest * (cnt / 2)
+	}
+}
+
+// NormalizeRaidArrays adjusts the type, metadata and size of the raid arrays as loaded
+// from a descriptor based on their members found in medias, it's meant to be called
+// once the target medias are known and before validating the layout
+func NormalizeRaidArrays(medias []*BlockDevice, arrays []*BlockDevice) {
+	for _, arr := range arrays {
+		arr.normalizeRaidArray(arr.raidMembers(medias))
+	}
+}
+
+// MakeRaidArray assembles the raid array bd with its members found in medias, the
+// members must have been previously prepared with MakeFs()
+func (bd *BlockDevice) MakeRaidArray(medias []*BlockDevice) error {
+	members := bd.raidMembers(medias)
+	bd.normalizeRaidArray(members)
+
+	if len(members) == 0 {
+		return errors.Errorf("No members found for raid array: %s", bd.Name)
+	}
+
+	args := []string{
+		"mdadm",
+		"--create",
+		bd.GetDeviceFile(),
+		"--run",
+		fmt.Sprintf("--level=%s", bd.RaidLevel),
+		fmt.Sprintf("--metadata=%s", bd.RaidMetadata),
+		fmt.Sprintf("--raid-devices=%d", len(members)),
+	}
+
+	for _, curr := range members {
+		args = append(args, curr.GetMappedDeviceFile())
+	}
+
+	if err := cmd.RunAndLog(args...); err != nil {
+		return errors.Wrap(err)
+	}
+
+	// Store the array for later stopping
+	activeArrays = append(activeArrays, bd.GetDeviceFile())
+
+	return nil
+}
+
+// StopRaidArrays stops all the previously assembled raid arrays
+func StopRaidArrays() error {
+	fails := []string{}
+
+	for i := len(activeArrays) - 1; i >= 0; i-- {
+		dev := activeArrays[i]
+
+		if err := cmd.RunAndLog("mdadm", "--stop", dev); err != nil {
+			log.ErrorError(fmt.Errorf("mdadm --stop %s: %v", dev, err))
+			fails = append(fails, dev)
+		} else {
+			log.Debug("Stopped ok: %s", dev)
+		}
+	}
+
+	activeArrays = nil
+
+	if len(fails) > 0 {
+		return errors.Errorf("Failed to stop: %v", fails)
+	}
+
+	return nil
+}
+
+// WriteMdadmConf writes the target's /etc/mdadm.conf describing the assembled
+// raid arrays, no-op if no array was assembled
+func WriteMdadmConf(rootDir string) error {
+	if len(activeArrays) == 0 {
+		return nil
+	}
+
+	w := bytes.NewBuffer(nil)
+	if plan.Enabled() {
+		plan.AddCommand("mdadm", "--detail", "--scan")
+	} else if err := cmd.Run(w, "mdadm", "--detail", "--scan"); err != nil {
+		return errors.Errorf("mdadm --detail --scan: %s", w.String())
+	}
+
+	etcDir := filepath.Join(rootDir, "etc")
+	if err := utils.MkdirAll(etcDir, 0755); err != nil {
+		return err
+	}
+
+	if err := plan.WriteFile(filepath.Join(etcDir, "mdadm.conf"), w.Bytes(), 0644); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+func isValidRaidMetadata(metadata string) bool {
+	for _, curr := range raidMetadataVersions {
+		if curr == metadata {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateRaidArrays checks the raid arrays are consistent with the members declared
+// in medias, the level's minimum member count is satisfied and the members have
+// matching sizes, all the problems found are returned as a ValidationError
+func ValidateRaidArrays(medias []*BlockDevice, arrays []*BlockDevice) error {
+	ve := &ValidationError{}
+	ve.validateRaidArrays(medias, arrays)
+	return ve.err()
+}
+
+// validateRaidArrays records the problems of the raid arrays, see ValidateRaidArrays()
+func (ve *ValidationError) validateRaidArrays(medias []*BlockDevice, arrays []*BlockDevice) {
+	names := map[string]bool{}
+
+	for _, arr := range arrays {
+		if arr.Name == "" {
+			ve.add(nil, "Raid arrays must be named")
+			continue
+		}
+
+		if names[arr.Name] {
+			ve.add(nil, "Duplicated raid array: %s", arr.Name)
+			continue
+		}
+		names[arr.Name] = true
+
+		min, ok := raidMinMembers[arr.RaidLevel]
+		if !ok {
+			ve.add(nil, "Unsupported raid level for %s: %s", arr.Name, arr.RaidLevel)
+		}
+
+		if arr.RaidMetadata != "" && !isValidRaidMetadata(arr.RaidMetadata) {
+			ve.add(nil, "Unsupported raid metadata for %s: %s", arr.Name, arr.RaidMetadata)
+		}
+
+		if _, ok := LookupFileSystem(arr.FsType); !ok {
+			ve.add(nil, "Unsupported file system for raid array %s: %s", arr.Name, arr.FsType)
+		}
+
+		ve.addError(nil, arr.validateSubvolumes())
+		ve.addError(nil, arr.validateMountOptions())
+
+		members := arr.raidMembers(medias)
+		if ok && len(members) < min {
+			ve.add(nil, "Raid level %s array %s requires at least %d members, found %d",
+				arr.RaidLevel, arr.Name, min, len(members))
+		}
+
+		for _, curr := range members {
+			if curr.MountPoint != "" {
+				ve.add(nil, "Raid member %s can not have a mount point", curr.Name)
+			}
+
+			diff := int64(curr.Size) - int64(members[0].Size)
+			if diff > raidSizeTolerance || diff < -raidSizeTolerance {
+				ve.add(nil, "Raid members %s and %s of %s have different sizes",
+					members[0].Name, curr.Name, arr.Name)
+			}
+		}
+	}
+
+	for _, bd := range medias {
+		for _, ch := range bd.Children {
+			if ch.RaidArray != "" && !names[ch.RaidArray] {
+				ve.add(nil, "Partition %s references an unknown raid array: %s",
+					ch.Name, ch.RaidArray)
+			}
+		}
+	}
+}
+
+// RaidKernelCmdline returns the kernel command line arguments required to boot
+// from a root file system in a raid array
+func RaidKernelCmdline(arrays []*BlockDevice) string {
+	for _, arr := range arrays {
+		if arr.mainMountPoint() != "/" {
+			continue
+		}
+
+		// arrays not yet normalized are not typed as such
+		dev := *arr
+		dev.Type = BlockDeviceTypeRaid
+
+		return fmt.Sprintf("rd.md=1 root=%s", dev.GetDeviceFile())
+	}
+
+	return ""
+}
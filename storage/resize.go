@@ -0,0 +1,285 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/log"
+	"github.com/clearlinux/clr-installer/plan"
+)
+
+var (
+	extMinSizeExp   = regexp.MustCompile(`(?m)^Estimated minimum size of the filesystem: ([0-9]+)`)
+	extBlockSizeExp = regexp.MustCompile(`(?m)^Block size:\s+([0-9]+)`)
+	ntfsMinSizeExp  = regexp.MustCompile(`You might resize at ([0-9]+) bytes`)
+	btrfsMinSizeExp = regexp.MustCompile(`^([0-9]+) bytes`)
+)
+
+// matchSize returns the size captured by exp in out
+func matchSize(exp *regexp.Regexp, out []byte) (uint64, error) {
+	match := exp.FindSubmatch(out)
+	if match == nil {
+		return 0, errors.Errorf("Could not parse: %s", string(out))
+	}
+
+	size, err := strconv.ParseUint(string(match[1]), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+
+	return size, nil
+}
+
+// parseExtMinSize parses the output of resize2fs -P and dumpe2fs -h returning
+// the minimum file system size in bytes
+func parseExtMinSize(resizeOut []byte, dumpOut []byte) (uint64, error) {
+	blocks, err := matchSize(extMinSizeExp, resizeOut)
+	if err != nil {
+		return 0, err
+	}
+
+	blockSize, err := matchSize(extBlockSizeExp, dumpOut)
+	if err != nil {
+		return 0, err
+	}
+
+	return blocks * blockSize, nil
+}
+
+func extMinSize(bd *BlockDevice) (uint64, error) {
+	resizeOut := bytes.NewBuffer(nil)
+	if err := cmd.Run(resizeOut, "resize2fs", "-P", bd.GetMappedDeviceFile()); err != nil {
+		return 0, errors.Errorf("resize2fs -P %s: %s", bd.GetMappedDeviceFile(), resizeOut.String())
+	}
+
+	dumpOut := bytes.NewBuffer(nil)
+	if err := cmd.Run(dumpOut, "dumpe2fs", "-h", bd.GetMappedDeviceFile()); err != nil {
+		return 0, errors.Errorf("dumpe2fs -h %s: %s", bd.GetMappedDeviceFile(), dumpOut.String())
+	}
+
+	return parseExtMinSize(resizeOut.Bytes(), dumpOut.Bytes())
+}
+
+func extResize(bd *BlockDevice, size uint64) error {
+	// resize2fs refuses to shrink a file system not recently checked, e2fsck exits
+	// with 1 once it corrected the file system errors
+	err := cmd.RunAndLog("e2fsck", "-f", "-y", bd.GetMappedDeviceFile())
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		log.Warning("e2fsck corrected errors in %s", bd.GetMappedDeviceFile())
+	} else if err != nil {
+		return errors.Wrap(err)
+	}
+
+	args := []string{
+		"resize2fs",
+		bd.GetMappedDeviceFile(),
+		fmt.Sprintf("%dK", size>>10),
+	}
+
+	if err := cmd.RunAndLog(args...); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+func btrfsMinSize(bd *BlockDevice) (uint64, error) {
+	var size uint64
+
+	err := bd.withBtrfsMounted(func(dir string) error {
+		w := bytes.NewBuffer(nil)
+		if err := cmd.Run(w, "btrfs", "inspect-internal", "min-dev-size", dir); err != nil {
+			return errors.Errorf("btrfs inspect-internal min-dev-size %s: %s", dir, w.String())
+		}
+
+		var err error
+		size, err = matchSize(btrfsMinSizeExp, w.Bytes())
+		return err
+	})
+
+	return size, err
+}
+
+func btrfsResize(bd *BlockDevice, size uint64) error {
+	return bd.withBtrfsMounted(func(dir string) error {
+		args := []string{
+			"btrfs",
+			"filesystem",
+			"resize",
+			strconv.FormatUint(size, 10),
+			dir,
+		}
+
+		if err := cmd.RunAndLog(args...); err != nil {
+			return errors.Wrap(err)
+		}
+
+		return nil
+	})
+}
+
+func ntfsMinSize(bd *BlockDevice) (uint64, error) {
+	w := bytes.NewBuffer(nil)
+
+	err := cmd.Run(w, "ntfsresize", "--info", "--force", "--no-progress-bar", bd.GetMappedDeviceFile())
+	if err != nil {
+		return 0, errors.Errorf("ntfsresize --info %s: %s", bd.GetMappedDeviceFile(), w.String())
+	}
+
+	return matchSize(ntfsMinSizeExp, w.Bytes())
+}
+
+func ntfsResize(bd *BlockDevice, size uint64) error {
+	args := []string{
+		"ntfsresize",
+		"--force",
+		"--no-progress-bar",
+		"--size",
+		strconv.FormatUint(size, 10),
+		bd.GetMappedDeviceFile(),
+	}
+
+	// ntfsresize asks for confirmation before touching the file system
+	if err := cmd.PipeRunAndLog("y\n", args...); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+// loadedSize returns the size bd had when its disk was listed, 0 if unknown
+func (bd *BlockDevice) loadedSize() uint64 {
+	if bd.Parent == nil {
+		return 0
+	}
+
+	for _, curr := range bd.Parent.loadedChildren {
+		if curr.Name == bd.Name {
+			return curr.Size
+		}
+	}
+
+	return 0
+}
+
+// CanShrink returns true if bd is an existing partition whose file system
+// supports shrinking
+func (bd *BlockDevice) CanShrink() bool {
+	if !bd.Existing {
+		return false
+	}
+
+	op, found := bd.getOps()
+	return found && op.Resize != nil && op.MinSize != nil
+}
+
+// IsShrunk returns true if bd is an existing partition configured to be smaller
+// than it currently is
+func (bd *BlockDevice) IsShrunk() bool {
+	loaded := bd.loadedSize()
+	return bd.Existing && loaded > 0 && bd.Size < loaded
+}
+
+// ProbeMinimumSize queries the file system tools for the minimum size bd can be
+// shrunk to, the result is used by Validate() and IsValidSize(). In dry-run mode the
+// disks are not probed, the skipped probing is recorded in the plan instead
+func (bd *BlockDevice) ProbeMinimumSize() error {
+	if !bd.CanShrink() {
+		return errors.Errorf("File system of %s can not be shrunk: %s", bd.Name, bd.FsType)
+	}
+
+	if plan.Enabled() {
+		plan.Add("skip probing the used space of %s, shrinking it to %d bytes is not checked",
+			bd.GetDeviceFile(), bd.shrunkSize())
+		return nil
+	}
+
+	op, _ := bd.getOps()
+
+	size, err := op.MinSize(bd)
+	if err != nil {
+		return err
+	}
+
+	bd.minSize = size
+	return nil
+}
+
+// ProbeShrunkPartitions probes the minimum size of every existing partition of disks
+// configured to be shrunk, so the layout validation rejects shrinking a partition below
+// its used space before any disk is changed. Partitions already probed are skipped, in
+// dry-run mode the skipped probing is recorded when the partitions are shrunk
+func ProbeShrunkPartitions(disks []*BlockDevice) error {
+	if plan.Enabled() {
+		return nil
+	}
+
+	for _, disk := range disks {
+		for _, curr := range disk.Children {
+			if !curr.IsShrunk() || !curr.CanShrink() || curr.minSize > 0 {
+				continue
+			}
+
+			if err := curr.ProbeMinimumSize(); err != nil {
+				return errors.Errorf("Could not determine the used space of %s: %v", curr.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// MinimumSize returns the previously probed minimum size of bd, 0 if unknown
+func (bd *BlockDevice) MinimumSize() uint64 {
+	return bd.minSize
+}
+
+// shrunkSize returns the size an existing partition is shrunk to, aligned so the
+// partition boundaries stay aligned
+func (bd *BlockDevice) shrunkSize() uint64 {
+	return bd.Size &^ ((1 << 20) - 1)
+}
+
+// checkShrink returns an error if the existing partition bd can't be shrunk to its
+// configured size, its minimum size is probed unless already known
+func (bd *BlockDevice) checkShrink() error {
+	if !bd.CanShrink() {
+		return errors.Errorf("Shrinking not supported for file system: %s", bd.FsType)
+	}
+
+	if bd.minSize == 0 {
+		if err := bd.ProbeMinimumSize(); err != nil {
+			return err
+		}
+	}
+
+	if bd.shrunkSize() < bd.minSize {
+		return errors.Errorf("Can not shrink %s below its used space: %d bytes", bd.Name, bd.minSize)
+	}
+
+	return nil
+}
+
+// shrinkPartition shrinks the file system of the existing partition bd to its configured
+// size, the partition itself is shrunk when writing the partition table. The shrinking
+// must have been checked with checkShrink()
+func (bd *BlockDevice) shrinkPartition() error {
+	op, _ := bd.getOps()
+	size := bd.shrunkSize()
+
+	if err := op.Resize(bd, size); err != nil {
+		return err
+	}
+
+	bd.Size = size
+	return nil
+}
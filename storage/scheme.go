@@ -0,0 +1,195 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/clearlinux/clr-installer/conf"
+	"github.com/clearlinux/clr-installer/errors"
+)
+
+const (
+	// RAMSwapSize is the size of a scheme's partition sized from the installed memory
+	RAMSwapSize = "ram"
+
+	// defaultSwapSize is used for RAMSwapSize when the installed memory is unknown
+	defaultSwapSize = 2 << 30
+
+	// maxSwapSize caps the swap size computed from the installed memory
+	maxSwapSize = 16 << 30
+)
+
+// SchemePartition describes a partition created by a partition scheme, Size is
+// either an absolute or a relative size, or RAMSwapSize
+type SchemePartition struct {
+	FsType     string `json:"fstype"`
+	MountPoint string `json:"mountpoint,omitempty"`
+	Size       string `json:"size"`
+}
+
+// PartitionScheme is a named set of partitions applied to a target disk
+type PartitionScheme struct {
+	Name       string             `json:"name"`
+	Desc       string             `json:"desc"`
+	Partitions []*SchemePartition `json:"partitions"`
+}
+
+// DefaultPartitionScheme is used when no scheme definition file is available
+var DefaultPartitionScheme = &PartitionScheme{
+	Name: "default",
+	Desc: "EFI, swap and a single root file system",
+	Partitions: []*SchemePartition{
+		{FsType: "vfat", MountPoint: "/boot", Size: "150M"},
+		{FsType: "swap", Size: RAMSwapSize},
+		{FsType: "ext4", MountPoint: "/", Size: "rest"},
+	},
+}
+
+// LoadPartitionSchemes loads the partition scheme definitions
+func LoadPartitionSchemes() ([]*PartitionScheme, error) {
+	path, err := conf.LookupPartitionSchemeFile()
+	if err != nil {
+		return nil, err
+	}
+
+	root := struct {
+		Schemes []*PartitionScheme `json:"schemes"`
+	}{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	if err = json.Unmarshal(data, &root); err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	return root.Schemes, nil
+}
+
+// FindPartitionScheme looks up the scheme called name in the scheme definitions, the
+// builtin DefaultPartitionScheme is used for "default" if no definition file is found
+func FindPartitionScheme(name string) (*PartitionScheme, error) {
+	schemes, err := LoadPartitionSchemes()
+	if err != nil {
+		if name == DefaultPartitionScheme.Name {
+			return DefaultPartitionScheme, nil
+		}
+		return nil, err
+	}
+
+	for _, curr := range schemes {
+		if curr.Name == name {
+			return curr, nil
+		}
+	}
+
+	return nil, errors.Errorf("Unknown partition scheme: %s", name)
+}
+
+// Apply replaces the partitions of disk with the ones described by the scheme
+func (ps *PartitionScheme) Apply(disk *BlockDevice) error {
+	disk.Children = nil
+
+	for _, curr := range ps.Partitions {
+		part := &BlockDevice{
+			Type:       BlockDeviceTypePart,
+			FsType:     curr.FsType,
+			MountPoint: curr.MountPoint,
+		}
+
+		disk.AddChild(part)
+
+		if curr.Size == RAMSwapSize {
+			part.Size = swapSizeFromRAM()
+			continue
+		}
+
+		if err := part.SetSize(curr.Size); err != nil {
+			return err
+		}
+	}
+
+	if disk.Size > 0 {
+		return disk.resolveSizes(disk.Size)
+	}
+
+	return nil
+}
+
+// WithoutSwap returns a copy of the scheme without its swap partitions
+func (ps *PartitionScheme) WithoutSwap() *PartitionScheme {
+	res := &PartitionScheme{Name: ps.Name, Desc: ps.Desc, Partitions: []*SchemePartition{}}
+
+	for _, curr := range ps.Partitions {
+		if curr.FsType != "swap" {
+			res.Partitions = append(res.Partitions, curr)
+		}
+	}
+
+	return res
+}
+
+// SwapSizeForMemory returns the recommended swap size for mem bytes of memory, twice
+// the memory up to 2G, as much as the memory up to 8G and half of it above that
+func SwapSizeForMemory(mem uint64) uint64 {
+	var size uint64
+
+	if mem <= 2<<30 {
+		size = mem * 2
+	} else if mem <= 8<<30 {
+		size = mem
+	} else {
+		size = mem / 2
+	}
+
+	if size > maxSwapSize {
+		size = maxSwapSize
+	}
+
+	return size &^ (MinimumPartitionSize - 1)
+}
+
+// parseMemTotal parses the MemTotal entry of /proc/meminfo returning its size in bytes
+func parseMemTotal(data string) (uint64, error) {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, errors.Wrap(err)
+		}
+
+		return kb << 10, nil
+	}
+
+	return 0, errors.Errorf("Could not find the total memory")
+}
+
+// swapSizeFromRAM returns the recommended swap size for the installed memory
+func swapSizeFromRAM() uint64 {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return defaultSwapSize
+	}
+
+	mem, err := parseMemTotal(string(data))
+	if err != nil || mem == 0 {
+		return defaultSwapSize
+	}
+
+	return SwapSizeForMemory(mem)
+}
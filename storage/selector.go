@@ -0,0 +1,301 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/clearlinux/clr-installer/errors"
+)
+
+const (
+	// PickLargest selects the largest of the disks matching a rule
+	PickLargest = "largest"
+
+	// PickSmallest selects the smallest of the disks matching a rule
+	PickSmallest = "smallest"
+
+	// MediaSSD matches non rotational disks
+	MediaSSD = "ssd"
+
+	// MediaHDD matches rotational disks
+	MediaHDD = "hdd"
+)
+
+// DiskSelector is a rule selecting a target disk among the disks found at install
+// time i.e the largest non removable ssd or the smallest disk of at least 64G
+type DiskSelector struct {
+	Pick      string `yaml:"pick,omitempty"`      // largest or smallest, required if many disks match
+	Media     string `yaml:"media,omitempty"`     // ssd or hdd
+	Removable *bool  `yaml:"removable,omitempty"` // match removable or non removable disks only
+	MinSize   string `yaml:"minSize,omitempty"`   // minimum disk size
+	MaxSize   string `yaml:"maxSize,omitempty"`   // maximum disk size
+}
+
+// validate checks the rule's values are well formed
+func (ds *DiskSelector) validate() error {
+	if ds.Pick != "" && ds.Pick != PickLargest && ds.Pick != PickSmallest {
+		return errors.Errorf("Invalid disk selection: %s", ds.Pick)
+	}
+
+	if ds.Media != "" && ds.Media != MediaSSD && ds.Media != MediaHDD {
+		return errors.Errorf("Invalid disk media: %s", ds.Media)
+	}
+
+	for _, curr := range []string{ds.MinSize, ds.MaxSize} {
+		if curr == "" {
+			continue
+		}
+
+		if _, err := ParseVolumeSize(curr); err != nil {
+			return errors.Errorf("Invalid disk size: %s", curr)
+		}
+	}
+
+	return nil
+}
+
+// matches returns true if disk satisfies all the rule's conditions
+func (ds *DiskSelector) matches(disk *BlockDevice) bool {
+	if ds.Media == MediaSSD && disk.Rotational || ds.Media == MediaHDD && !disk.Rotational {
+		return false
+	}
+
+	if ds.Removable != nil && *ds.Removable != disk.RemovableDevice {
+		return false
+	}
+
+	if min, err := ParseVolumeSize(ds.MinSize); ds.MinSize != "" && (err != nil || disk.Size < min) {
+		return false
+	}
+
+	if max, err := ParseVolumeSize(ds.MaxSize); ds.MaxSize != "" && (err != nil || disk.Size > max) {
+		return false
+	}
+
+	return true
+}
+
+// String describes the rule for error messages
+func (ds *DiskSelector) String() string {
+	res := []string{}
+
+	if ds.Pick != "" {
+		res = append(res, ds.Pick)
+	}
+
+	if ds.Removable != nil && *ds.Removable {
+		res = append(res, "removable")
+	} else if ds.Removable != nil {
+		res = append(res, "non-removable")
+	}
+
+	if ds.Media != "" {
+		res = append(res, ds.Media)
+	} else {
+		res = append(res, "disk")
+	}
+
+	if ds.MinSize != "" {
+		res = append(res, ">= "+ds.MinSize)
+	}
+
+	if ds.MaxSize != "" {
+		res = append(res, "<= "+ds.MaxSize)
+	}
+
+	return strings.Join(res, " ")
+}
+
+// HasSelector returns true if bd selects its disk by a stable identifier or a rule
+// instead of its name
+func (bd *BlockDevice) HasSelector() bool {
+	return bd.Serial != "" || bd.WWN != "" || bd.DevicePath != "" || bd.Selector != nil
+}
+
+// selectorString describes how bd selects its disk for error messages
+func (bd *BlockDevice) selectorString() string {
+	res := []string{}
+
+	if bd.Serial != "" {
+		res = append(res, fmt.Sprintf("serial %s", bd.Serial))
+	}
+
+	if bd.WWN != "" {
+		res = append(res, fmt.Sprintf("wwn %s", bd.WWN))
+	}
+
+	if bd.DevicePath != "" {
+		res = append(res, bd.DevicePath)
+	}
+
+	if bd.Selector != nil {
+		res = append(res, bd.Selector.String())
+	}
+
+	return strings.Join(res, ", ")
+}
+
+// validateSelector checks the identifiers and the rule selecting bd's disk are well formed
+func (bd *BlockDevice) validateSelector() error {
+	if bd.DevicePath != "" && !strings.HasPrefix(bd.DevicePath, "/dev/disk/by-") {
+		return errors.Errorf("Invalid device path, expected a /dev/disk/by-* link: %s",
+			bd.DevicePath)
+	}
+
+	if bd.Selector != nil {
+		return bd.Selector.validate()
+	}
+
+	return nil
+}
+
+// devicePathName returns the name of the device a /dev/disk/by-* link points to
+func devicePathName(path string) (string, error) {
+	link, err := os.Readlink(path)
+	if err != nil {
+		return "", errors.Errorf("Could not resolve device path %s: %v", path, err)
+	}
+
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(filepath.Dir(path), link)
+	}
+
+	return filepath.Base(filepath.Clean(link)), nil
+}
+
+// matchesDisk returns true if disk satisfies all of bd's identifiers and rule
+func (bd *BlockDevice) matchesDisk(disk *BlockDevice) (bool, error) {
+	if bd.Serial != "" && bd.Serial != disk.Serial {
+		return false, nil
+	}
+
+	if bd.WWN != "" && !strings.EqualFold(bd.WWN, disk.WWN) {
+		return false, nil
+	}
+
+	if bd.DevicePath != "" {
+		name, err := devicePathName(bd.DevicePath)
+		if err != nil {
+			return false, err
+		}
+
+		if name != disk.Name {
+			return false, nil
+		}
+	}
+
+	if bd.Selector != nil && !bd.Selector.matches(disk) {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// selectDisk returns the only disk of candidates selected by bd
+func (bd *BlockDevice) selectDisk(candidates []*BlockDevice) (*BlockDevice, error) {
+	if err := bd.validateSelector(); err != nil {
+		return nil, err
+	}
+
+	matched := []*BlockDevice{}
+
+	for _, curr := range candidates {
+		ok, err := bd.matchesDisk(curr)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			matched = append(matched, curr)
+		}
+	}
+
+	if len(matched) == 0 {
+		return nil, errors.Errorf("No disk matches the target media: %s", bd.selectorString())
+	}
+
+	pick := ""
+	if bd.Selector != nil {
+		pick = bd.Selector.Pick
+	}
+
+	if pick != "" {
+		sort.SliceStable(matched, func(i, j int) bool {
+			if pick == PickLargest {
+				return matched[i].Size > matched[j].Size
+			}
+			return matched[i].Size < matched[j].Size
+		})
+
+		// disks of the same size can not be told apart
+		if len(matched) > 1 && matched[0].Size == matched[1].Size {
+			matched = matched[:2]
+		} else {
+			matched = matched[:1]
+		}
+	}
+
+	if len(matched) > 1 {
+		names := []string{}
+		for _, curr := range matched {
+			names = append(names, curr.Name)
+		}
+
+		return nil, errors.Errorf("Ambiguous target media %s, matches: %s", bd.selectorString(),
+			strings.Join(names, ", "))
+	}
+
+	return matched[0], nil
+}
+
+// ResolveTargetMedias binds the target medias selected by identifiers or rules to the
+// disks of inventory, as returned by ListBlockDevices(). Disks in use by the host, i.e
+// the installer media, are never selected. Target medias are given the name and size
+// of their disk, it's an error if a rule matches none or many disks or two target
+// medias select the same disk
+func ResolveTargetMedias(targets []*BlockDevice, inventory []*BlockDevice) error {
+	candidates := []*BlockDevice{}
+	for _, curr := range inventory {
+		if curr.Type == BlockDeviceTypeDisk && curr.IsAvailable() {
+			candidates = append(candidates, curr)
+		}
+	}
+
+	selected := map[string]*BlockDevice{}
+
+	for _, curr := range targets {
+		if !curr.HasSelector() {
+			continue
+		}
+
+		disk, err := curr.selectDisk(candidates)
+		if err != nil {
+			return err
+		}
+
+		if prev, ok := selected[disk.Name]; ok {
+			return errors.Errorf("Target medias %s and %s select the same disk: %s",
+				prev.selectorString(), curr.selectorString(), disk.Name)
+		}
+		selected[disk.Name] = curr
+
+		curr.Name = disk.Name
+		curr.Model = disk.Model
+		curr.MajorMinor = disk.MajorMinor
+		curr.Type = disk.Type
+		curr.Size = disk.Size
+		curr.Rotational = disk.Rotational
+		curr.RemovableDevice = disk.RemovableDevice
+		curr.ReadOnly = disk.ReadOnly
+		curr.loadedChildren = disk.loadedChildren
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/clearlinux/clr-installer/errors"
+)
+
+const (
+	// reservedDiskSpace is left unpartitioned when resolving relative sizes, it
+	// accounts for the partition alignment and the backup gpt header
+	reservedDiskSpace = 2 << 20
+)
+
+var (
+	// sysBlockDir is where the kernel exposes the block devices attributes
+	sysBlockDir = "/sys/class/block"
+)
+
+// relativeSize is a size expressed as a percentage of the disk or as the space left
+// by the other partitions, optionally bounded by a minimum and maximum size
+type relativeSize struct {
+	percent float64 // percentage of the disk, 0 for the remaining space
+	min     uint64
+	max     uint64
+}
+
+// IsRelativeSize returns true if str is a relative size i.e 50%, rest or fill, optionally
+// followed by bounds i.e 50%,min=10G,max=100G
+func IsRelativeSize(str string) bool {
+	head := strings.TrimSpace(strings.Split(strings.ToLower(str), ",")[0])
+	return head == "rest" || head == "fill" || strings.HasSuffix(head, "%")
+}
+
+// parseRelativeSize parses a relative size as accepted by IsRelativeSize()
+func parseRelativeSize(str string) (*relativeSize, error) {
+	if !IsRelativeSize(str) {
+		return nil, errors.Errorf("Not a relative size: %s", str)
+	}
+
+	res := &relativeSize{}
+	fields := strings.Split(strings.ToLower(str), ",")
+	head := strings.TrimSpace(fields[0])
+
+	if strings.HasSuffix(head, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(head, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, errors.Errorf("Invalid percentage: %s", head)
+		}
+
+		res.percent = percent
+	}
+
+	for _, curr := range fields[1:] {
+		kv := strings.SplitN(strings.TrimSpace(curr), "=", 2)
+		if len(kv) != 2 || IsRelativeSize(kv[1]) {
+			return nil, errors.Errorf("Invalid size bound: %s", curr)
+		}
+
+		size, err := ParseVolumeSize(kv[1])
+		if err != nil {
+			return nil, err
+		}
+
+		switch kv[0] {
+		case "min":
+			res.min = size
+		case "max":
+			res.max = size
+		default:
+			return nil, errors.Errorf("Invalid size bound: %s", curr)
+		}
+	}
+
+	if res.max != 0 && res.min > res.max {
+		return nil, errors.Errorf("Minimum size larger than the maximum: %s", str)
+	}
+
+	return res, nil
+}
+
+// clamp bounds size to the relative size's minimum and maximum
+func (rs *relativeSize) clamp(size uint64) uint64 {
+	if size < rs.min {
+		size = rs.min
+	}
+
+	if rs.max != 0 && size > rs.max {
+		size = rs.max
+	}
+
+	return size
+}
+
+// SetSize sets bd's size from str, either an absolute or a relative size. Relative sizes
+// are estimated against the parent disk, they are only final once resolved by ResolveSizes()
+func (bd *BlockDevice) SetSize(str string) error {
+	if !IsRelativeSize(str) {
+		size, err := ParseVolumeSize(str)
+		if err != nil {
+			return err
+		}
+
+		bd.Size = size
+		bd.RelativeSize = ""
+		return nil
+	}
+
+	if _, err := parseRelativeSize(str); err != nil {
+		return err
+	}
+
+	bd.RelativeSize = str
+
+	if bd.Parent != nil && bd.Parent.Size > 0 {
+		return bd.Parent.resolveSizes(bd.Parent.Size)
+	}
+
+	return nil
+}
+
+// diskSize reads the current size of the disk bd from sysfs
+func (bd *BlockDevice) diskSize() (uint64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(sysBlockDir, bd.Name, "size"))
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+
+	// sysfs always reports the size in 512 bytes sectors
+	return sectors * 512, nil
+}
+
+// ResolveSizes computes the actual size of the partitions declared with relative sizes
+// against the real size of the disk bd, it must be called before WritePartitionTable()
+func (bd *BlockDevice) ResolveSizes() error {
+	relative := false
+	for _, curr := range bd.Children {
+		if curr.RelativeSize != "" {
+			relative = true
+			break
+		}
+	}
+
+	if !relative {
+		return nil
+	}
+
+	size, err := bd.diskSize()
+	if err != nil {
+		if bd.Size == 0 {
+			return errors.Errorf("Could not determine the size of %s: %v", bd.Name, err)
+		}
+
+		size = bd.Size
+	}
+
+	bd.Size = size
+	return bd.resolveSizes(size)
+}
+
+// resolveSizes computes the size of the partitions declared with relative sizes given
+// the disk's total size, percentages are resolved first and the remaining space is
+// given to the partition declared as rest
+func (bd *BlockDevice) resolveSizes(total uint64) error {
+	if total <= reservedDiskSpace {
+		return errors.Errorf("Disk %s is too small", bd.Name)
+	}
+
+	usable := total - reservedDiskSpace
+
+	var used uint64
+	var rest *BlockDevice
+	var restSize *relativeSize
+
+	for _, curr := range bd.Children {
+		if curr.RelativeSize == "" {
+			used = used + curr.Size
+			continue
+		}
+
+		rs, err := parseRelativeSize(curr.RelativeSize)
+		if err != nil {
+			return err
+		}
+
+		if rs.percent == 0 {
+			if rest != nil {
+				return errors.Errorf("Only one partition of %s may take the remaining space",
+					bd.Name)
+			}
+
+			rest = curr
+			restSize = rs
+			continue
+		}
+
+		size := rs.clamp(uint64(float64(usable) * rs.percent / 100))
+		curr.Size = size &^ (MinimumPartitionSize - 1)
+		used = used + curr.Size
+	}
+
+	if used > usable {
+		return errors.Errorf("Partitions of %s don't fit in the disk", bd.Name)
+	}
+
+	if rest == nil {
+		return nil
+	}
+
+	remaining := usable - used
+	if remaining < restSize.min || remaining < MinimumPartitionSize {
+		return errors.Errorf("Not enough space left for partition: %s", rest.Name)
+	}
+
+	rest.Size = restSize.clamp(remaining) &^ (MinimumPartitionSize - 1)
+
+	return nil
+}
+
+// validateRelativeSizes checks the relative sizes of bd's partitions are well formed
+func (bd *BlockDevice) validateRelativeSizes() error {
+	rest := false
+
+	for _, curr := range bd.Children {
+		if curr.RelativeSize == "" {
+			continue
+		}
+
+		if curr.Existing {
+			return errors.Errorf("Existing partition %s requires an absolute size", curr.Name)
+		}
+
+		rs, err := parseRelativeSize(curr.RelativeSize)
+		if err != nil {
+			return err
+		}
+
+		if rs.percent == 0 {
+			if rest {
+				return errors.Errorf("Only one partition of %s may take the remaining space",
+					bd.Name)
+			}
+			rest = true
+		}
+	}
+
+	return nil
+}
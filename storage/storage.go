@@ -12,13 +12,13 @@ import (
 	"math"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/clearlinux/clr-installer/cmd"
 	"github.com/clearlinux/clr-installer/errors"
-	"github.com/clearlinux/clr-installer/utils"
+	"github.com/clearlinux/clr-installer/log"
 )
 
 // A BlockDevice describes a block device and its partitions
@@ -26,18 +26,48 @@ type BlockDevice struct {
 	Name            string           // device name
 	Model           string           // device model
 	MajorMinor      string           // major:minor device number
+	Serial          string           // disk serial number
+	WWN             string           // disk world wide name
+	DevicePath      string           // stable /dev/disk/by-id or by-path link selecting the disk
+	Selector        *DiskSelector    // rule selecting the disk, see ResolveTargetMedias()
+	Rotational      bool             // rotational device i.e not a ssd
+	Transport       string           // how the disk is attached i.e nvme, sata, usb or mmc
+	LogSectorSize   uint64           // logical sector size in bytes
+	PhySectorSize   uint64           // physical sector size in bytes
 	FsType          string           // filesystem type
 	UUID            string           // filesystem uuid
 	MountPoint      string           // where the device is mounted
+	MountOptions    string           // fstab like comma separated mount options
+	Label           string           // filesystem label
 	Size            uint64           // size of the device
+	RelativeSize    string           // size relative to the disk i.e 50% or rest, see ResolveSizes()
 	Type            BlockDeviceType  // device type
 	State           BlockDeviceState // device state (running, live etc)
 	ReadOnly        bool             // read-only device
 	RemovableDevice bool             // removable device
+	Encrypted       bool             // should the partition be luks encrypted?
+	Passphrase      string           // luks passphrase, never written back to descriptors
+	KeyFile         string           // luks key file, used instead of a passphrase
+	VolumeGroup     string           // the lvm2 volume group this partition is a physical volume of
+	RaidArray       string           // the raid array this partition is a member of
+	RaidLevel       string           // raid level of a raid array device (0, 1, 5, 6 or 10)
+	RaidMetadata    string           // raid superblock metadata version of a raid array device
+	Subvolumes      []*Subvolume     // btrfs subvolumes created in this partition
+	Existing        bool             // partition already present in the disk, kept as is
+	Format          bool             // should an existing partition be formatted when used?
+	Image           string           // image file the disk is backed by, see AttachImage()
+	ImageFormat     string           // format the image is finalized to (raw or qcow2)
+	ImageOverwrite  bool             // replace the image file if it already exists
+	Wipe            string           // how the disk is wiped before partitioning, see WipeDisk()
+	MkfsOptions     string           // extra mkfs options, appended before the device file
 	Children        []*BlockDevice   // children devices/partitions
 	Parent          *BlockDevice     // Parent block device; nil for disk
 	userDefined     bool             // was this value set by user?
 	available       bool             // was it mounted the moment we loaded?
+	luksUUID        string           // the luks header uuid, set once formatted
+	subvolume       *Subvolume       // the btrfs subvolume this mount target refers to
+	loadedChildren  []*BlockDevice   // partitions found in the disk when it was listed
+	minSize         uint64           // smallest size an existing partition can be shrunk to
 }
 
 // Version used for reading and writing YAML
@@ -45,14 +75,35 @@ type blockDeviceYAMLMarshal struct {
 	Name            string         `yaml:"name,omitempty"`
 	Model           string         `yaml:"model,omitempty"`
 	MajorMinor      string         `yaml:"majMin,omitempty"`
+	Serial          string         `yaml:"serial,omitempty"`
+	WWN             string         `yaml:"wwn,omitempty"`
+	DevicePath      string         `yaml:"devicePath,omitempty"`
+	Selector        *DiskSelector  `yaml:"select,omitempty"`
 	FsType          string         `yaml:"fstype,omitempty"`
 	UUID            string         `yaml:"uuid,omitempty"`
 	MountPoint      string         `yaml:"mountpoint,omitempty"`
+	MountOptions    string         `yaml:"mountOptions,omitempty"`
+	Label           string         `yaml:"label,omitempty"`
 	Size            string         `yaml:"size,omitempty"`
 	ReadOnly        string         `yaml:"ro,omitempty"`
 	RemovableDevice string         `yaml:"rm,omitempty"`
 	Type            string         `yaml:"type,omitempty"`
 	State           string         `yaml:"state,omitempty"`
+	Encrypted       string         `yaml:"encrypted,omitempty"`
+	Passphrase      string         `yaml:"passphrase,omitempty"`
+	KeyFile         string         `yaml:"keyfile,omitempty"`
+	VolumeGroup     string         `yaml:"volumeGroup,omitempty"`
+	RaidArray       string         `yaml:"raidArray,omitempty"`
+	RaidLevel       string         `yaml:"level,omitempty"`
+	RaidMetadata    string         `yaml:"metadata,omitempty"`
+	Subvolumes      []*Subvolume   `yaml:"subvolumes,omitempty"`
+	Existing        string         `yaml:"existing,omitempty"`
+	Format          string         `yaml:"format,omitempty"`
+	Image           string         `yaml:"image,omitempty"`
+	ImageFormat     string         `yaml:"imageFormat,omitempty"`
+	ImageOverwrite  string         `yaml:"imageOverwrite,omitempty"`
+	Wipe            string         `yaml:"wipe,omitempty"`
+	MkfsOptions     string         `yaml:"mkfsOptions,omitempty"`
 	Children        []*BlockDevice `yaml:"children,omitempty"`
 }
 
@@ -81,6 +132,9 @@ const (
 	// BlockDeviceTypeLoop identifies a BlockDevice as a loop device (created with losetup)
 	BlockDeviceTypeLoop
 
+	// BlockDeviceTypeRaid identifies a BlockDevice as a software raid array (created with mdadm)
+	BlockDeviceTypeRaid
+
 	// BlockDeviceTypeUnknown identifies a BlockDevice as unknown
 	BlockDeviceTypeUnknown
 
@@ -99,6 +153,7 @@ const (
 
 var (
 	avBlockDevices      []*BlockDevice
+	avBlockDevicesMutex sync.Mutex
 	lsblkBinary         = "lsblk"
 	storageExp          = regexp.MustCompile(`^([0-9]*(\.)?[0-9]*)([bkmgtp]{1}){0,1}$`)
 	mountExp            = regexp.MustCompile(`^(/|(/[[:word:]-+_]+)+)$`)
@@ -111,6 +166,7 @@ var (
 		BlockDeviceTypeDisk:       "disk",
 		BlockDeviceTypePart:       "part",
 		BlockDeviceTypeLoop:       "loop",
+		BlockDeviceTypeRaid:       "raid",
 		BlockDeviceTypeRom:        "rom",
 		BlockDeviceTypeLVM2Group:  "LVM2_member",
 		BlockDeviceTypeLVM2Volume: "lvm",
@@ -120,6 +176,14 @@ var (
 
 // GetDeviceFile formats the block device's file path
 func (bd BlockDevice) GetDeviceFile() string {
+	if bd.Type == BlockDeviceTypeLVM2Volume && bd.Parent != nil {
+		return filepath.Join("/dev/", bd.Parent.Name, bd.Name)
+	}
+
+	if bd.Type == BlockDeviceTypeRaid {
+		return filepath.Join("/dev/md/", bd.Name)
+	}
+
 	return filepath.Join("/dev/", bd.Name)
 }
 
@@ -134,6 +198,11 @@ func parseBlockDeviceType(bdt string) (BlockDeviceType, error) {
 		}
 	}
 
+	// lsblk reports raid arrays with their levels i.e raid0, raid1, raid10
+	if strings.HasPrefix(bdt, "raid") {
+		return BlockDeviceTypeRaid, nil
+	}
+
 	return BlockDeviceTypeUnknown, errors.Errorf("Unknown block device type: %s", bdt)
 }
 
@@ -157,17 +226,47 @@ func (bd *BlockDevice) Clone() *BlockDevice {
 		Name:            bd.Name,
 		Model:           bd.Model,
 		MajorMinor:      bd.MajorMinor,
+		Serial:          bd.Serial,
+		WWN:             bd.WWN,
+		DevicePath:      bd.DevicePath,
+		Selector:        bd.Selector,
+		Rotational:      bd.Rotational,
+		Transport:       bd.Transport,
+		LogSectorSize:   bd.LogSectorSize,
+		PhySectorSize:   bd.PhySectorSize,
 		FsType:          bd.FsType,
 		UUID:            bd.UUID,
 		MountPoint:      bd.MountPoint,
+		MountOptions:    bd.MountOptions,
+		Label:           bd.Label,
 		Size:            bd.Size,
+		RelativeSize:    bd.RelativeSize,
 		Type:            bd.Type,
 		State:           bd.State,
 		ReadOnly:        bd.ReadOnly,
 		RemovableDevice: bd.RemovableDevice,
+		Encrypted:       bd.Encrypted,
+		Passphrase:      bd.Passphrase,
+		KeyFile:         bd.KeyFile,
+		VolumeGroup:     bd.VolumeGroup,
+		RaidArray:       bd.RaidArray,
+		RaidLevel:       bd.RaidLevel,
+		RaidMetadata:    bd.RaidMetadata,
+		Subvolumes:      bd.Subvolumes,
+		Existing:        bd.Existing,
+		Format:          bd.Format,
+		Image:           bd.Image,
+		ImageFormat:     bd.ImageFormat,
+		ImageOverwrite:  bd.ImageOverwrite,
+		Wipe:            bd.Wipe,
+		MkfsOptions:     bd.MkfsOptions,
 		Parent:          bd.Parent,
 		userDefined:     bd.userDefined,
 		available:       bd.available,
+		luksUUID:        bd.luksUUID,
+		subvolume:       bd.subvolume,
+		loadedChildren:  bd.loadedChildren,
+		minSize:         bd.minSize,
 	}
 
 	clone.Children = []*BlockDevice{}
@@ -193,27 +292,39 @@ func (bd *BlockDevice) IsAvailable() bool {
 	return bd.available
 }
 
-// Validate checks if the minimal requirements for a installation is met
+// Validate checks if the minimal requirements for a installation is met, removable
+// disks are rejected
 func (bd *BlockDevice) Validate() error {
-	bootPartition := false
-	rootPartition := false
-
-	for _, ch := range bd.Children {
-		if ch.FsType == "vfat" && ch.MountPoint == "/boot" {
-			bootPartition = true
-		}
+	return bd.ValidatePartitions(true, false)
+}
 
-		if ch.MountPoint == "/" {
-			rootPartition = true
-		}
-	}
+// ValidatePartitions checks if the minimal requirements for a installation is met,
+// requireRoot must be false when the root file system is provided elsewhere i.e
+// by a lvm2 logical volume and removable disks are only accepted if allowRemovable.
+// All the problems found are returned as a ValidationError
+func (bd *BlockDevice) ValidatePartitions(requireRoot bool, allowRemovable bool) error {
+	return validateLayout([]*BlockDevice{bd}, nil, nil, requireRoot, allowRemovable, false).err()
+}
 
-	if !bootPartition {
-		return errors.Errorf("Could not find a suitable EFI partition")
-	}
+// HasMountPoint returns true if any of the bds, or their children, is mounted
+// at mountPoint, btrfs subvolumes are also considered
+func HasMountPoint(bds []*BlockDevice, mountPoint string) bool {
+	return FindMountPoint(bds, mountPoint) != nil
+}
 
-	if !rootPartition {
-		return errors.Errorf("Could not find a root partition")
+// FindMountPoint returns the mount target of bds, or their children, mounted at
+// mountPoint, nil if none is
+func FindMountPoint(bds []*BlockDevice, mountPoint string) *BlockDevice {
+	for _, bd := range bds {
+		devices := append([]*BlockDevice{bd}, bd.Children...)
+
+		for _, curr := range devices {
+			for _, target := range curr.MountTargets() {
+				if target.MountPoint == mountPoint {
+					return target
+				}
+			}
+		}
 	}
 
 	return nil
@@ -244,15 +355,55 @@ func (bd *BlockDevice) AddChild(child *BlockDevice) {
 	child.Parent = bd
 	bd.Children = append(bd.Children, child)
 
+	if child.Name == "" {
+		child.Name = bd.partitionName(bd.nextPartitionNumber())
+	}
+}
+
+// partitionName returns the name of the partition numbered num in the disk bd, as
+// the kernel names it: disks whose names end in a digit i.e nvme0n1, mmcblk0, loop0
+// or md0 separate the partition number with a "p"
+func (bd *BlockDevice) partitionName(num int) string {
 	partPrefix := ""
 
-	if bd.Type == BlockDeviceTypeLoop || strings.Contains(bd.Name, "nvme") {
+	if n := len(bd.Name); n > 0 && bd.Name[n-1] >= '0' && bd.Name[n-1] <= '9' {
 		partPrefix = "p"
 	}
 
-	if child.Name == "" {
-		child.Name = fmt.Sprintf("%s%s%d", bd.Name, partPrefix, len(bd.Children))
+	return fmt.Sprintf("%s%s%d", bd.Name, partPrefix, num)
+}
+
+// partitionNumber returns the partition number of bd based on its name, i.e 3 for
+// sda3 or nvme0n1p3, returns 0 if the name has no partition number
+func (bd *BlockDevice) partitionNumber() int {
+	idx := len(bd.Name)
+	for idx > 0 && bd.Name[idx-1] >= '0' && bd.Name[idx-1] <= '9' {
+		idx--
+	}
+
+	num, err := strconv.Atoi(bd.Name[idx:])
+	if err != nil {
+		return 0
+	}
+
+	return num
+}
+
+// nextPartitionNumber returns the lowest partition number not used by any of
+// bd's partitions, the same number a new partition is given in the partition table
+func (bd *BlockDevice) nextPartitionNumber() int {
+	used := map[int]bool{}
+
+	for _, curr := range bd.Children {
+		used[curr.partitionNumber()] = true
 	}
+
+	num := 1
+	for used[num] {
+		num++
+	}
+
+	return num
 }
 
 // HumanReadableSizeWithUnitAndPrecision converts the size representation in bytes to the
@@ -367,7 +518,8 @@ func (bd *BlockDevice) HumanReadableSize() (string, error) {
 	return bd.HumanReadableSizeWithUnitAndPrecision("", -1)
 }
 
-func listBlockDevices(userDefined []*BlockDevice) ([]*BlockDevice, error) {
+// listLsblkBlockDevices lists the block devices with lsblk, used when sysfs is not available
+func listLsblkBlockDevices() ([]*BlockDevice, error) {
 	w := bytes.NewBuffer(nil)
 	// Exclude memory(1), floppy(2), and SCSI CDROM(11) devices
 	err := cmd.Run(w, lsblkBinary, "--exclude", "1,2,11", "-J", "-b", "-O")
@@ -375,16 +527,18 @@ func listBlockDevices(userDefined []*BlockDevice) ([]*BlockDevice, error) {
 		return nil, fmt.Errorf("%s", w.String())
 	}
 
-	bds, err := parseBlockDevicesDescriptor(w.Bytes())
+	return parseBlockDevicesDescriptor(w.Bytes())
+}
+
+// listBlockDevices lists the disks and their partitions, listing has no side effects
+// on the devices: the partition tables are not probed
+func listBlockDevices(userDefined []*BlockDevice) ([]*BlockDevice, error) {
+	bds, err := listSysfsBlockDevices()
 	if err != nil {
-		return nil, err
-	}
+		log.Debug("Could not list the block devices from sysfs, using lsblk: %s", err)
 
-	if err = utils.VerifyRootUser(); err == nil {
-		for _, bd := range bds {
-			if err = bd.partProbe(); err != nil {
-				return nil, err
-			}
+		if bds, err = listLsblkBlockDevices(); err != nil {
+			return nil, err
 		}
 	}
 
@@ -401,6 +555,7 @@ func listBlockDevices(userDefined []*BlockDevice) ([]*BlockDevice, error) {
 				continue
 			}
 
+			udef.loadedChildren = loaded.loadedChildren
 			merged = append(merged, udef)
 			added = true
 			break
@@ -418,6 +573,9 @@ func listBlockDevices(userDefined []*BlockDevice) ([]*BlockDevice, error) {
 // where available means block devices not mounted or not in use by the host system
 // userDefined will be inserted in the resulting list rather the loaded ones
 func ListAvailableBlockDevices(userDefined []*BlockDevice) ([]*BlockDevice, error) {
+	avBlockDevicesMutex.Lock()
+	defer avBlockDevicesMutex.Unlock()
+
 	if avBlockDevices != nil {
 		return avBlockDevices, nil
 	}
@@ -440,18 +598,37 @@ func ListAvailableBlockDevices(userDefined []*BlockDevice) ([]*BlockDevice, erro
 	return result, nil
 }
 
+// InvalidateBlockDevices discards the list of available block devices, the next call
+// to ListAvailableBlockDevices() lists the block devices again
+func InvalidateBlockDevices() {
+	avBlockDevicesMutex.Lock()
+	defer avBlockDevicesMutex.Unlock()
+
+	avBlockDevices = nil
+}
+
 // ListBlockDevices Lists all block devices
 // userDefined will be inserted in the resulting list reather the loaded ones
 func ListBlockDevices(userDefined []*BlockDevice) ([]*BlockDevice, error) {
 	return listBlockDevices(userDefined)
 }
 
-// Equals compares two BlockDevice instances
+// Equals compares two BlockDevice instances, the serial number and the world wide
+// name are preferred when both devices have them since they survive enumeration
+// order changes
 func (bd *BlockDevice) Equals(cmp *BlockDevice) bool {
 	if cmp == nil {
 		return false
 	}
 
+	if bd.Serial != "" && cmp.Serial != "" {
+		return bd.Serial == cmp.Serial
+	}
+
+	if bd.WWN != "" && cmp.WWN != "" {
+		return strings.EqualFold(bd.WWN, cmp.WWN)
+	}
+
 	return bd.Name == cmp.Name && bd.Model == cmp.Model && bd.MajorMinor == cmp.MajorMinor
 }
 
@@ -465,19 +642,33 @@ func parseBlockDevicesDescriptor(data []byte) ([]*BlockDevice, error) {
 		return nil, errors.Wrap(err)
 	}
 
-	for _, bd := range root.BlockDevices {
-		bd.available = true
+	setLoadedBlockDevices(root.BlockDevices)
+
+	return root.BlockDevices, nil
+}
+
+// setLoadedBlockDevices flags the partitions of the listed disks bds as existing ones
+// and records them as found, disks in use by the host are not available
+func setLoadedBlockDevices(bds []*BlockDevice) {
+	for _, bd := range bds {
+		// a disk may also be used as a whole i.e a file system without partition table
+		bd.available = bd.MountPoint == ""
 
 		for _, ch := range bd.Children {
 			ch.Parent = bd
+			ch.Existing = true
+			ch.Format = true
+
 			if ch.MountPoint != "" {
 				bd.available = false
-				break
 			}
 		}
-	}
 
-	return root.BlockDevices, nil
+		bd.loadedChildren = []*BlockDevice{}
+		for _, ch := range bd.Children {
+			bd.loadedChildren = append(bd.loadedChildren, ch.Clone())
+		}
+	}
 }
 
 func getNextStrToken(dec *json.Decoder, name string) (string, error) {
@@ -537,13 +728,18 @@ func IsValidMount(str string) string {
 
 // IsValidSize returns an empty string if
 // -- size is suffixed with B, K, M, G, T, P
+// -- or size is relative to the disk i.e 50% or rest, see IsRelativeSize()
 // -- size is greater than MinimumPartitionSize
 // -- size is less than (or equal to) current size + free space
 func (bd *BlockDevice) IsValidSize(str string) string {
 	str = strings.ToLower(str)
 
+	if IsRelativeSize(str) {
+		return bd.isValidRelativeSize(str)
+	}
+
 	if !storageExp.MatchString(str) {
-		return "Invalid size, may only be suffixed by: B, K, M, G, T or P"
+		return "Invalid size, may only be suffixed by: B, K, M, G, T or P, or be relative i.e 50% or rest"
 	}
 
 	size, err := ParseVolumeSize(str)
@@ -560,16 +756,55 @@ func (bd *BlockDevice) IsValidSize(str string) string {
 		return "Size too large"
 	}
 
+	if bd.Existing {
+		if loaded := bd.loadedSize(); loaded > 0 && size > loaded {
+			return "Existing partitions can only be shrunk"
+		} else if size < bd.minSize {
+			return "Size smaller than the used space"
+		}
+	}
+
+	return ""
+}
+
+// isValidRelativeSize returns an empty string if str is a well formed relative size
+// which, estimated against the parent disk, fits in the free space
+func (bd *BlockDevice) isValidRelativeSize(str string) string {
+	if bd.Existing {
+		return "Existing partitions require an absolute size"
+	}
+
+	rs, err := parseRelativeSize(str)
+	if err != nil {
+		return "Invalid relative size"
+	}
+
+	if rs.percent == 0 || bd.Parent == nil {
+		return ""
+	}
+
+	size := rs.clamp(uint64(float64(bd.Parent.Size) * rs.percent / 100))
+	if size < MinimumPartitionSize {
+		return "Size too small"
+	} else if size > bd.MaxParitionSize() {
+		return "Size too large"
+	}
+
 	return ""
 }
 
 // ParseVolumeSize will parse a string formatted (1M, 10G, 2T) size and return its representation
-// in bytes
+// in bytes, relative sizes (50%, rest) can't be represented without a disk and are refused,
+// see BlockDevice.SetSize()
 func ParseVolumeSize(str string) (uint64, error) {
 	var size uint64
 
 	str = strings.ToLower(str)
 
+	if IsRelativeSize(str) {
+		return 0, errors.Errorf("Relative size must be resolved against a disk: %s", str)
+	}
+
 	if !storageExp.MatchString(str) {
 		return strconv.ParseUint(str, 0, 64)
 	}
@@ -645,6 +880,24 @@ func (bd *BlockDevice) UnmarshalJSON(b []byte) error {
 			}
 
 			bd.MajorMinor = majMin
+		case "serial":
+			var serial string
+
+			serial, err = getNextStrToken(dec, "serial")
+			if err != nil {
+				return err
+			}
+
+			bd.Serial = strings.TrimSpace(serial)
+		case "wwn":
+			var wwn string
+
+			wwn, err = getNextStrToken(dec, "wwn")
+			if err != nil {
+				return err
+			}
+
+			bd.WWN = wwn
 		case "size":
 			var size string
 
@@ -675,6 +928,15 @@ func (bd *BlockDevice) UnmarshalJSON(b []byte) error {
 			}
 
 			bd.UUID = uuid
+		case "label":
+			var label string
+
+			label, err = getNextStrToken(dec, "label")
+			if err != nil {
+				return err
+			}
+
+			bd.Label = label
 		case "type":
 			var tp string
 
@@ -718,6 +980,20 @@ func (bd *BlockDevice) UnmarshalJSON(b []byte) error {
 			if err != nil {
 				return err
 			}
+		case "tran":
+			var tran string
+
+			tran, err = getNextStrToken(dec, "tran")
+			if err != nil {
+				return err
+			}
+
+			bd.Transport = tran
+		case "rota":
+			bd.Rotational, err = getNextBoolToken(dec, "rota")
+			if err != nil {
+				return err
+			}
 		case "children":
 			bd.Children = []*BlockDevice{}
 			err := dec.Decode(&bd.Children)
@@ -738,14 +1014,44 @@ func (bd *BlockDevice) MarshalYAML() (interface{}, error) {
 	bdm.Name = bd.Name
 	bdm.Model = bd.Model
 	bdm.MajorMinor = bd.MajorMinor
+	bdm.Serial = bd.Serial
+	bdm.WWN = bd.WWN
+	bdm.DevicePath = bd.DevicePath
+	bdm.Selector = bd.Selector
 	bdm.FsType = bd.FsType
 	bdm.UUID = bd.UUID
 	bdm.MountPoint = bd.MountPoint
+	bdm.MountOptions = bd.MountOptions
+	bdm.Label = bd.Label
 	bdm.Size = strconv.FormatUint(bd.Size, 10)
+	if bd.RelativeSize != "" {
+		bdm.Size = bd.RelativeSize
+	}
 	bdm.ReadOnly = strconv.FormatBool(bd.ReadOnly)
 	bdm.RemovableDevice = strconv.FormatBool(bd.RemovableDevice)
 	bdm.Type = bd.Type.String()
 	bdm.State = bd.State.String()
+	bdm.Encrypted = strconv.FormatBool(bd.Encrypted)
+	bdm.KeyFile = bd.KeyFile
+	bdm.VolumeGroup = bd.VolumeGroup
+	bdm.RaidArray = bd.RaidArray
+	bdm.RaidLevel = bd.RaidLevel
+	bdm.RaidMetadata = bd.RaidMetadata
+	bdm.Subvolumes = bd.Subvolumes
+	bdm.Image = bd.Image
+	bdm.ImageFormat = bd.ImageFormat
+	bdm.Wipe = bd.Wipe
+	bdm.MkfsOptions = bd.MkfsOptions
+
+	if bd.Existing {
+		bdm.Existing = strconv.FormatBool(bd.Existing)
+		bdm.Format = strconv.FormatBool(bd.Format)
+	}
+
+	if bd.ImageOverwrite {
+		bdm.ImageOverwrite = strconv.FormatBool(bd.ImageOverwrite)
+	}
+
 	bdm.Children = bd.Children
 
 	return bdm, nil
@@ -764,12 +1070,34 @@ func (bd *BlockDevice) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	bd.Name = unmarshBlockDevice.Name
 	bd.Model = unmarshBlockDevice.Model
 	bd.MajorMinor = unmarshBlockDevice.MajorMinor
+	bd.Serial = unmarshBlockDevice.Serial
+	bd.WWN = unmarshBlockDevice.WWN
+	bd.DevicePath = unmarshBlockDevice.DevicePath
+	bd.Selector = unmarshBlockDevice.Selector
 	bd.FsType = unmarshBlockDevice.FsType
 	bd.UUID = unmarshBlockDevice.UUID
 	bd.MountPoint = unmarshBlockDevice.MountPoint
+	bd.MountOptions = unmarshBlockDevice.MountOptions
+	bd.Label = unmarshBlockDevice.Label
+	bd.Passphrase = unmarshBlockDevice.Passphrase
+	bd.KeyFile = unmarshBlockDevice.KeyFile
+	bd.VolumeGroup = unmarshBlockDevice.VolumeGroup
+	bd.RaidArray = unmarshBlockDevice.RaidArray
+	bd.RaidLevel = unmarshBlockDevice.RaidLevel
+	bd.RaidMetadata = unmarshBlockDevice.RaidMetadata
+	bd.Subvolumes = unmarshBlockDevice.Subvolumes
+	bd.Image = unmarshBlockDevice.Image
+	bd.ImageFormat = unmarshBlockDevice.ImageFormat
+	bd.Wipe = unmarshBlockDevice.Wipe
+	bd.MkfsOptions = unmarshBlockDevice.MkfsOptions
 	bd.Children = unmarshBlockDevice.Children
-	// Convert String to Uint64
-	if unmarshBlockDevice.Size != "" {
+	// Convert String to Uint64, relative sizes are resolved later
+	if IsRelativeSize(unmarshBlockDevice.Size) {
+		if _, err := parseRelativeSize(unmarshBlockDevice.Size); err != nil {
+			return errors.Errorf("Device: %s: %v", unmarshBlockDevice.Name, err)
+		}
+		bd.RelativeSize = unmarshBlockDevice.Size
+	} else if unmarshBlockDevice.Size != "" {
 		uSize, err := ParseVolumeSize(unmarshBlockDevice.Size)
 		if err != nil {
 			return err
@@ -815,64 +1143,50 @@ func (bd *BlockDevice) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		bd.RemovableDevice = bRemovableDevice
 	}
 
-	return nil
-}
-
-// SupportedFileSystems exposes the currently supported file system
-func SupportedFileSystems() []string {
-	res := []string{}
-
-	for key := range bdOps {
-		res = append(res, key)
+	// Map the Encrypted bool
+	if unmarshBlockDevice.Encrypted != "" {
+		bEncrypted, err := strconv.ParseBool(unmarshBlockDevice.Encrypted)
+		if err != nil {
+			return err
+		}
+		bd.Encrypted = bEncrypted
 	}
 
-	sort.Strings(res)
-	return res
-}
+	// Map the Existing bool
+	if unmarshBlockDevice.Existing != "" {
+		bExisting, err := strconv.ParseBool(unmarshBlockDevice.Existing)
+		if err != nil {
+			return err
+		}
+		bd.Existing = bExisting
+	}
 
-// LargestFileSystemName returns the lengh of the largest supported file system name
-func LargestFileSystemName() int {
-	res := 0
+	// Map the Format bool, existing partitions are formatted unless told otherwise
+	bd.Format = true
+	if unmarshBlockDevice.Format != "" {
+		bFormat, err := strconv.ParseBool(unmarshBlockDevice.Format)
+		if err != nil {
+			return err
+		}
+		bd.Format = bFormat
+	}
 
-	for key := range bdOps {
-		fsl := len(key)
-		if fsl > res {
-			res = fsl
+	// Map the ImageOverwrite bool
+	if unmarshBlockDevice.ImageOverwrite != "" {
+		bImageOverwrite, err := strconv.ParseBool(unmarshBlockDevice.ImageOverwrite)
+		if err != nil {
+			return err
 		}
+		bd.ImageOverwrite = bImageOverwrite
 	}
 
-	return res
+	return nil
 }
 
 // NewStandardPartitions will add to disk a new set of partitions representing a
-// default set of partitions required for an installation
-func NewStandardPartitions(disk *BlockDevice) {
-	bootSize := uint64(150 * (1 << 20))
-	swapSize := uint64(2 * (1 << 30))
-	rootSize := uint64(disk.Size - bootSize - swapSize)
-
-	disk.Children = nil
-
-	// TODO review this standard partition schema (maybe add a default configuration)
-	disk.AddChild(&BlockDevice{
-		Size:       bootSize,
-		Type:       BlockDeviceTypePart,
-		FsType:     "vfat",
-		MountPoint: "/boot",
-	})
-
-	disk.AddChild(&BlockDevice{
-		Size:   swapSize,
-		Type:   BlockDeviceTypePart,
-		FsType: "swap",
-	})
-
-	disk.AddChild(&BlockDevice{
-		Size:       rootSize,
-		Type:       BlockDeviceTypePart,
-		FsType:     "ext4",
-		MountPoint: "/",
-	})
+// default set of partitions required for an installation, see DefaultPartitionScheme
+func NewStandardPartitions(disk *BlockDevice) error {
+	return DefaultPartitionScheme.Apply(disk)
 }
 
 func (bd *BlockDevice) partProbe() error {
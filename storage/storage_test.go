@@ -6,12 +6,25 @@ package storage
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"text/template"
+	"time"
+
+	"github.com/clearlinux/clr-installer/plan"
+	"github.com/clearlinux/clr-installer/progress"
 )
 
 func TestSupportedFileSystem(t *testing.T) {
-	expected := []string{"btrfs", "ext2", "ext3", "ext4", "swap", "vfat", "xfs"}
+	expected := []string{"btrfs", "ext2", "ext3", "ext4", "f2fs", "ntfs", "swap", "vfat", "xfs"}
 	supported := SupportedFileSystems()
 	tot := 0
 
@@ -33,6 +46,7 @@ func TestSupportedFileSystem(t *testing.T) {
 }
 
 func TestFailListBlockDevices(t *testing.T) {
+	sysDiskDir = "/sys/blockX"
 	lsblkBinary = "lsblkX"
 
 	_, err := ListBlockDevices(nil)
@@ -40,6 +54,7 @@ func TestFailListBlockDevices(t *testing.T) {
 		t.Fatalf("Should have failed to list block devices")
 	}
 
+	sysDiskDir = "/sys/block"
 	lsblkBinary = "lsblk"
 }
 
@@ -352,3 +367,1816 @@ func TestNullRemovable(t *testing.T) {
 		t.Fatalf("Could not parser block device descriptor: %s", err)
 	}
 }
+
+func TestEncryptedValidate(t *testing.T) {
+	tests := []struct {
+		part  *BlockDevice
+		valid bool
+	}{
+		{&BlockDevice{FsType: "ext4", MountPoint: "/", Encrypted: true, Passphrase: "clear-linux"}, true},
+		{&BlockDevice{FsType: "ext4", MountPoint: "/", Encrypted: true, KeyFile: "/root/key"}, false},
+		{&BlockDevice{FsType: "ext4", MountPoint: "/", Encrypted: true, KeyFile: "/root/key",
+			Passphrase: "clear-linux"}, true},
+		{&BlockDevice{FsType: "ext4", MountPoint: "/home", Encrypted: true, KeyFile: "/root/key"}, true},
+		{&BlockDevice{FsType: "ext4", MountPoint: "/", Encrypted: true}, false},
+		{&BlockDevice{FsType: "ext4", MountPoint: "/", Encrypted: true, Passphrase: "clear"}, false},
+	}
+
+	for _, curr := range tests {
+		bd := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk}
+		bd.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot"})
+		if curr.part.MountPoint != "/" {
+			bd.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/"})
+		}
+		bd.AddChild(curr.part)
+
+		err := bd.Validate()
+		if curr.valid && err != nil {
+			t.Fatalf("Encrypted partition should be valid: %s", err)
+		} else if !curr.valid && err == nil {
+			t.Fatal("Encrypted partition with no usable key should be invalid")
+		}
+	}
+
+	bd := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk}
+	bd.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot", Encrypted: true, Passphrase: "clear-linux"})
+	bd.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/"})
+
+	if err := bd.Validate(); err == nil {
+		t.Fatal("Encrypted EFI partition should be invalid")
+	}
+}
+
+func TestEncryptionKernelCmdline(t *testing.T) {
+	bd := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk}
+	bd.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot"})
+	bd.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/"})
+
+	if cmdline := EncryptionKernelCmdline([]*BlockDevice{bd}, nil, nil); cmdline != "" {
+		t.Fatalf("No encrypted partitions, expected an empty cmdline, had: %s", cmdline)
+	}
+
+	bd.Children[1].Encrypted = true
+	bd.Children[1].luksUUID = "1234"
+
+	expected := "rd.luks.name=1234=luks-sda2 root=/dev/mapper/luks-sda2"
+	if cmdline := EncryptionKernelCmdline([]*BlockDevice{bd}, nil, nil); cmdline != expected {
+		t.Fatalf("Expected cmdline: %s - had: %s", expected, cmdline)
+	}
+
+	// the root logical volume lives on encrypted physical volumes, the ones of other
+	// groups are unlocked later
+	bd = &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk}
+	bd.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot"})
+	bd.AddChild(&BlockDevice{VolumeGroup: "vg0", Encrypted: true, luksUUID: "1234"})
+	bd.AddChild(&BlockDevice{VolumeGroup: "vg1", Encrypted: true, luksUUID: "5678"})
+	groups := []*BlockDevice{
+		{Name: "vg0", Children: []*BlockDevice{{Name: "root", MountPoint: "/"}}},
+		{Name: "vg1", Children: []*BlockDevice{{Name: "home", MountPoint: "/home"}}},
+	}
+
+	expected = "rd.luks.name=1234=luks-sda2"
+	if cmdline := EncryptionKernelCmdline([]*BlockDevice{bd}, groups, nil); cmdline != expected {
+		t.Fatalf("Expected cmdline: %s - had: %s", expected, cmdline)
+	}
+
+	// the root raid array is assembled from encrypted members
+	medias := []*BlockDevice{}
+	for _, name := range []string{"sda", "sdb"} {
+		bd = &BlockDevice{Name: name, Type: BlockDeviceTypeDisk}
+		bd.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot"})
+		bd.AddChild(&BlockDevice{RaidArray: "md0", Encrypted: true, luksUUID: name})
+		medias = append(medias, bd)
+	}
+	arrays := []*BlockDevice{{Name: "md0", FsType: "ext4", MountPoint: "/"}}
+
+	expected = "rd.luks.name=sda=luks-sda2 rd.luks.name=sdb=luks-sdb2"
+	if cmdline := EncryptionKernelCmdline(medias, nil, arrays); cmdline != expected {
+		t.Fatalf("Expected cmdline: %s - had: %s", expected, cmdline)
+	}
+}
+
+func TestWriteCrypttabPlan(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "crypttab-")
+	if err != nil {
+		t.Fatalf("Should have created a temporary directory: %v", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(rootDir)
+	}()
+
+	bd := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk}
+	bd.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/home", Encrypted: true,
+		KeyFile: "/nonexistent/home.key", luksUUID: "1234"})
+
+	plan.Enable(true)
+	defer plan.Enable(false)
+
+	if err = WriteCrypttab(rootDir, []*BlockDevice{bd}); err != nil {
+		t.Fatalf("Should have planned the key file copy: %v", err)
+	}
+
+	keyPath := filepath.Join(rootDir, luksKeyDir, "luks-sda1.key")
+	if _, err = os.Stat(keyPath); err == nil {
+		t.Fatalf("The key file should not be copied in dry-run mode")
+	}
+
+	copied := false
+	for _, curr := range plan.Entries() {
+		if curr.Action == fmt.Sprintf("copy /nonexistent/home.key to %s", keyPath) {
+			copied = true
+		}
+	}
+
+	if !copied {
+		t.Fatalf("The key file copy should be recorded in the plan")
+	}
+}
+
+func TestIsValidPassphrase(t *testing.T) {
+	if IsValidPassphrase("short") == "" {
+		t.Fatal("Short passphrase should be invalid")
+	}
+
+	if IsValidPassphrase("clear-linux") != "" {
+		t.Fatal("Passphrase should be valid")
+	}
+}
+
+func TestValidateVolumeGroups(t *testing.T) {
+	newMedias := func() []*BlockDevice {
+		bd := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk}
+		bd.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot", Size: 150 << 20})
+		bd.AddChild(&BlockDevice{VolumeGroup: "vg0", Size: 10 << 30})
+		return []*BlockDevice{bd}
+	}
+
+	tests := []struct {
+		name   string
+		group  *BlockDevice
+		medias []*BlockDevice
+		valid  bool
+	}{
+		{"valid", &BlockDevice{Name: "vg0", Children: []*BlockDevice{
+			{Name: "root", FsType: "ext4", MountPoint: "/", Size: 8 << 30},
+			{Name: "home", FsType: "ext4", MountPoint: "/home"},
+		}}, newMedias(), true},
+		{"unknown group", &BlockDevice{Name: "vg1", Children: []*BlockDevice{
+			{Name: "root", FsType: "ext4", MountPoint: "/"},
+		}}, newMedias(), false},
+		{"too large", &BlockDevice{Name: "vg0", Children: []*BlockDevice{
+			{Name: "root", FsType: "ext4", MountPoint: "/", Size: 20 << 30},
+		}}, newMedias(), false},
+		{"two fills", &BlockDevice{Name: "vg0", Children: []*BlockDevice{
+			{Name: "root", FsType: "ext4", MountPoint: "/"},
+			{Name: "home", FsType: "ext4", MountPoint: "/home"},
+		}}, newMedias(), false},
+		{"duplicated volume", &BlockDevice{Name: "vg0", Children: []*BlockDevice{
+			{Name: "root", FsType: "ext4", MountPoint: "/", Size: 1 << 30},
+			{Name: "root", FsType: "ext4", MountPoint: "/home", Size: 1 << 30},
+		}}, newMedias(), false},
+		{"vfat volume", &BlockDevice{Name: "vg0", Children: []*BlockDevice{
+			{Name: "root", FsType: "vfat", MountPoint: "/"},
+		}}, newMedias(), false},
+		{"smaller than an extent", &BlockDevice{Name: "vg0", Children: []*BlockDevice{
+			{Name: "root", FsType: "ext4", MountPoint: "/", Size: 1 << 20},
+		}}, newMedias(), false},
+	}
+
+	for _, curr := range tests {
+		err := ValidateVolumeGroups(curr.medias, []*BlockDevice{curr.group})
+		if curr.valid && err != nil {
+			t.Fatalf("%s: should be valid, had: %s", curr.name, err)
+		} else if !curr.valid && err == nil {
+			t.Fatalf("%s: should be invalid", curr.name)
+		}
+	}
+}
+
+func TestMakeVolumeGroupPlan(t *testing.T) {
+	medias := []*BlockDevice{{Name: "sda", Type: BlockDeviceTypeDisk}}
+	medias[0].AddChild(&BlockDevice{VolumeGroup: "vg0", Size: 10 << 30})
+
+	vg := &BlockDevice{Name: "vg0", Children: []*BlockDevice{
+		{Name: "home", FsType: "ext4", MountPoint: "/home"},
+		{Name: "root", FsType: "ext4", MountPoint: "/", Size: (8 << 30) + 1},
+	}}
+
+	plan.Enable(true)
+	defer plan.Enable(false)
+
+	if err := vg.MakeVolumeGroup(medias); err != nil {
+		t.Fatalf("Should have planned the volume group: %v", err)
+	}
+
+	created := []string{}
+	for _, curr := range plan.Entries() {
+		if len(curr.Command) > 0 && curr.Command[0] == "lvcreate" {
+			created = append(created, strings.Join(curr.Command, " "))
+		}
+	}
+
+	expected := []string{
+		"lvcreate -y -n root -l 2048 vg0",
+		"lvcreate -y -n home -l 100%FREE vg0",
+	}
+
+	if !reflect.DeepEqual(created, expected) {
+		t.Fatalf("Expected logical volumes: %v - had: %v", expected, created)
+	}
+}
+
+func TestLogicalVolumeDeviceFile(t *testing.T) {
+	vg := &BlockDevice{Name: "vg0", Children: []*BlockDevice{{Name: "root", MountPoint: "/"}}}
+
+	expected := "rd.lvm.vg=vg0 root=/dev/vg0/root"
+	if cmdline := VolumeGroupKernelCmdline([]*BlockDevice{vg}); cmdline != expected {
+		t.Fatalf("Expected cmdline: %s - had: %s", expected, cmdline)
+	}
+
+	if vg.Type == BlockDeviceTypeLVM2Group || vg.Children[0].Parent != nil {
+		t.Fatalf("The cmdline should not modify the volume group")
+	}
+
+	vg.normalizeVolumeGroup()
+	if file := vg.Children[0].GetDeviceFile(); file != "/dev/vg0/root" {
+		t.Fatalf("Expected device file: /dev/vg0/root - had: %s", file)
+	}
+}
+
+func TestValidateRaidArrays(t *testing.T) {
+	newMedias := func(sizes ...uint64) []*BlockDevice {
+		medias := []*BlockDevice{}
+
+		for i, size := range sizes {
+			bd := &BlockDevice{Name: fmt.Sprintf("loop%d", i), Type: BlockDeviceTypeLoop}
+			bd.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot", Size: 150 << 20})
+			bd.AddChild(&BlockDevice{RaidArray: "md0", Size: size})
+			medias = append(medias, bd)
+		}
+
+		return medias
+	}
+
+	tests := []struct {
+		name   string
+		array  *BlockDevice
+		medias []*BlockDevice
+		valid  bool
+		size   uint64
+	}{
+		{"mirror", &BlockDevice{Name: "md0", RaidLevel: "1", FsType: "ext4", MountPoint: "/"},
+			newMedias(1<<30, 1<<30), true, 1 << 30},
+		{"stripe", &BlockDevice{Name: "md0", RaidLevel: "0", FsType: "ext4", MountPoint: "/"},
+			newMedias(1<<30, 1<<30), true, 2 << 30},
+		{"raid5", &BlockDevice{Name: "md0", RaidLevel: "5", FsType: "ext4", MountPoint: "/"},
+			newMedias(1<<30, 1<<30, 1<<30), true, 2 << 30},
+		{"few members", &BlockDevice{Name: "md0", RaidLevel: "5", FsType: "ext4", MountPoint: "/"},
+			newMedias(1<<30, 1<<30), false, 0},
+		{"size mismatch", &BlockDevice{Name: "md0", RaidLevel: "1", FsType: "ext4", MountPoint: "/"},
+			newMedias(1<<30, 2<<30), false, 0},
+		{"unknown level", &BlockDevice{Name: "md0", RaidLevel: "3", FsType: "ext4", MountPoint: "/"},
+			newMedias(1<<30, 1<<30, 1<<30), false, 0},
+		{"bad metadata", &BlockDevice{Name: "md0", RaidLevel: "1", RaidMetadata: "2.0",
+			FsType: "ext4", MountPoint: "/"}, newMedias(1<<30, 1<<30), false, 0},
+	}
+
+	for _, curr := range tests {
+		err := ValidateRaidArrays(curr.medias, []*BlockDevice{curr.array})
+		if curr.valid && err != nil {
+			t.Fatalf("%s: should be valid, had: %s", curr.name, err)
+		} else if !curr.valid && err == nil {
+			t.Fatalf("%s: should be invalid", curr.name)
+		}
+
+		if curr.array.Size != 0 || curr.array.Type == BlockDeviceTypeRaid {
+			t.Fatalf("%s: the validation should not modify the array", curr.name)
+		}
+
+		NormalizeRaidArrays(curr.medias, []*BlockDevice{curr.array})
+		if curr.valid && curr.array.Size != curr.size {
+			t.Fatalf("%s: expected array size: %d - had: %d", curr.name, curr.size, curr.array.Size)
+		}
+	}
+}
+
+func TestRaidKernelCmdline(t *testing.T) {
+	arr := &BlockDevice{Name: "md0", RaidLevel: "1", FsType: "ext4", MountPoint: "/"}
+
+	expected := "rd.md=1 root=/dev/md/md0"
+	if cmdline := RaidKernelCmdline([]*BlockDevice{arr}); cmdline != expected {
+		t.Fatalf("Expected cmdline: %s - had: %s", expected, cmdline)
+	}
+
+	if arr.Type == BlockDeviceTypeRaid {
+		t.Fatalf("The cmdline should not modify the array")
+	}
+}
+
+func TestValidateSubvolumes(t *testing.T) {
+	newDisk := func(fsType string, subvolumes ...*Subvolume) *BlockDevice {
+		bd := &BlockDevice{Name: "loop0", Type: BlockDeviceTypeLoop}
+		bd.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot", Size: 150 << 20})
+		bd.AddChild(&BlockDevice{FsType: fsType, Size: 1 << 30, Subvolumes: subvolumes})
+		return bd
+	}
+
+	tests := []struct {
+		name  string
+		bd    *BlockDevice
+		valid bool
+	}{
+		{"root subvolume", newDisk("btrfs", &Subvolume{Name: "@", MountPoint: "/"},
+			&Subvolume{Name: "@home", MountPoint: "/home", Options: "compress=zstd"}), true},
+		{"no root", newDisk("btrfs", &Subvolume{Name: "@home", MountPoint: "/home"}), false},
+		{"not btrfs", newDisk("ext4", &Subvolume{Name: "@", MountPoint: "/"}), false},
+		{"unnamed", newDisk("btrfs", &Subvolume{MountPoint: "/"}), false},
+		{"duplicated name", newDisk("btrfs", &Subvolume{Name: "@", MountPoint: "/"},
+			&Subvolume{Name: "@", MountPoint: "/home"}), false},
+		{"duplicated mount", newDisk("btrfs", &Subvolume{Name: "@", MountPoint: "/"},
+			&Subvolume{Name: "@home", MountPoint: "/"}), false},
+	}
+
+	for _, curr := range tests {
+		err := curr.bd.Validate()
+		if curr.valid && err != nil {
+			t.Fatalf("%s: should be valid, had: %s", curr.name, err)
+		} else if !curr.valid && err == nil {
+			t.Fatalf("%s: should be invalid", curr.name)
+		}
+	}
+}
+
+func TestSubvolumeMountTargets(t *testing.T) {
+	bd := &BlockDevice{Name: "sda2", FsType: "btrfs", Subvolumes: []*Subvolume{
+		{Name: "@", MountPoint: "/", Options: "compress=zstd"},
+		{Name: "@snapshots"},
+		{Name: "@var", MountPoint: "/var"},
+	}}
+
+	targets := bd.MountTargets()
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 mount targets, had: %d", len(targets))
+	}
+
+	if targets[0].MountPoint != "/" || targets[0].subvolume.mountData() != "subvol=@,compress=zstd" {
+		t.Fatalf("Unexpected root mount target: %s %s", targets[0].MountPoint,
+			targets[0].subvolume.mountData())
+	}
+
+	if bd.mainMountPoint() != "/" {
+		t.Fatalf("Expected main mount point /, had: %s", bd.mainMountPoint())
+	}
+
+	cmdline := SubvolumeKernelCmdline([]*BlockDevice{{Children: []*BlockDevice{bd}}})
+	if cmdline != "rootflags=subvol=@,compress=zstd" {
+		t.Fatalf("Unexpected kernel cmdline: %s", cmdline)
+	}
+}
+
+func TestTableLayout(t *testing.T) {
+	table, err := newGPTTable(defaultSectorSize, 10<<30)
+	if err != nil {
+		t.Fatalf("Should have created the partition table: %s", err)
+	}
+
+	// the home partition is listed first in the partition entries
+	table.partitions = []*gptPartition{
+		{number: 2, firstLBA: 309248, lastLBA: 4503551},
+		{number: 1, firstLBA: 2048, lastLBA: 309247},
+	}
+
+	layout := tableLayout(table)
+
+	if len(layout) != 4 {
+		t.Fatalf("Expected 4 entries, had: %d", len(layout))
+	}
+
+	if !layout[0].free || layout[1].free || layout[2].number != 2 || !layout[3].free {
+		t.Fatalf("Unexpected layout entries")
+	}
+
+	if layout[0].start != 17408 || layout[1].start != 1048576 || layout[2].end != 2305818623 ||
+		layout[3].end != 10737401343 {
+		t.Fatalf("Unexpected layout boundaries: %+v %+v", layout[0], layout[3])
+	}
+
+	root := &BlockDevice{Name: "sda3", Size: 4 << 30}
+	swap := &BlockDevice{Name: "sda4", Size: 2 << 30}
+	big := &BlockDevice{Name: "sda5", Size: 4 << 30}
+
+	starts, err := placePartitions(layout, []*BlockDevice{root, swap})
+	if err != nil {
+		t.Fatalf("Should have placed the partitions: %s", err)
+	}
+
+	if starts[root] != 2199 || starts[swap] != 2199+4096 {
+		t.Fatalf("Unexpected partition placement: %d %d", starts[root], starts[swap])
+	}
+
+	if _, err = placePartitions(layout, []*BlockDevice{root, swap, big}); err == nil {
+		t.Fatalf("Should have failed placing partitions exceeding the free space")
+	}
+
+	// removing the /home partition frees a single contiguous region
+	freed := freePartitions(layout, map[int]bool{1: true})
+	if len(freed) != 3 || !freed[2].free || freed[2].start != 158334976 {
+		t.Fatalf("Unexpected layout after removing partitions")
+	}
+
+	if _, err = placePartitions(freed, []*BlockDevice{root, big}); err != nil {
+		t.Fatalf("Should have placed the partitions in the freed space: %s", err)
+	}
+
+	shrunk := shrinkEntry(layout, 2, 1<<30)
+	if len(shrunk) != 4 || shrunk[2].end != 158334976+(1<<30)-1 || shrunk[3].start != 158334976+(1<<30) {
+		t.Fatalf("Unexpected layout after shrinking a partition")
+	}
+
+	if layout[2].end != 2305818623 {
+		t.Fatalf("Shrinking should not modify the original layout")
+	}
+
+	// the whole layout is planned before the disk is touched
+	disk := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk, Size: 10 << 30}
+	esp := &BlockDevice{Name: "sda1", FsType: "vfat", Size: 150 << 20, Existing: true}
+	disk.AddChild(esp)
+	disk.AddChild(&BlockDevice{Name: "sda3", FsType: "ext4", Size: 8 << 30})
+
+	lp, err := disk.planLayout(layout)
+	if err != nil {
+		t.Fatalf("Should have planned the layout: %s", err)
+	}
+
+	if len(lp.removed) != 1 || lp.removed[0] != 2 || len(lp.newParts) != 1 ||
+		lp.starts[lp.newParts[0]] != 151 {
+		t.Fatalf("Unexpected layout plan: %+v", lp)
+	}
+
+	// nothing is removed if the new partitions can't be placed
+	disk.Children[1].Size = 12 << 30
+	if _, err = disk.planLayout(layout); err == nil {
+		t.Fatalf("Should have failed planning partitions exceeding the disk")
+	}
+
+	// the shrunk partitions release their space before placing the new ones
+	disk = &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk, Size: 10 << 30}
+	home := &BlockDevice{Name: "sda2", FsType: "ext4", Size: 1 << 30, Existing: true,
+		minSize: 2 << 30}
+	disk.AddChild(esp)
+	disk.AddChild(home)
+	disk.AddChild(&BlockDevice{Name: "sda3", FsType: "ext4", Size: 8 << 30})
+
+	// the used space is checked before anything is changed in the disk
+	if _, err = disk.planLayout(layout); err == nil {
+		t.Fatalf("Should have failed shrinking a partition below its used space")
+	}
+
+	home.minSize = 512 << 20
+	lp, err = disk.planLayout(layout)
+	if err != nil {
+		t.Fatalf("Should have planned the layout: %s", err)
+	}
+
+	if len(lp.removed) != 0 || len(lp.shrunk) != 1 || lp.shrunk[0] != home ||
+		lp.starts[lp.newParts[0]] != (158334976+(1<<30))>>20 {
+		t.Fatalf("Unexpected layout plan: %+v", lp)
+	}
+}
+
+func TestExistingPartitions(t *testing.T) {
+	bd := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk, Size: 10 << 30}
+	esp := &BlockDevice{Name: "sda1", FsType: "vfat", Size: 150 << 20, Existing: true,
+		Format: true}
+	win := &BlockDevice{Name: "sda2", FsType: "ntfs", Size: 4 << 30, Existing: true,
+		Format: true}
+	home := &BlockDevice{Name: "sda3", FsType: "ext4", Size: 2 << 30, Existing: true,
+		Format: true}
+
+	for _, curr := range []*BlockDevice{esp, win, home} {
+		bd.AddChild(curr)
+		bd.loadedChildren = append(bd.loadedChildren, curr.Clone())
+	}
+
+	if !bd.KeepsPartitionTable() || len(bd.DestroyedPartitions()) != 0 {
+		t.Fatalf("All the existing partitions should be kept")
+	}
+
+	esp.MountPoint = "/boot"
+	esp.Format = false
+	home.MountPoint = "/home"
+	home.Format = false
+
+	if esp.ShouldFormat() || win.ShouldFormat() || home.ShouldFormat() {
+		t.Fatalf("Existing partitions should not be formatted")
+	}
+
+	bd.RemoveChild(home)
+	root := &BlockDevice{FsType: "ext4", MountPoint: "/", Size: 2 << 30}
+	bd.AddChild(root)
+
+	if root.Name != "sda3" || !root.ShouldFormat() {
+		t.Fatalf("Expected a new sda3 partition, had: %s", root.Name)
+	}
+
+	destroyed := bd.DestroyedPartitions()
+	if len(destroyed) != 1 || destroyed[0].Name != "sda3" {
+		t.Fatalf("Expected sda3 to be destroyed")
+	}
+
+	if err := bd.Validate(); err != nil {
+		t.Fatalf("Should be valid, had: %s", err)
+	}
+
+	esp.Encrypted = true
+	esp.Passphrase = "passphrase"
+	if err := bd.Validate(); err == nil {
+		t.Fatalf("Should be invalid, existing partitions can't be encrypted unformatted")
+	}
+}
+
+func TestParseMinimumSizes(t *testing.T) {
+	resizeOut := []byte("resize2fs 1.44.2 (14-May-2018)\nEstimated minimum size of the filesystem: 25600\n")
+	dumpOut := []byte("Filesystem magic number:  0xEF53\nBlock size:               4096\nFragment size:            4096\n")
+
+	size, err := parseExtMinSize(resizeOut, dumpOut)
+	if err != nil || size != 25600*4096 {
+		t.Fatalf("Unexpected ext minimum size: %d, %v", size, err)
+	}
+
+	if _, err = parseExtMinSize([]byte("garbage"), dumpOut); err == nil {
+		t.Fatalf("Should have failed parsing invalid resize2fs output")
+	}
+
+	ntfsOut := []byte("Checking filesystem consistency ...\nYou might resize at 5369094144 bytes or 5370 MB (freeing 4370 MB).\n")
+	if size, err = matchSize(ntfsMinSizeExp, ntfsOut); err != nil || size != 5369094144 {
+		t.Fatalf("Unexpected ntfs minimum size: %d, %v", size, err)
+	}
+
+	btrfsOut := []byte("1343225856 bytes (1.25GiB)\n")
+	if size, err = matchSize(btrfsMinSizeExp, btrfsOut); err != nil || size != 1343225856 {
+		t.Fatalf("Unexpected btrfs minimum size: %d, %v", size, err)
+	}
+}
+
+func TestValidateShrink(t *testing.T) {
+	bd := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk, Size: 20 << 30}
+	esp := &BlockDevice{Name: "sda1", FsType: "vfat", MountPoint: "/boot", Size: 150 << 20,
+		Existing: true}
+	win := &BlockDevice{Name: "sda2", FsType: "ntfs", Size: 10 << 30, Existing: true,
+		Format: true}
+
+	for _, curr := range []*BlockDevice{esp, win} {
+		bd.AddChild(curr)
+		bd.loadedChildren = append(bd.loadedChildren, curr.Clone())
+	}
+
+	bd.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/", Size: 8 << 30})
+
+	win.minSize = 6 << 30
+	win.Size = 4 << 30
+
+	if !win.IsShrunk() || !win.CanShrink() {
+		t.Fatalf("sda2 should be shrunk")
+	}
+
+	if err := bd.Validate(); err == nil {
+		t.Fatalf("Should be invalid, shrinking below the used space")
+	}
+
+	if msg := win.IsValidSize("4G"); msg == "" {
+		t.Fatalf("Should refuse sizes below the used space")
+	}
+
+	if msg := win.IsValidSize("12G"); msg == "" {
+		t.Fatalf("Should refuse growing an existing partition")
+	}
+
+	win.Size = 7 << 30
+	if err := bd.Validate(); err != nil {
+		t.Fatalf("Should be valid, had: %s", err)
+	}
+
+	esp.Size = 100 << 20
+	if err := bd.Validate(); err == nil {
+		t.Fatalf("Should be invalid, vfat partitions can't be shrunk")
+	}
+
+	// the probed partitions are not probed again
+	if err := ProbeShrunkPartitions([]*BlockDevice{bd}); err != nil {
+		t.Fatalf("Should not probe sda2 again, had: %s", err)
+	}
+
+	// the used space of a missing device can't be probed
+	win.minSize = 0
+	if err := ProbeShrunkPartitions([]*BlockDevice{bd}); err == nil {
+		t.Fatalf("Should have failed probing the used space of sda2")
+	}
+
+	// the disks are not probed in dry-run mode, the skipped probing is planned
+	plan.Enable(true)
+	defer plan.Enable(false)
+
+	if err := ProbeShrunkPartitions([]*BlockDevice{bd}); err != nil {
+		t.Fatalf("Should not probe in dry-run mode, had: %s", err)
+	}
+
+	if err := win.checkShrink(); err != nil {
+		t.Fatalf("Should have skipped probing sda2, had: %s", err)
+	}
+
+	entries := plan.Entries()
+	if len(entries) != 1 || !strings.Contains(entries[0].Action, "skip probing the used space of /dev/sda2") {
+		t.Fatalf("Expected the skipped probing of sda2 in the plan, got: %+v", entries)
+	}
+}
+
+func TestParseMountOptions(t *testing.T) {
+	tests := []struct {
+		options string
+		flags   uintptr
+		data    string
+	}{
+		{"", syscall.MS_RELATIME, ""},
+		{"defaults", syscall.MS_RELATIME, ""},
+		{"noatime,compress=zstd", syscall.MS_NOATIME, "compress=zstd"},
+		{"ro,nodev,nofail,x-systemd.automount", syscall.MS_RELATIME, ""},
+		{"nodiratime,nodev,sync", syscall.MS_NODIRATIME | syscall.MS_SYNCHRONOUS, ""},
+		{"noexec,nosuid,exec,suid,dev,async,lazytime", syscall.MS_RELATIME, ""},
+		{"data=journal,discard", syscall.MS_RELATIME, "data=journal,discard"},
+	}
+
+	for _, curr := range tests {
+		flags, data := parseMountOptions(curr.options)
+		if flags != curr.flags || data != curr.data {
+			t.Fatalf("%q: expected flags %d and data %q - had: %d and %q", curr.options,
+				curr.flags, curr.data, flags, data)
+		}
+	}
+}
+
+func TestFstabEntry(t *testing.T) {
+	root := &BlockDevice{Name: "sda2", FsType: "btrfs", MountOptions: "noatime",
+		Subvolumes: []*Subvolume{{Name: "@", MountPoint: "/", Options: "compress=zstd"}}}
+	home := &BlockDevice{Name: "sda3", FsType: "ext4", MountPoint: "/home"}
+	data := &BlockDevice{Name: "sda4", FsType: "xfs", MountPoint: "/data",
+		MountOptions: "nofail"}
+	swap := &BlockDevice{Name: "sda5", FsType: "swap"}
+
+	tests := []struct {
+		bd       *BlockDevice
+		expected string
+	}{
+		{root.MountTargets()[0], "UUID=x / btrfs subvol=@,compress=zstd,noatime 0 0"},
+		{&BlockDevice{Name: "sda6", FsType: "ext4", MountPoint: "/"}, "UUID=x / ext4 defaults 0 1"},
+		{home, "UUID=x /home ext4 defaults 0 2"},
+		{data, "UUID=x /data xfs nofail 0 0"},
+		{swap, "UUID=x none swap defaults 0 0"},
+	}
+
+	for _, curr := range tests {
+		if entry := curr.bd.fstabEntry("UUID=x"); entry != curr.expected {
+			t.Fatalf("Expected fstab entry %q, had: %q", curr.expected, entry)
+		}
+	}
+
+	lv := &BlockDevice{Name: "root", Type: BlockDeviceTypeLVM2Volume,
+		Parent: &BlockDevice{Name: "vg0"}}
+
+	if dev, err := lv.fstabDevice(); err != nil || dev != "/dev/vg0/root" {
+		t.Fatalf("Unexpected logical volume fstab device: %s", dev)
+	}
+}
+
+func TestValidateMountOptions(t *testing.T) {
+	tests := []struct {
+		bd    *BlockDevice
+		valid bool
+	}{
+		{&BlockDevice{FsType: "ext4", Label: "clear-root", MountOptions: "noatime"}, true},
+		{&BlockDevice{FsType: "vfat", Label: "EFI"}, true},
+		{&BlockDevice{FsType: "vfat", Label: "TOO-LONG-LABEL"}, false},
+		{&BlockDevice{FsType: "ext4", MountOptions: "noatime, nodev"}, false},
+	}
+
+	for _, curr := range tests {
+		err := curr.bd.validateMountOptions()
+		if curr.valid && err != nil {
+			t.Fatalf("%+v should be valid, had: %s", curr.bd, err)
+		} else if !curr.valid && err == nil {
+			t.Fatalf("%+v should be invalid", curr.bd)
+		}
+	}
+}
+
+func TestRelativeSizes(t *testing.T) {
+	newDisk := func(sizes ...string) *BlockDevice {
+		bd := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk}
+
+		for _, size := range sizes {
+			ch := &BlockDevice{FsType: "ext4"}
+			bd.AddChild(ch)
+
+			if err := ch.SetSize(size); err != nil {
+				t.Fatalf("Should have set size %s: %s", size, err)
+			}
+		}
+
+		return bd
+	}
+
+	total := uint64(100<<30) + reservedDiskSpace
+
+	tests := []struct {
+		name     string
+		bd       *BlockDevice
+		valid    bool
+		expected []uint64
+	}{
+		{"percentages", newDisk("150M", "25%", "rest"), true,
+			[]uint64{150 << 20, 25 << 30, (75 << 30) - (150 << 20)}},
+		{"fill", newDisk("50%", "fill"), true, []uint64{50 << 30, 50 << 30}},
+		{"bounded", newDisk("10%,max=4G", "rest,min=10G,max=20G"), true,
+			[]uint64{4 << 30, 20 << 30}},
+		{"minimum", newDisk("1%,min=2G", "rest"), true, []uint64{2 << 30, 98 << 30}},
+		{"too large", newDisk("60%", "60%"), false, nil},
+		{"two rests", newDisk("rest", "fill"), false, nil},
+		{"rest too small", newDisk("90%", "rest,min=20G"), false, nil},
+	}
+
+	for _, curr := range tests {
+		err := curr.bd.resolveSizes(total)
+		if curr.valid && err != nil {
+			t.Fatalf("%s: should be valid, had: %s", curr.name, err)
+		} else if !curr.valid && err == nil {
+			t.Fatalf("%s: should be invalid", curr.name)
+		}
+
+		for i, size := range curr.expected {
+			if curr.bd.Children[i].Size != size {
+				t.Fatalf("%s: expected partition %d size %d - had: %d", curr.name, i, size,
+					curr.bd.Children[i].Size)
+			}
+		}
+	}
+
+	invalid := []string{"0%", "101%", "abc%", "50%,min", "50%,avg=10G", "50%,min=10G,max=5G",
+		"rest,max=10%"}
+
+	for _, curr := range invalid {
+		if _, err := parseRelativeSize(curr); err == nil {
+			t.Fatalf("%s should be an invalid relative size", curr)
+		}
+	}
+
+	if _, err := ParseVolumeSize("50%"); err == nil {
+		t.Fatalf("ParseVolumeSize() should refuse relative sizes")
+	}
+
+	disk := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk, Size: 10 << 30}
+	part := &BlockDevice{FsType: "ext4", Size: 1 << 30}
+	disk.AddChild(part)
+
+	for _, curr := range []string{"50%", "REST", "fill,max=2G"} {
+		if msg := part.IsValidSize(curr); msg != "" {
+			t.Fatalf("%s should be a valid size, had: %s", curr, msg)
+		}
+	}
+
+	if msg := part.IsValidSize("150%"); msg == "" {
+		t.Fatalf("150%% should be an invalid size")
+	}
+}
+
+func TestSwapSizeForMemory(t *testing.T) {
+	tests := []struct {
+		mem  uint64
+		swap uint64
+	}{
+		{1 << 30, 2 << 30},
+		{2 << 30, 4 << 30},
+		{4 << 30, 4 << 30},
+		{16 << 30, 8 << 30},
+		{64 << 30, 16 << 30},
+	}
+
+	for _, curr := range tests {
+		if size := SwapSizeForMemory(curr.mem); size != curr.swap {
+			t.Fatalf("Expected %d bytes of swap for %d bytes of memory, got %d",
+				curr.swap, curr.mem, size)
+		}
+	}
+
+	mem, err := parseMemTotal("MemTotal:        8052148 kB\nMemFree:         1234 kB\n")
+	if err != nil {
+		t.Fatalf("Should have parsed the total memory: %v", err)
+	}
+
+	if mem != 8052148<<10 {
+		t.Fatalf("Wrong total memory: %d", mem)
+	}
+
+	if _, err = parseMemTotal("MemFree:         1234 kB\n"); err == nil {
+		t.Fatalf("Should fail parsing meminfo without MemTotal")
+	}
+}
+
+func TestPartitionSchemeApply(t *testing.T) {
+	scheme := &PartitionScheme{
+		Name: "server",
+		Partitions: []*SchemePartition{
+			{FsType: "vfat", MountPoint: "/boot", Size: "150M"},
+			{FsType: "ext4", MountPoint: "/", Size: "30%"},
+			{FsType: "ext4", MountPoint: "/home", Size: "rest"},
+		},
+	}
+
+	disk := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk, Size: 100 << 30}
+	disk.AddChild(&BlockDevice{Name: "sda1", Type: BlockDeviceTypePart, FsType: "ext4"})
+
+	if err := scheme.Apply(disk); err != nil {
+		t.Fatalf("Should have applied the scheme: %v", err)
+	}
+
+	if len(disk.Children) != 3 {
+		t.Fatalf("Expected 3 partitions, got %d", len(disk.Children))
+	}
+
+	if disk.Children[2].Name != "sda3" || disk.Children[2].MountPoint != "/home" {
+		t.Fatalf("Wrong partition: %s %s", disk.Children[2].Name, disk.Children[2].MountPoint)
+	}
+
+	var total uint64
+	for _, curr := range disk.Children {
+		total = total + curr.Size
+	}
+
+	if total > disk.Size || disk.Size-total > 2*MinimumPartitionSize+reservedDiskSpace {
+		t.Fatalf("Partitions should take the whole disk, got %d of %d bytes", total, disk.Size)
+	}
+
+	if err := disk.ValidatePartitions(true, false); err != nil {
+		t.Fatalf("Applied scheme should be valid: %v", err)
+	}
+
+	scheme.Partitions[1].Size = "invalid"
+	if err := scheme.Apply(disk); err == nil {
+		t.Fatalf("Should fail applying a scheme with invalid sizes")
+	}
+}
+
+func TestSwapConfig(t *testing.T) {
+	disk := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk, Size: 20 << 30}
+	if err := DefaultPartitionScheme.WithoutSwap().Apply(disk); err != nil {
+		t.Fatalf("Should have applied the scheme: %v", err)
+	}
+
+	bds := []*BlockDevice{disk}
+
+	tests := []struct {
+		sc    *SwapConfig
+		valid bool
+	}{
+		{&SwapConfig{Type: SwapTypePartition}, true},
+		{&SwapConfig{Type: SwapTypeFile}, true},
+		{&SwapConfig{Type: SwapTypeFile, Size: "4G"}, true},
+		{&SwapConfig{Type: SwapTypeZram, Size: RAMSwapSize}, true},
+		{&SwapConfig{Type: SwapTypeFile, Size: "4X"}, false},
+		{&SwapConfig{Type: "invalid"}, false},
+	}
+
+	for _, curr := range tests {
+		err := curr.sc.Validate(bds)
+		if curr.valid && err != nil {
+			t.Fatalf("%s swap should be valid: %v", curr.sc.Type, err)
+		} else if !curr.valid && err == nil {
+			t.Fatalf("%s swap (%s) should be invalid", curr.sc.Type, curr.sc.Size)
+		}
+	}
+
+	disk.Children[1].FsType = "vfat"
+	if err := (&SwapConfig{Type: SwapTypeFile}).Validate(bds); err == nil {
+		t.Fatalf("Swap files should not be supported in vfat")
+	}
+
+	disk.Children[1].FsType = "swap"
+	if err := (&SwapConfig{Type: SwapTypeZram}).Validate(bds); err == nil {
+		t.Fatalf("Swap partitions should conflict with zram")
+	}
+
+	conf, err := (&SwapConfig{Type: SwapTypeZram, Size: "1G"}).zramConf()
+	if err != nil {
+		t.Fatalf("Should have generated the zram configuration: %v", err)
+	}
+
+	if !strings.Contains(conf, "zram-size = 1024\n") {
+		t.Fatalf("Wrong zram configuration: %s", conf)
+	}
+}
+
+func TestGUID(t *testing.T) {
+	str := "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+
+	g, err := parseGUID(str)
+	if err != nil {
+		t.Fatalf("Should have parsed the GUID: %v", err)
+	}
+
+	// the first fields are stored in little endian
+	if g[0] != 0x28 || g[3] != 0xC1 || g[4] != 0x1F || g[8] != 0xBA {
+		t.Fatalf("Wrong on-disk GUID representation: %x", g[:])
+	}
+
+	if g.String() != str {
+		t.Fatalf("Expected %s, got %s", str, g.String())
+	}
+
+	if _, err = parseGUID("C12A7328-F81F-11D2"); err == nil {
+		t.Fatalf("Should fail parsing an invalid GUID")
+	}
+
+	r1, _ := randomGUID()
+	r2, _ := randomGUID()
+	if r1 == r2 || r1.String()[14] != '4' {
+		t.Fatalf("Invalid random GUIDs: %s %s", r1, r2)
+	}
+}
+
+func TestWritePartitionTableFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "gpt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	size := uint64(64 << 20)
+	if err = f.Truncate(int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	disk := &BlockDevice{Name: "loop7", Type: BlockDeviceTypeLoop, Size: size}
+	disk.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot", Size: 16 << 20})
+	disk.AddChild(&BlockDevice{FsType: "swap", Size: 8 << 20})
+	disk.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/", RelativeSize: "rest"})
+
+	if err = disk.resolveSizes(size); err != nil {
+		t.Fatalf("Should have resolved the sizes: %v", err)
+	}
+
+	if err = disk.writePartitionTableFile(f.Name(), defaultSectorSize, true); err != nil {
+		t.Fatalf("Should have written the partition table: %v", err)
+	}
+
+	f, err = os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	table, err := readGPT(f, defaultSectorSize, size)
+	if err != nil {
+		t.Fatalf("Should have read the partition table: %v", err)
+	}
+
+	if len(table.partitions) != 3 {
+		t.Fatalf("Expected 3 partitions, got %d", len(table.partitions))
+	}
+
+	expected := []struct {
+		first uint64
+		name  string
+		guid  string
+	}{
+		{2048, "EFI", "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"},
+		{2048 + 16<<11, "linux-swap", "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"},
+		{2048 + 24<<11, "/", "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"},
+	}
+
+	for idx, curr := range table.partitions {
+		if curr.firstLBA != expected[idx].first || curr.name != expected[idx].name ||
+			curr.typeGUID.String() != expected[idx].guid {
+			t.Fatalf("Unexpected partition %d: %d %s %s", idx+1, curr.firstLBA, curr.name,
+				curr.typeGUID)
+		}
+
+		if (curr.lastLBA+1)%2048 != 0 && curr.lastLBA != table.lastUsableLBA() {
+			t.Fatalf("Partition %d is not aligned: %d", idx+1, curr.lastLBA)
+		}
+	}
+
+	if table.partitions[2].lastLBA > table.lastUsableLBA() {
+		t.Fatalf("Partition exceeds the usable space")
+	}
+
+	if !table.legacyBoot {
+		t.Fatalf("The protective MBR should be marked as active")
+	}
+
+	for idx, curr := range table.partitions {
+		legacy := curr.attributes&gptAttrLegacyBIOSBootable != 0
+		if legacy != (idx == 0) {
+			t.Fatalf("Unexpected legacy boot attribute for partition %d", idx+1)
+		}
+	}
+
+	// the backup header must be in the last sector
+	backup := make([]byte, defaultSectorSize)
+	if _, err = f.ReadAt(backup, int64(size-defaultSectorSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(backup[0:8]) != gptSignature {
+		t.Fatalf("Backup header not found")
+	}
+
+	disk.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/home", Size: 4 << 20})
+	if _, err = disk.gptTable(defaultSectorSize, size, false); err == nil {
+		t.Fatalf("Should fail adding partitions exceeding the disk")
+	}
+}
+
+func TestUpdatePartitionTableFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "gpt-update-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	size := uint64(64 << 20)
+	if err = f.Truncate(int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	disk := &BlockDevice{Name: "loop7", Type: BlockDeviceTypeLoop, Size: size}
+	disk.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot", Size: 16 << 20})
+	disk.AddChild(&BlockDevice{FsType: "swap", Size: 8 << 20})
+	disk.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/", Size: 32 << 20})
+
+	if err = disk.writePartitionTableFile(f.Name(), defaultSectorSize, false); err != nil {
+		t.Fatalf("Should have written the partition table: %v", err)
+	}
+
+	table, err := readPartitionTableFile(f.Name(), defaultSectorSize)
+	if err != nil {
+		t.Fatalf("Should have read the partition table: %v", err)
+	}
+	diskGUID := table.diskGUID
+
+	// the swap partition is replaced by a new /home partition
+	home := &BlockDevice{FsType: "ext4", MountPoint: "/home", Size: 4 << 20}
+	disk = &BlockDevice{Name: "loop7", Type: BlockDeviceTypeLoop, Size: size}
+	disk.AddChild(&BlockDevice{Name: "loop7p1", FsType: "vfat", MountPoint: "/boot",
+		Size: 16 << 20, Existing: true})
+	disk.AddChild(home)
+	disk.AddChild(&BlockDevice{Name: "loop7p3", FsType: "ext4", MountPoint: "/",
+		Size: 32 << 20, Existing: true})
+
+	lp, err := disk.planLayout(tableLayout(table))
+	if err != nil {
+		t.Fatalf("Should have planned the layout: %v", err)
+	}
+
+	if err = disk.updateTable(table, lp, true); err != nil {
+		t.Fatalf("Should have updated the partition table: %v", err)
+	}
+
+	if err = disk.writeTableFile(f.Name(), table); err != nil {
+		t.Fatalf("Should have written the partition table: %v", err)
+	}
+
+	if home.Name != "loop7p2" {
+		t.Fatalf("Expected the new partition to be loop7p2, got: %s", home.Name)
+	}
+
+	table, err = readPartitionTableFile(f.Name(), defaultSectorSize)
+	if err != nil {
+		t.Fatalf("Should have read the updated partition table: %v", err)
+	}
+
+	if table.diskGUID != diskGUID || len(table.partitions) != 3 || !table.legacyBoot {
+		t.Fatalf("Unexpected updated partition table: %+v", table)
+	}
+
+	part := table.partition(2)
+	if part == nil || part.firstLBA != 2048+16<<11 || part.name != "/home" ||
+		part.typeGUID.String() != "933AC7E1-2EB4-4F13-B844-0E14E2AEF915" {
+		t.Fatalf("Unexpected new partition: %+v", part)
+	}
+
+	if table.partition(1).attributes&gptAttrLegacyBIOSBootable == 0 {
+		t.Fatalf("The existing /boot partition should be legacy BIOS bootable")
+	}
+
+	if table.partition(3).firstLBA != 2048+24<<11 {
+		t.Fatalf("The existing partitions should be kept in place")
+	}
+}
+
+func TestImage(t *testing.T) {
+	bd := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk, Size: 8 << 30}
+	if bd.IsImage() || bd.validateImage() != nil || bd.AttachImage() != nil {
+		t.Fatalf("Regular disks should not be handled as images")
+	}
+
+	bd.Image = "/nonexistent/clr.img"
+	if err := bd.validateImage(); err == nil {
+		t.Fatalf("Should fail validating an image in a missing directory")
+	}
+
+	bd.Image = os.TempDir() + "/clr.qcow2"
+	bd.ImageFormat = "vmdk"
+	if err := bd.validateImage(); err == nil {
+		t.Fatalf("Should fail validating an unknown image format")
+	}
+
+	bd.ImageFormat = ImageFormatQcow2
+	bd.RelativeSize = "50%"
+	if err := bd.validateImage(); err == nil {
+		t.Fatalf("Should fail validating an image with a relative size")
+	}
+
+	bd.RelativeSize = ""
+	if err := bd.validateImage(); err != nil {
+		t.Fatalf("Should have validated the image: %v", err)
+	}
+
+	if bd.rawImagePath() != bd.Image+".raw" {
+		t.Fatalf("Unexpected raw image path: %s", bd.rawImagePath())
+	}
+
+	existing, err := ioutil.TempFile("", "clr-img-")
+	if err != nil {
+		t.Fatalf("Should have created a temporary file: %v", err)
+	}
+	_ = existing.Close()
+	defer func() {
+		_ = os.Remove(existing.Name())
+	}()
+
+	img := &BlockDevice{Name: "sdb", Type: BlockDeviceTypeDisk, Size: 8 << 30,
+		Image: existing.Name()}
+	if err = img.validateImage(); err == nil {
+		t.Fatalf("Should fail validating an existing image")
+	}
+
+	if err = img.AttachImage(); err == nil {
+		t.Fatalf("Should fail creating an existing image")
+	}
+
+	img.ImageOverwrite = true
+	if err = img.validateImage(); err != nil {
+		t.Fatalf("Should accept overwriting an existing image: %v", err)
+	}
+
+	plan.Enable(true)
+	defer plan.Enable(false)
+
+	if err = bd.AttachImage(); err != nil {
+		t.Fatalf("Should have planned attaching the image: %v", err)
+	}
+
+	if bd.Type != BlockDeviceTypeLoop || !strings.HasPrefix(bd.Name, "loop") {
+		t.Fatalf("The image should be attached to a loop device: %s", bd.Name)
+	}
+
+	if err = DetachImages(true); err != nil {
+		t.Fatalf("Should have planned detaching the image: %v", err)
+	}
+
+	converted := false
+	for _, curr := range plan.Entries() {
+		if len(curr.Command) > 1 && curr.Command[0] == "qemu-img" && curr.Command[1] == "convert" {
+			converted = true
+		}
+	}
+
+	if !converted {
+		t.Fatalf("The image should have been converted to qcow2")
+	}
+
+	if err = bd.AttachImage(); err != nil {
+		t.Fatalf("Should have planned attaching the image: %v", err)
+	}
+
+	count := len(plan.Entries())
+	if err = DetachImages(false); err != nil {
+		t.Fatalf("Should have planned detaching the image: %v", err)
+	}
+
+	for _, curr := range plan.Entries()[count:] {
+		if len(curr.Command) > 1 && curr.Command[0] == "qemu-img" {
+			t.Fatalf("The image of a failed installation should not be converted")
+		}
+	}
+
+	if _, err := os.Stat(bd.rawImagePath()); err == nil {
+		t.Fatalf("No image file should be created in dry-run mode")
+	}
+}
+
+func TestWipe(t *testing.T) {
+	bd := &BlockDevice{Name: "sdz", Type: BlockDeviceTypeDisk, Wipe: "shred"}
+	if err := bd.validateWipe(); err == nil {
+		t.Fatalf("Should fail validating an unknown wipe method")
+	}
+
+	bd.Wipe = WipeDiscard
+	bd.AddChild(&BlockDevice{Name: "sdz1", Existing: true})
+	if err := bd.validateWipe(); err == nil {
+		t.Fatalf("Should fail wiping a disk with existing partitions")
+	}
+
+	bd.Children = nil
+	if err := bd.validateWipe(); err != nil {
+		t.Fatalf("Should have validated the wipe method: %v", err)
+	}
+
+	plan.Enable(true)
+	defer plan.Enable(false)
+	progress.Set(plan.Progress{})
+
+	if err := bd.WipeDisk(); err != nil {
+		t.Fatalf("Should have planned wiping the disk: %v", err)
+	}
+
+	commands := []string{}
+	for _, curr := range plan.Entries() {
+		if len(curr.Command) > 0 {
+			commands = append(commands, strings.Join(curr.Command, " "))
+		}
+	}
+
+	expected := []string{"wipefs --all --force /dev/sdz", "blkdiscard /dev/sdz"}
+	if strings.Join(commands, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected wipe commands: %v", commands)
+	}
+}
+
+func TestResolveTargetMedias(t *testing.T) {
+	lsblkOutput := `{
+    "blockdevices": [
+        {"name": "sda", "type": "disk", "size": "500G", "serial": "S1", "wwn": "0x5001", "rota": "0", "rm": "0", "ro": "1"},
+        {"name": "sdb", "type": "disk", "size": "1T", "serial": "S2", "rota": "1", "rm": "0"},
+        {"name": "sdc", "type": "disk", "size": "64G", "serial": "S3", "rota": "0", "rm": "1"},
+        {"name": "sdd", "type": "disk", "size": "1T", "serial": "S4", "rota": "1", "rm": "0"},
+        {"name": "sde", "type": "disk", "size": "2T", "serial": "S6", "rota": "1", "rm": "0",
+         "children": [{"name": "sde1", "type": "part", "size": "2T", "mountpoint": "/"}]},
+        {"name": "sr0", "type": "rom", "size": "1G", "rota": "1", "rm": "1"}
+    ]
+}`
+
+	inventory, err := parseBlockDevicesDescriptor([]byte(lsblkOutput))
+	if err != nil {
+		t.Fatalf("Should have parsed the lsblk output: %v", err)
+	}
+
+	if inventory[0].Serial != "S1" || inventory[0].WWN != "0x5001" || inventory[0].Rotational ||
+		!inventory[1].Rotational || !inventory[2].RemovableDevice {
+		t.Fatalf("Unexpected disk identifiers: %+v", inventory[0])
+	}
+
+	nonRemovable := false
+
+	tests := []struct {
+		target   *BlockDevice
+		expected string
+	}{
+		{&BlockDevice{Serial: "S3"}, "sdc"},
+		{&BlockDevice{WWN: "0X5001"}, "sda"},
+		{&BlockDevice{Selector: &DiskSelector{Pick: PickLargest, Media: MediaSSD,
+			Removable: &nonRemovable}}, "sda"},
+		{&BlockDevice{Selector: &DiskSelector{Pick: PickSmallest, MinSize: "64G"}}, "sdc"},
+		{&BlockDevice{Selector: &DiskSelector{Media: MediaHDD, MaxSize: "600G"}}, ""},
+		{&BlockDevice{Selector: &DiskSelector{Pick: PickLargest}}, ""},
+		{&BlockDevice{Selector: &DiskSelector{Media: MediaHDD}}, ""},
+		{&BlockDevice{Selector: &DiskSelector{Pick: "fastest"}}, ""},
+		{&BlockDevice{Serial: "S5"}, ""},
+		{&BlockDevice{Serial: "S6"}, ""},
+	}
+
+	for _, curr := range tests {
+		err = ResolveTargetMedias([]*BlockDevice{curr.target}, inventory)
+		if curr.expected == "" && err == nil {
+			t.Fatalf("Should fail resolving %s, got: %s", curr.target.selectorString(),
+				curr.target.Name)
+		} else if curr.expected != "" && (err != nil || curr.target.Name != curr.expected) {
+			t.Fatalf("Expected %s to select %s, got: %s %v", curr.target.selectorString(),
+				curr.expected, curr.target.Name, err)
+		}
+	}
+
+	target := &BlockDevice{Serial: "S1"}
+	if err = ResolveTargetMedias([]*BlockDevice{target}, inventory); err != nil || !target.ReadOnly {
+		t.Fatalf("Expected the target media to be read-only: %v", err)
+	}
+
+	targets := []*BlockDevice{{Serial: "S1"}, {WWN: "0x5001"}}
+	if err = ResolveTargetMedias(targets, inventory); err == nil {
+		t.Fatalf("Should fail selecting the same disk twice")
+	}
+
+	if !inventory[0].Equals(&BlockDevice{Name: "sdz", Serial: "S1"}) {
+		t.Fatalf("Disks with the same serial should be equal")
+	}
+
+	dir, err := ioutil.TempDir("", "by-id-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	link := dir + "/ata-disk"
+	if err = os.Symlink("../../sdb", link); err != nil {
+		t.Fatal(err)
+	}
+
+	if name, err := devicePathName(link); err != nil || name != "sdb" {
+		t.Fatalf("Expected the link to resolve to sdb, got: %s %v", name, err)
+	}
+}
+
+func TestValidateLayout(t *testing.T) {
+	sda := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk, Size: 1 << 30, ReadOnly: true}
+	sda.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot", Size: 32 << 20})
+	sda.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/", Size: 2 << 30})
+
+	sdb := &BlockDevice{Name: "sdb", Type: BlockDeviceTypeDisk, Size: 8 << 30, RemovableDevice: true}
+	sdb.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot", Size: 512 << 20})
+	sdb.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/", Size: 4 << 30})
+
+	err := ValidateLayout([]*BlockDevice{sda, sdb}, nil, nil, false, false)
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got: %v", err)
+	}
+
+	expected := []string{
+		"/dev/sda: Read-only device",
+		"/dev/sda1: The EFI partition is too small",
+		"/dev/sda: Partitions",
+		"/dev/sdb: Removable device",
+		"/dev/sdb1: Duplicated mount point: /boot",
+		"/dev/sdb2: Duplicated mount point: /",
+		"/dev/sdb1: Only one EFI partition is supported",
+	}
+
+	if len(ve.Problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got:\n%s", len(expected), ve)
+	}
+
+	for idx, curr := range ve.Problems {
+		if !strings.HasPrefix(curr.String(), expected[idx]) {
+			t.Fatalf("Expected problem %q, got: %q", expected[idx], curr)
+		}
+	}
+
+	sda.ReadOnly = false
+	sda.Children[0].FsType = "ext4"
+	sda.Children[1].Size = 512 << 20
+	sdb.Children = nil
+
+	err = ValidateLayout([]*BlockDevice{sda, sdb}, nil, nil, true, false)
+	if err == nil || !strings.Contains(err.Error(), "Unsupported file system for /boot") ||
+		!strings.Contains(err.Error(), "Could not find a suitable EFI partition") {
+		t.Fatalf("Expected the /boot file system to be rejected, got: %v", err)
+	}
+
+	sda.Children[0].Size = 150 << 20
+	if err = ValidateLayout([]*BlockDevice{sda, sdb}, nil, nil, true, true); err != nil {
+		t.Fatalf("An ext4 legacy boot partition should be valid: %v", err)
+	}
+
+	sda.Children[0].FsType = "xfs"
+	err = ValidateLayout([]*BlockDevice{sda, sdb}, nil, nil, true, true)
+	if err == nil || !strings.Contains(err.Error(), "the legacy boot partition must be one of") ||
+		!strings.Contains(err.Error(), "Could not find a suitable legacy boot partition") {
+		t.Fatalf("Expected the legacy boot file system to be rejected, got: %v", err)
+	}
+
+	sda.Children[0].FsType = "vfat"
+	if err = ValidateLayout([]*BlockDevice{sda, sdb}, nil, nil, true, false); err != nil {
+		t.Fatalf("The layout should be valid: %v", err)
+	}
+
+	// every problem of the volume groups and raid arrays is reported
+	groups := []*BlockDevice{
+		{Name: "vg0", Children: []*BlockDevice{{Name: "data", FsType: "vfat", MountPoint: "/data"}}},
+		{Name: "vg1", Children: []*BlockDevice{{Name: "srv", FsType: "ext4", MountPoint: "/srv"}}},
+	}
+	arrays := []*BlockDevice{{Name: "md0", RaidLevel: "3", FsType: "ext4", MountPoint: "/var"}}
+
+	err = ValidateLayout([]*BlockDevice{sda, sdb}, groups, arrays, true, false)
+	ve, ok = err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got: %v", err)
+	}
+
+	expected = []string{
+		"No physical volumes found for volume group: vg0",
+		"No physical volumes found for volume group: vg1",
+		"Unsupported raid level for md0: 3",
+	}
+
+	if len(ve.Problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got:\n%s", len(expected), ve)
+	}
+
+	for idx, curr := range ve.Problems {
+		if curr.String() != expected[idx] {
+			t.Fatalf("Expected problem %q, got: %q", expected[idx], curr)
+		}
+	}
+}
+
+func TestMountManager(t *testing.T) {
+	root := "/tmp/install-test"
+	mm := GetMountManager(root + "/")
+
+	if GetMountManager(root) != mm || mm.Root() != root {
+		t.Fatalf("Expected a single manager per root directory")
+	}
+
+	if GetMountManager("/tmp/install-other") == mm {
+		t.Fatalf("Expected a manager per root directory")
+	}
+
+	for _, curr := range []string{"", "/boot", "/home", "/proc", "/home/user", "/boot/efi"} {
+		mm.mounts = append(mm.mounts, &mountEntry{path: root + curr, parent: mm.parentOf(root + curr)})
+	}
+
+	order := []string{}
+	for _, curr := range umountOrder(mm.mounts) {
+		order = append(order, strings.TrimPrefix(curr.path, root))
+	}
+
+	expected := []string{"/boot/efi", "/home/user", "/proc", "/home", "/boot", ""}
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected unmount order: %v", order)
+	}
+
+	mountInfo := `22 1 8:3 / / rw,relatime shared:1 - ext4 /dev/sda3 rw
+90 22 8:33 / /tmp/install-test rw,relatime - ext4 /dev/sdc3 rw
+91 90 0:5 / /tmp/install-test/dev rw - devtmpfs devtmpfs rw
+92 22 8:17 / /tmp/install-1234 rw,relatime - ext4 /dev/sdb3 rw
+93 92 8:16 / /tmp/install-1234/boot rw,relatime - vfat /dev/sdb1 rw
+94 22 8:18 / /tmp/my\040dir rw,relatime - ext4 /dev/sdb2 rw
+`
+
+	mountPoints, err := parseMountInfo(strings.NewReader(mountInfo))
+	if err != nil {
+		t.Fatalf("Should have parsed the mount info: %v", err)
+	}
+
+	if len(mountPoints) != 6 || mountPoints[5] != "/tmp/my dir" {
+		t.Fatalf("Unexpected mount points: %v", mountPoints)
+	}
+
+	stale := staleMountPoints(mountPoints, "/tmp")
+	if strings.Join(stale, ",") != "/tmp/install-1234/boot,/tmp/install-1234" {
+		t.Fatalf("Unexpected stale mount points: %v", stale)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "mounts-")
+	if err != nil {
+		t.Fatalf("Should have created a temporary directory: %v", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	live := filepath.Join(tmpDir, "install-live")
+	dead := filepath.Join(tmpDir, "install-dead")
+
+	if err = ioutil.WriteFile(ownerFile(live), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		t.Fatalf("Should have written the owner file: %v", err)
+	}
+
+	// no process can have a pid above the kernel's pid_max limit
+	if err = ioutil.WriteFile(ownerFile(dead), []byte("2147483647"), 0644); err != nil {
+		t.Fatalf("Should have written the owner file: %v", err)
+	}
+
+	stale = staleMountPoints([]string{live, live + "/boot", dead, dead + "/boot"}, tmpDir)
+	if strings.Join(stale, ",") != dead+"/boot,"+dead {
+		t.Fatalf("Only the mounts of a gone owner should be stale: %v", stale)
+	}
+
+	// nothing was actually mounted
+	mm.mounts = nil
+	if err = UmountAll(); err != nil {
+		t.Fatalf("Should have forgotten the managers: %v", err)
+	}
+
+	if len(managers) != 0 {
+		t.Fatalf("The managers should be removed once unmounted")
+	}
+}
+
+func TestRegisterFileSystem(t *testing.T) {
+	if err := RegisterFileSystem(&FileSystem{Name: "ext4", MakeFsCommand: []string{"true"}}); err == nil {
+		t.Fatalf("Should fail registering a file system twice")
+	}
+
+	if err := RegisterFileSystem(&FileSystem{Name: "nofs"}); err == nil {
+		t.Fatalf("Should fail registering a file system without mkfs command")
+	}
+
+	fs := &FileSystem{Name: "testfs", MakeFsCommand: []string{"true", "-q"}, LabelOption: "-n"}
+	if err := RegisterFileSystem(fs); err != nil {
+		t.Fatalf("Should have registered the file system: %v", err)
+	}
+	defer delete(fileSystems, fs.Name)
+
+	available := strings.Join(AvailableFileSystems(), ",")
+	if !strings.Contains(available, "testfs") {
+		t.Fatalf("The registered file system should be available: %s", available)
+	}
+
+	fs.MakeFsCommand = []string{"mkfs.nonexistent"}
+	if strings.Contains(strings.Join(AvailableFileSystems(), ","), "testfs") {
+		t.Fatalf("File systems without tools should not be available")
+	}
+
+	plan.Enable(true)
+	defer plan.Enable(false)
+
+	disk := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk}
+	parts := []*BlockDevice{
+		{Type: BlockDeviceTypePart, FsType: "xfs", Label: "data", MkfsOptions: "-m reflink=1"},
+		{Type: BlockDeviceTypePart, FsType: "ext4", MkfsOptions: "-O encrypt,casefold"},
+		{Type: BlockDeviceTypePart, FsType: "testfs", Label: "test"},
+	}
+
+	for _, curr := range parts {
+		disk.AddChild(curr)
+		if err := curr.MakeFs(); err != nil {
+			t.Fatalf("Should have planned the file system creation: %v", err)
+		}
+	}
+
+	expected := []string{
+		"mkfs.xfs -f -L data -m reflink=1 /dev/sda1",
+		"mkfs.ext4 -v -F -b 4096 -O encrypt,casefold /dev/sda2",
+		"mkfs.nonexistent -n test /dev/sda3",
+	}
+
+	commands := []string{}
+	for _, curr := range plan.Entries() {
+		commands = append(commands, strings.Join(curr.Command, " "))
+	}
+
+	if strings.Join(commands, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected mkfs commands: %v", commands)
+	}
+}
+
+func TestMultiDiskLayout(t *testing.T) {
+	nvme := &BlockDevice{Name: "nvme0n1", Type: BlockDeviceTypeDisk, Size: 16 << 30}
+	nvme.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot", Size: 512 << 20})
+	nvme.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/", Size: 8 << 30})
+
+	sda := &BlockDevice{Name: "sda", Type: BlockDeviceTypeDisk, Size: 32 << 30}
+	sda.AddChild(&BlockDevice{FsType: "xfs", MountPoint: "/home", Size: 16 << 30})
+	sda.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/var", Size: 8 << 30})
+	sda.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/opt", Size: 4 << 30})
+
+	medias := []*BlockDevice{nvme, sda}
+	if err := ValidateLayout(medias, nil, nil, false, false); err != nil {
+		t.Fatalf("The multi disk layout should be valid: %v", err)
+	}
+
+	if nvme.Children[1].Name != "nvme0n1p2" || sda.Children[0].Name != "sda1" {
+		t.Fatalf("Unexpected partition names: %s %s", nvme.Children[1].Name, sda.Children[0].Name)
+	}
+
+	// the disk without the EFI partition gets a table of its own
+	table, err := sda.gptTable(defaultSectorSize, sda.Size, false)
+	if err != nil {
+		t.Fatalf("Should have built the partition table: %v", err)
+	}
+
+	expected := []string{guidMap["/home"], guidMap["/var"], guidMap["data"]}
+	for idx, curr := range table.partitions {
+		if curr.typeGUID.String() != expected[idx] {
+			t.Fatalf("Wrong type of partition %d: %s", idx+1, curr.typeGUID)
+		}
+	}
+
+	// the EFI partition may live in any of the target disks
+	sda.AddChild(nvme.Children[0])
+	nvme.RemoveChild(nvme.Children[0])
+	if err = ValidateLayout(medias, nil, nil, false, false); err != nil {
+		t.Fatalf("The EFI partition should be allowed in the second disk: %v", err)
+	}
+
+	sda.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/", Size: 1 << 30})
+	sda.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot", Size: 512 << 20})
+
+	err = ValidateLayout(medias, nil, nil, false, false)
+	if err == nil || !strings.Contains(err.Error(), "Duplicated mount point: /\n") ||
+		!strings.Contains(err.Error(), "Only one EFI partition is supported") {
+		t.Fatalf("Expected a single / and EFI partition across the disks, got: %v", err)
+	}
+}
+
+func TestSysfsBlockDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysfs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	files := map[string]string{
+		"block/sda/dev":                       "8:0",
+		"block/sda/size":                      "62521344",
+		"block/sda/removable":                 "1",
+		"block/sda/queue/rotational":          "0",
+		"block/sda/queue/logical_block_size":  "512",
+		"block/sda/queue/physical_block_size": "4096",
+		"block/sda/device/model":              "Flash Drive     ",
+		"block/sda/device/state":              "running",
+		"block/sda/sda2/dev":                  "8:2",
+		"block/sda/sda2/size":                 "2048",
+		"block/sda/sda2/partition":            "2",
+		"block/sda/sda1/dev":                  "8:1",
+		"block/sda/sda1/size":                 "1024",
+		"block/sda/sda1/partition":            "1",
+		"block/nvme0n1/dev":                   "259:0",
+		"block/nvme0n1/size":                  "1000215216",
+		"block/nvme0n1/queue/rotational":      "0",
+		"block/nvme0n1/device/serial":         "S4EWNX0N ",
+		"block/nvme0n1/nvme0n1p1/dev":         "259:1",
+		"block/nvme0n1/nvme0n1p1/size":        "1024",
+		"block/nvme0n1/nvme0n1p1/partition":   "1",
+		"block/loop0/dev":                     "7:0",
+		"block/loop0/size":                    "0",
+		"block/sr0/dev":                       "11:0",
+		"block/sr0/size":                      "2048",
+		"block/dm-0/dev":                      "253:0",
+		"block/dm-0/size":                     "2048",
+		"block/dm-0/slaves/sda2":              "",
+		"udev/b8:0":                           "S:disk/by-id/usb-Flash\nE:ID_BUS=usb\nE:ID_SERIAL_SHORT=AA01\nE:ID_MODEL=Flash_Drive\n",
+		"udev/b8:1":                           "E:ID_FS_TYPE=vfat\nE:ID_FS_UUID=1234-ABCD\nE:ID_FS_LABEL=BOOT\n",
+		"mountinfo":                           "36 1 259:1 / /boot rw,relatime - vfat /dev/nvme0n1p1 rw\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sysDiskDir, udevDataDir, mountInfoFile, swapsFile = dir+"/block", dir+"/udev",
+		dir+"/mountinfo", dir+"/swaps"
+	defer func() {
+		sysDiskDir, udevDataDir, mountInfoFile, swapsFile = "/sys/block", "/run/udev/data",
+			"/proc/self/mountinfo", "/proc/swaps"
+	}()
+
+	bds, err := listSysfsBlockDevices()
+	if err != nil {
+		t.Fatalf("Should have listed the block devices: %v", err)
+	}
+
+	if len(bds) != 2 || bds[0].Name != "nvme0n1" || bds[1].Name != "sda" {
+		t.Fatalf("Expected only the nvme0n1 and sda disks, got: %v", bds)
+	}
+
+	nvme, sda := bds[0], bds[1]
+
+	if nvme.Serial != "S4EWNX0N" || nvme.Transport != "nvme" || nvme.IsAvailable() ||
+		nvme.Children[0].MountPoint != "/boot" {
+		t.Fatalf("Unexpected nvme0n1 properties: %+v", nvme)
+	}
+
+	if sda.Model != "Flash Drive" || sda.Serial != "AA01" || sda.Transport != "usb" ||
+		sda.Size != 62521344*512 || !sda.RemovableDevice || sda.Rotational ||
+		sda.LogSectorSize != 512 || sda.PhySectorSize != 4096 ||
+		sda.State != BlockDeviceStateRunning || !sda.IsAvailable() {
+		t.Fatalf("Unexpected sda properties: %+v", sda)
+	}
+
+	if len(sda.Children) != 2 || sda.Children[0].Name != "sda1" || sda.Children[1].Name != "sda2" {
+		t.Fatalf("Expected the partitions sorted by number: %v", sda.Children)
+	}
+
+	part := sda.Children[0]
+	if part.FsType != "vfat" || part.UUID != "1234-ABCD" || part.Label != "BOOT" ||
+		part.Size != 1024*512 || !part.Existing || part.Parent != sda {
+		t.Fatalf("Unexpected sda1 properties: %+v", part)
+	}
+}
+
+func TestParseUevent(t *testing.T) {
+	kernel := "add@/devices/pci0000:00/usb1/1-1/block/sdb\x00ACTION=add\x00" +
+		"DEVPATH=/devices/pci0000:00/usb1/1-1/block/sdb\x00SUBSYSTEM=block\x00DEVNAME=sdb\x00"
+
+	ev, err := parseUevent([]byte(kernel))
+	if err != nil || ev.action != "add" || !ev.isBlockDevice() || ev.properties["DEVNAME"] != "sdb" {
+		t.Fatalf("Unexpected kernel uevent: %+v %v", ev, err)
+	}
+
+	props := "ACTION=remove\x00SUBSYSTEM=block\x00DEVNAME=/dev/sdb1\x00"
+	header := make([]byte, 40)
+	copy(header, udevMonitorPrefix)
+	binary.LittleEndian.PutUint32(header[16:20], uint32(len(header)))
+	binary.LittleEndian.PutUint32(header[20:24], uint32(len(props)))
+
+	ev, err = parseUevent(append(header, props...))
+	if err != nil || ev.action != "remove" || ev.properties["DEVNAME"] != "/dev/sdb1" {
+		t.Fatalf("Unexpected udev uevent: %+v %v", ev, err)
+	}
+
+	binary.LittleEndian.PutUint32(header[20:24], 4096)
+	if _, err = parseUevent(append(header, props...)); err == nil {
+		t.Fatalf("Should fail parsing truncated udev uevents")
+	}
+
+	if _, err = parseUevent([]byte("SUBSYSTEM=net\x00")); err == nil {
+		t.Fatalf("Should fail parsing uevents without action")
+	}
+}
+
+func TestPartitionNames(t *testing.T) {
+	tests := []struct {
+		disk      string
+		partition string
+	}{
+		{"sda", "sda3"},
+		{"vdb", "vdb3"},
+		{"nvme0n1", "nvme0n1p3"},
+		{"mmcblk0", "mmcblk0p3"},
+		{"loop0", "loop0p3"},
+		{"md127", "md127p3"},
+	}
+
+	for _, curr := range tests {
+		bd := &BlockDevice{Name: curr.disk}
+		if name := bd.partitionName(3); name != curr.partition {
+			t.Fatalf("Expected partition %s of %s, got: %s", curr.partition, curr.disk, name)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "sysfs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	for num, name := range []string{"mmcblk0p1", "mmcblk0p2"} {
+		partDir := filepath.Join(dir, "mmcblk0", name)
+		if err = os.MkdirAll(partDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = ioutil.WriteFile(partDir+"/partition", []byte(fmt.Sprintf("%d\n", num+1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sysBlockDir = dir
+	defer func() {
+		sysBlockDir = "/sys/class/block"
+	}()
+
+	disk := &BlockDevice{Name: "mmcblk0", Type: BlockDeviceTypeDisk}
+	disk.AddChild(&BlockDevice{FsType: "vfat", MountPoint: "/boot"})
+	disk.AddChild(&BlockDevice{FsType: "ext4", MountPoint: "/"})
+
+	// names guessed before the disk was known i.e by a descriptor
+	disk.Children[1].Name = "mmcblk02"
+	disk.refreshPartitionNames()
+
+	if disk.Children[0].Name != "mmcblk0p1" || disk.Children[1].Name != "mmcblk0p2" {
+		t.Fatalf("Unexpected partition names: %s %s", disk.Children[0].Name, disk.Children[1].Name)
+	}
+
+	if err = waitDeviceFile(dir+"/mmcblk0/mmcblk0p1", time.Second); err != nil {
+		t.Fatalf("Should have found the device file: %v", err)
+	}
+
+	if err = waitDeviceFile(dir+"/mmcblk0/mmcblk0p3", 200*time.Millisecond); err == nil {
+		t.Fatalf("Should have timed out waiting for the device file")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/plan"
+	"github.com/clearlinux/clr-installer/progress"
+	"github.com/clearlinux/clr-installer/utils"
+)
+
+const (
+	// SwapTypePartition uses the swap partitions declared in the target medias
+	SwapTypePartition = "partition"
+
+	// SwapTypeFile creates a swap file in the root file system
+	SwapTypeFile = "file"
+
+	// SwapTypeZram configures a compressed swap device in memory
+	SwapTypeZram = "zram"
+
+	// SwapFilePath is the path of the swap file in the target system
+	SwapFilePath = "/swapfile"
+
+	// zramConfFile is the zram-generator configuration of the target system
+	zramConfFile = "etc/systemd/zram-generator.conf"
+)
+
+var (
+	// SwapTypes lists the supported swap configurations
+	SwapTypes = []string{SwapTypePartition, SwapTypeFile, SwapTypeZram}
+
+	// swapFileFileSystems are the root file systems a swap file can be created in
+	swapFileFileSystems = []string{"ext2", "ext3", "ext4", "xfs", "btrfs"}
+)
+
+// SwapConfig describes how the target system swaps, Size is an absolute size or
+// RAMSwapSize, if empty the size is computed from the installed memory
+type SwapConfig struct {
+	Type string `yaml:"type"`
+	Size string `yaml:"size,omitempty"`
+}
+
+// UsesPartitions returns true if the swap is provided by swap partitions
+func (sc *SwapConfig) UsesPartitions() bool {
+	return sc == nil || sc.Type == "" || sc.Type == SwapTypePartition
+}
+
+// size returns the swap size in bytes, 0 meaning it's computed from the installed memory
+func (sc *SwapConfig) size() (uint64, error) {
+	if sc.Size == "" || sc.Size == RAMSwapSize {
+		return 0, nil
+	}
+
+	return ParseVolumeSize(sc.Size)
+}
+
+// Validate checks the swap configuration is consistent with the bds, the target
+// medias, volume groups and raid arrays
+func (sc *SwapConfig) Validate(bds []*BlockDevice) error {
+	found := false
+	for _, curr := range SwapTypes {
+		if sc.Type == curr {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return errors.Errorf("Invalid swap type: %s", sc.Type)
+	}
+
+	if sc.UsesPartitions() {
+		return nil
+	}
+
+	size, err := sc.size()
+	if err != nil {
+		return err
+	}
+
+	if size != 0 && size < MinimumPartitionSize {
+		return errors.Errorf("Invalid swap size: %s", sc.Size)
+	}
+
+	for _, bd := range bds {
+		for _, curr := range append([]*BlockDevice{bd}, bd.Children...) {
+			if curr.FsType == "swap" {
+				return errors.Errorf("Swap partition %s conflicts with the %s swap", curr.Name, sc.Type)
+			}
+		}
+	}
+
+	if sc.Type != SwapTypeFile {
+		return nil
+	}
+
+	root := FindMountPoint(bds, "/")
+	if root == nil {
+		return nil
+	}
+
+	for _, curr := range swapFileFileSystems {
+		if root.FsType == curr {
+			return nil
+		}
+	}
+
+	return errors.Errorf("Swap files are not supported by the root file system: %s", root.FsType)
+}
+
+// Setup creates the swap file or the zram configuration in the target system
+// mounted at rootDir, root is the root file system's block device
+func (sc *SwapConfig) Setup(rootDir string, root *BlockDevice) error {
+	switch sc.Type {
+	case SwapTypeFile:
+		return sc.createSwapFile(rootDir, root)
+	case SwapTypeZram:
+		return sc.writeZramConf(rootDir)
+	}
+
+	return nil
+}
+
+// FstabEntries returns the fstab entries required by the swap configuration
+func (sc *SwapConfig) FstabEntries() []string {
+	if sc == nil || sc.Type != SwapTypeFile {
+		return []string{}
+	}
+
+	return []string{fmt.Sprintf("%s none swap defaults 0 0", SwapFilePath)}
+}
+
+// createSwapFile allocates and formats the swap file, it's added to the target's
+// fstab by WriteFstab() with FstabEntries()
+func (sc *SwapConfig) createSwapFile(rootDir string, root *BlockDevice) error {
+	size, err := sc.size()
+	if err != nil {
+		return err
+	}
+
+	if size == 0 {
+		size = swapSizeFromRAM()
+	}
+
+	prg := progress.NewLoop("Creating swap file: %s", SwapFilePath)
+	path := filepath.Join(rootDir, SwapFilePath)
+
+	cmds := [][]string{
+		{"truncate", "-s", "0", path},
+		{"chmod", "0600", path},
+	}
+
+	// btrfs swap files must not be copy-on-write, the attribute only
+	// applies to empty files
+	if root != nil && root.FsType == "btrfs" {
+		cmds = append(cmds, []string{"chattr", "+C", path})
+	}
+
+	cmds = append(cmds, []string{"fallocate", "-l", fmt.Sprintf("%d", size), path},
+		[]string{"mkswap", path})
+
+	for _, args := range cmds {
+		if err = cmd.RunAndLog(args...); err != nil {
+			prg.Failure()
+			return errors.Wrap(err)
+		}
+	}
+
+	prg.Success()
+	return nil
+}
+
+// zramConf returns the zram-generator configuration for the swap size
+func (sc *SwapConfig) zramConf() (string, error) {
+	size, err := sc.size()
+	if err != nil {
+		return "", err
+	}
+
+	zramSize := "ram / 2"
+	if size > 0 {
+		// zram-generator expects the size in MiB
+		zramSize = fmt.Sprintf("%d", size>>20)
+	}
+
+	lines := []string{
+		"[zram0]",
+		fmt.Sprintf("zram-size = %s", zramSize),
+		"compression-algorithm = zstd",
+	}
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// writeZramConf writes the zram-generator configuration to the target system
+func (sc *SwapConfig) writeZramConf(rootDir string) error {
+	content, err := sc.zramConf()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(rootDir, zramConfFile)
+
+	if err = utils.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if err = plan.WriteFile(path, []byte(content), 0644); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/clearlinux/clr-installer/errors"
+)
+
+var (
+	// sysDiskDir is where the kernel lists the whole disks, partitions are
+	// sub directories of their disks
+	sysDiskDir = "/sys/block"
+
+	// udevDataDir is where udev keeps the properties of the devices it has processed
+	udevDataDir = "/run/udev/data"
+
+	// swapsFile lists the active swap devices
+	swapsFile = "/proc/swaps"
+
+	// excludedMajors are the memory(1), floppy(2) and SCSI CDROM(11) devices
+	excludedMajors = map[string]bool{"1": true, "2": true, "11": true}
+)
+
+// sysfsAttr returns the value of the attribute name of the sysfs directory dir,
+// an empty string is returned if the attribute is not present
+func sysfsAttr(dir string, name string) string {
+	content, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(content))
+}
+
+// sysfsUint returns the numeric attribute name of the sysfs directory dir
+func sysfsUint(dir string, name string) uint64 {
+	value, err := strconv.ParseUint(sysfsAttr(dir, name), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
+
+// udevProperties returns the properties udev has recorded for the block device majMin
+func udevProperties(majMin string) map[string]string {
+	res := map[string]string{}
+
+	content, err := ioutil.ReadFile(filepath.Join(udevDataDir, "b"+majMin))
+	if err != nil {
+		return res
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, "E:") {
+			continue
+		}
+
+		kv := strings.SplitN(strings.TrimPrefix(line, "E:"), "=", 2)
+		if len(kv) == 2 {
+			res[kv[0]] = kv[1]
+		}
+	}
+
+	return res
+}
+
+// deviceNumber returns the major:minor number of the block device file path
+func deviceNumber(path string) string {
+	if !strings.HasPrefix(path, "/dev/") {
+		return ""
+	}
+
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	return sysfsAttr(filepath.Join(sysBlockDir, filepath.Base(path)), "dev")
+}
+
+// mountedDevices maps the major:minor number of the block devices in use by the
+// host to their mount point, active swap devices are reported as [SWAP]
+func mountedDevices() map[string]string {
+	res := map[string]string{}
+
+	if f, err := os.Open(mountInfoFile); err == nil {
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 5 {
+				continue
+			}
+
+			// the mount source follows the optional fields separator, btrfs
+			// reports an anonymous device number so the source is also checked
+			keys := []string{fields[2]}
+			for idx, curr := range fields {
+				if curr == "-" && idx+2 < len(fields) {
+					keys = append(keys, deviceNumber(unescapeMountInfo(fields[idx+2])))
+					break
+				}
+			}
+
+			for _, key := range keys {
+				if _, ok := res[key]; key != "" && !ok {
+					res[key] = unescapeMountInfo(fields[4])
+				}
+			}
+		}
+
+		_ = f.Close()
+	}
+
+	if content, err := ioutil.ReadFile(swapsFile); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+
+			if key := deviceNumber(fields[0]); key != "" {
+				res[key] = "[SWAP]"
+			}
+		}
+	}
+
+	return res
+}
+
+// diskTransport determines how the disk name is attached to the system i.e
+// nvme, sata, usb or mmc, devPath is the disk's resolved sysfs directory
+func diskTransport(name string, devPath string, props map[string]string) string {
+	switch {
+	case strings.HasPrefix(name, "nvme"):
+		return "nvme"
+	case strings.HasPrefix(name, "mmcblk"):
+		return "mmc"
+	case strings.Contains(devPath, "/usb"):
+		return "usb"
+	case strings.Contains(devPath, "/ata"):
+		return "sata"
+	case strings.Contains(devPath, "/virtio"):
+		return "virtio"
+	}
+
+	return props["ID_BUS"]
+}
+
+// readSysfsProperties fills the file system properties and mount point of bd, a disk
+// or partition, from udev's database and the host's mounts
+func (bd *BlockDevice) readSysfsProperties(dir string, mounts map[string]string) {
+	props := udevProperties(bd.MajorMinor)
+
+	bd.Size = sysfsUint(dir, "size") * 512
+	bd.ReadOnly = sysfsAttr(dir, "ro") == "1"
+	bd.FsType = props["ID_FS_TYPE"]
+	bd.UUID = props["ID_FS_UUID"]
+	bd.Label = props["ID_FS_LABEL"]
+	bd.MountPoint = mounts[bd.MajorMinor]
+}
+
+// readSysfsPartitions returns the partitions of the disk whose sysfs directory is dir
+func readSysfsPartitions(dir string, mounts map[string]string) []*BlockDevice {
+	res := []*BlockDevice{}
+	numbers := map[*BlockDevice]uint64{}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*", "partition"))
+	if err != nil {
+		return res
+	}
+
+	for _, curr := range matches {
+		partDir := filepath.Dir(curr)
+
+		part := &BlockDevice{
+			Name:       filepath.Base(partDir),
+			MajorMinor: sysfsAttr(partDir, "dev"),
+			Type:       BlockDeviceTypePart,
+		}
+		part.readSysfsProperties(partDir, mounts)
+
+		numbers[part] = sysfsUint(partDir, "partition")
+		res = append(res, part)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return numbers[res[i]] < numbers[res[j]]
+	})
+
+	return res
+}
+
+// readSysfsDisk reads the disk name from the sysfs directory dir, nil is returned for
+// the devices not suitable as installation targets: the excluded device types, empty
+// devices such as detached loop devices or card readers without a card, and the
+// devices stacked on top of others i.e device mapper or raid arrays
+func readSysfsDisk(dir string, name string, mounts map[string]string) *BlockDevice {
+	majMin := sysfsAttr(dir, "dev")
+	if majMin == "" || excludedMajors[strings.Split(majMin, ":")[0]] {
+		return nil
+	}
+
+	if sysfsUint(dir, "size") == 0 {
+		return nil
+	}
+
+	if slaves, err := ioutil.ReadDir(filepath.Join(dir, "slaves")); err == nil && len(slaves) > 0 {
+		return nil
+	}
+
+	props := udevProperties(majMin)
+	devPath, _ := filepath.EvalSymlinks(dir)
+
+	bd := &BlockDevice{
+		Name:            name,
+		MajorMinor:      majMin,
+		Type:            BlockDeviceTypeDisk,
+		RemovableDevice: sysfsAttr(dir, "removable") == "1",
+		Rotational:      sysfsAttr(dir, "queue/rotational") == "1",
+		LogSectorSize:   sysfsUint(dir, "queue/logical_block_size"),
+		PhySectorSize:   sysfsUint(dir, "queue/physical_block_size"),
+		Model:           sysfsAttr(dir, "device/model"),
+		Serial:          props["ID_SERIAL_SHORT"],
+		WWN:             props["ID_WWN_WITH_EXTENSION"],
+		Transport:       diskTransport(name, devPath, props),
+	}
+	bd.readSysfsProperties(dir, mounts)
+
+	if strings.HasPrefix(name, "loop") {
+		bd.Type = BlockDeviceTypeLoop
+	}
+
+	if bd.Model == "" {
+		bd.Model = strings.Replace(props["ID_MODEL"], "_", " ", -1)
+	}
+
+	// nvme disks expose their serial and world wide identifier in sysfs even without udev
+	if bd.Serial == "" {
+		bd.Serial = sysfsAttr(dir, "device/serial")
+	}
+
+	if bd.WWN == "" {
+		bd.WWN = props["ID_WWN"]
+	}
+
+	if bd.WWN == "" {
+		bd.WWN = sysfsAttr(dir, "wwid")
+	}
+
+	if state, err := parseBlockDeviceState(sysfsAttr(dir, "device/state")); err == nil {
+		bd.State = state
+	}
+
+	bd.Children = readSysfsPartitions(dir, mounts)
+
+	return bd
+}
+
+// listSysfsBlockDevices lists the disks and their partitions reading sysfs and
+// udev's database directly, no device is probed or otherwise touched
+func listSysfsBlockDevices() ([]*BlockDevice, error) {
+	entries, err := ioutil.ReadDir(sysDiskDir)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	mounts := mountedDevices()
+	bds := []*BlockDevice{}
+
+	for _, curr := range entries {
+		bd := readSysfsDisk(filepath.Join(sysDiskDir, curr.Name()), curr.Name(), mounts)
+		if bd != nil {
+			bds = append(bds, bd)
+		}
+	}
+
+	setLoadedBlockDevices(bds)
+
+	return bds, nil
+}
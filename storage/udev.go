@@ -0,0 +1,128 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/log"
+	"github.com/clearlinux/clr-installer/plan"
+)
+
+const (
+	// udevSettleTimeout bounds the time waited for udev to process the events
+	// triggered by a new partition table
+	udevSettleTimeout = 10 * time.Second
+
+	// deviceFileTimeout bounds the time waited for a partition device file to appear
+	deviceFileTimeout = 10 * time.Second
+
+	// deviceFilePollInterval is how often the partition device files are looked for
+	deviceFilePollInterval = 100 * time.Millisecond
+)
+
+// udevSettle waits for udev to process the pending events, nothing is done if udev
+// is not running i.e in containers
+func udevSettle() error {
+	if _, err := os.Stat(udevControlSocket); err != nil {
+		return nil
+	}
+
+	if _, err := exec.LookPath("udevadm"); err != nil {
+		log.Debug("udevadm not found, not waiting for udev")
+		return nil
+	}
+
+	timeout := fmt.Sprintf("--timeout=%d", int(udevSettleTimeout.Seconds()))
+	if err := cmd.RunAndLog("udevadm", "settle", timeout); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+// waitDeviceFile waits for the device file path to appear, for up to timeout
+func waitDeviceFile(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.Errorf("Timeout waiting for the device file: %s", path)
+		}
+
+		time.Sleep(deviceFilePollInterval)
+	}
+}
+
+// refreshPartitionNames names bd's partitions after the partitions the kernel found in
+// the disk, partitions are matched by their number
+func (bd *BlockDevice) refreshPartitionNames() {
+	names := map[int]string{}
+
+	for _, curr := range readSysfsPartitions(filepath.Join(sysBlockDir, bd.Name), nil) {
+		names[curr.partitionNumber()] = curr.Name
+	}
+
+	for _, curr := range bd.Children {
+		name, ok := names[curr.partitionNumber()]
+		if !ok || name == curr.Name {
+			continue
+		}
+
+		log.Debug("Partition %s is named %s by the kernel", curr.Name, name)
+		curr.Name = name
+	}
+}
+
+// settlePartitions waits for the partitions of bd to be ready once its partition table
+// is written: udev has processed the new partitions and their device files exist
+func (bd *BlockDevice) settlePartitions() error {
+	if plan.Enabled() {
+		return nil
+	}
+
+	if err := udevSettle(); err != nil {
+		return err
+	}
+
+	bd.refreshPartitionNames()
+
+	for _, curr := range bd.Children {
+		if err := waitDeviceFile(curr.GetDeviceFile(), deviceFileTimeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refreshUUID reads the file system uuid of bd, once formatted
+func (bd *BlockDevice) refreshUUID() {
+	if plan.Enabled() || bd.VolumeGroup != "" || bd.RaidArray != "" {
+		return
+	}
+
+	w := bytes.NewBuffer(nil)
+
+	err := cmd.Run(w, "blkid", "-p", "-s", "UUID", "-o", "value", bd.GetMappedDeviceFile())
+	if err != nil {
+		log.Warning("Could not read the file system uuid of %s: %s", bd.Name, err)
+		return
+	}
+
+	bd.UUID = strings.TrimSpace(w.String())
+}
@@ -0,0 +1,273 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/clearlinux/clr-installer/errors"
+)
+
+const (
+	// MinimumESPSize is the smallest EFI partition able to hold the boot loader and kernels
+	MinimumESPSize = 100 << 20
+)
+
+// LayoutProblem is a single problem found in a storage layout
+type LayoutProblem struct {
+	Device string // path of the offending device, empty if not specific to a device
+	What   string // description of the problem
+}
+
+// String formats the problem prefixed by its device path
+func (lp *LayoutProblem) String() string {
+	if lp.Device == "" {
+		return lp.What
+	}
+
+	return fmt.Sprintf("%s: %s", lp.Device, lp.What)
+}
+
+// ValidationError lists all the problems found by ValidateLayout()
+type ValidationError struct {
+	Problems []*LayoutProblem
+}
+
+// Error is the error interface implementation, every problem in its own line
+func (ve *ValidationError) Error() string {
+	lines := []string{}
+
+	for _, curr := range ve.Problems {
+		lines = append(lines, curr.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// add records a problem of bd, bd may be nil for problems of the whole layout
+func (ve *ValidationError) add(bd *BlockDevice, format string, a ...interface{}) {
+	problem := &LayoutProblem{What: fmt.Sprintf(format, a...)}
+
+	if bd != nil {
+		problem.Device = bd.GetDeviceFile()
+	}
+
+	ve.Problems = append(ve.Problems, problem)
+}
+
+// addError records err as a problem of bd, no-op if err is nil
+func (ve *ValidationError) addError(bd *BlockDevice, err error) {
+	if err == nil {
+		return
+	}
+
+	// the problems are meant for users, the error trace is left out
+	if te, ok := err.(errors.TraceableError); ok {
+		ve.add(bd, "%s", te.What)
+		return
+	}
+
+	ve.add(bd, "%s", err.Error())
+}
+
+// err returns ve as an error, nil if no problem was found
+func (ve *ValidationError) err() error {
+	if len(ve.Problems) == 0 {
+		return nil
+	}
+
+	return ve
+}
+
+// validateDisk records the problems of a target disk and its partitions, the /boot
+// partition is validated as the legacy boot partition if legacyBoot
+func (ve *ValidationError) validateDisk(bd *BlockDevice, allowRemovable bool, legacyBoot bool) {
+	if bd.ReadOnly {
+		ve.add(bd, "Read-only device")
+	}
+
+	if bd.RemovableDevice && !allowRemovable {
+		ve.add(bd, "Removable device, installing to removable media must be explicitly allowed")
+	}
+
+	ve.addError(bd, bd.validateRelativeSizes())
+	ve.addError(bd, bd.validateImage())
+	ve.addError(bd, bd.validateWipe())
+	ve.addError(bd, bd.validateSelector())
+
+	var used uint64
+
+	for _, ch := range bd.Children {
+		if ch.RelativeSize == "" {
+			used = used + ch.Size
+		}
+
+		if ch.MountPoint == "/boot" && legacyBoot {
+			ve.validateLegacyBootPartition(ch)
+		} else if ch.MountPoint == "/boot" {
+			ve.validateESP(ch)
+		}
+
+		if ch.Encrypted && ch.Passphrase == "" && ch.unlockedAtBoot() {
+			ve.add(ch, "Encrypted partition unlocked at boot requires a passphrase, key files can't be used")
+		} else if ch.Encrypted && ch.Passphrase == "" && ch.KeyFile == "" {
+			ve.add(ch, "Encrypted partition requires a passphrase or a key file")
+		} else if msg := IsValidPassphrase(ch.Passphrase); ch.Encrypted && ch.Passphrase != "" && msg != "" {
+			ve.add(ch, "%s", msg)
+		}
+
+		ve.validateFileSystem(ch)
+		ve.addError(ch, ch.validateSubvolumes())
+		ve.addError(ch, ch.validateExisting())
+		ve.addError(ch, ch.validateMountOptions())
+	}
+
+	if bd.Size > 0 && used > bd.Size {
+		used, _ := HumanReadableSize(used)
+		size, _ := HumanReadableSize(bd.Size)
+		ve.add(bd, "Partitions (%s) exceed the disk size (%s)", used, size)
+	}
+}
+
+// validateFileSystem records the problems of the file system created in bd
+func (ve *ValidationError) validateFileSystem(bd *BlockDevice) {
+	if bd.VolumeGroup != "" || bd.RaidArray != "" {
+		return
+	}
+
+	if !bd.ShouldFormat() {
+		if bd.MkfsOptions != "" {
+			ve.add(bd, "mkfs options set for a partition which is not formatted")
+		}
+		return
+	}
+
+	if _, ok := LookupFileSystem(bd.FsType); bd.FsType != "" && !ok {
+		ve.add(bd, "Unsupported file system: %s", bd.FsType)
+	}
+}
+
+// validateESP records the problems of the EFI partition bd
+func (ve *ValidationError) validateESP(bd *BlockDevice) {
+	if bd.FsType != "vfat" {
+		ve.add(bd, "Unsupported file system for /boot: %s, the EFI partition must be vfat",
+			bd.FsType)
+		return
+	}
+
+	if bd.Encrypted {
+		ve.add(bd, "The EFI partition can not be encrypted")
+	}
+
+	if bd.RelativeSize == "" && bd.Size > 0 && bd.Size < MinimumESPSize {
+		min, _ := HumanReadableSize(MinimumESPSize)
+		ve.add(bd, "The EFI partition is too small, it requires at least %s", min)
+	}
+}
+
+// validateLegacyBootPartition records the problems of the /boot partition bd legacy
+// BIOS boots from
+func (ve *ValidationError) validateLegacyBootPartition(bd *BlockDevice) {
+	if !isLegacyBootFileSystem(bd.FsType) {
+		ve.add(bd, "Unsupported file system for /boot: %s, the legacy boot partition must be one of: %s",
+			bd.FsType, strings.Join(legacyBootFileSystems, ", "))
+		return
+	}
+
+	if bd.Encrypted {
+		ve.add(bd, "The legacy boot partition can not be encrypted")
+	}
+
+	if bd.RelativeSize == "" && bd.Size > 0 && bd.Size < MinimumESPSize {
+		min, _ := HumanReadableSize(MinimumESPSize)
+		ve.add(bd, "The legacy boot partition is too small, it requires at least %s", min)
+	}
+}
+
+// validateMountPoints records the mount points used more than once in targets
+func (ve *ValidationError) validateMountPoints(targets []*BlockDevice) {
+	used := map[string]bool{}
+
+	for _, curr := range targets {
+		if used[curr.MountPoint] {
+			ve.add(curr, "Duplicated mount point: %s", curr.MountPoint)
+		}
+		used[curr.MountPoint] = true
+	}
+}
+
+// validateLayout collects the problems of the target disks, volume groups and raid
+// arrays, requireRoot must be false if the root file system may be provided elsewhere.
+// The /boot partition is required to be the EFI partition, or the legacy boot
+// partition if legacyBoot
+func validateLayout(medias []*BlockDevice, groups []*BlockDevice, arrays []*BlockDevice,
+	requireRoot bool, allowRemovable bool, legacyBoot bool) *ValidationError {
+	ve := &ValidationError{}
+	targets := []*BlockDevice{}
+	boots := []*BlockDevice{}
+	bootName := "EFI"
+
+	if legacyBoot {
+		bootName = "legacy boot"
+	}
+
+	for _, curr := range medias {
+		ve.validateDisk(curr, allowRemovable, legacyBoot)
+
+		for _, ch := range curr.Children {
+			targets = append(targets, ch.MountTargets()...)
+
+			if ch.MountPoint != "/boot" {
+				continue
+			}
+
+			if (legacyBoot && isLegacyBootFileSystem(ch.FsType)) || (!legacyBoot && ch.FsType == "vfat") {
+				boots = append(boots, ch)
+			}
+		}
+	}
+
+	for _, vg := range groups {
+		for _, lv := range vg.Children {
+			targets = append(targets, lv.MountTargets()...)
+		}
+	}
+
+	for _, arr := range arrays {
+		targets = append(targets, arr.MountTargets()...)
+	}
+
+	ve.validateVolumeGroups(medias, groups)
+	ve.validateRaidArrays(medias, arrays)
+	ve.validateMountPoints(targets)
+
+	if len(boots) == 0 {
+		ve.add(nil, "Could not find a suitable %s partition", bootName)
+	}
+
+	if len(boots) > 1 {
+		for _, curr := range boots[1:] {
+			ve.add(curr, "Only one %s partition is supported, found another one in %s",
+				bootName, boots[0].GetDeviceFile())
+		}
+	}
+
+	if requireRoot && !HasMountPoint(targets, "/") {
+		ve.add(nil, "Could not find a root partition")
+	}
+
+	return ve
+}
+
+// ValidateLayout checks the whole storage layout before any disk is touched: the
+// target disks, their partitions, the volume groups and the raid arrays. All the
+// problems found are returned as a ValidationError, removable target disks are
+// only accepted if allowRemovable. The /boot partition is validated as the legacy
+// boot partition if legacyBoot, as the EFI partition otherwise
+func ValidateLayout(medias []*BlockDevice, groups []*BlockDevice, arrays []*BlockDevice,
+	allowRemovable bool, legacyBoot bool) error {
+	return validateLayout(medias, groups, arrays, true, allowRemovable, legacyBoot).err()
+}
@@ -0,0 +1,185 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/plan"
+	"github.com/clearlinux/clr-installer/progress"
+)
+
+const (
+	// WipeSignatures erases the partition table, file system, raid and lvm2 signatures
+	WipeSignatures = "signatures"
+
+	// WipeDiscard erases the signatures and discards all the disk blocks
+	WipeDiscard = "discard"
+
+	// WipeZero overwrites the whole disk with zeros
+	WipeZero = "zero"
+
+	// zeroChunkSize is the size of the writes of a zero pass
+	zeroChunkSize = 4 << 20
+)
+
+var (
+	// WipeMethods are the supported methods of wiping a disk
+	WipeMethods = []string{WipeSignatures, WipeDiscard, WipeZero}
+)
+
+// validateWipe checks the wipe method is known and the disk partitions are not kept
+func (bd *BlockDevice) validateWipe() error {
+	if bd.Wipe == "" {
+		return nil
+	}
+
+	valid := false
+	for _, curr := range WipeMethods {
+		if bd.Wipe == curr {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		return errors.Errorf("Invalid wipe method for %s: %s", bd.Name, bd.Wipe)
+	}
+
+	if bd.KeepsPartitionTable() {
+		return errors.Errorf("Disk %s can not be wiped, it has existing partitions", bd.Name)
+	}
+
+	return nil
+}
+
+// currentPartitions returns the device files of the partitions the kernel currently
+// knows of bd, their signatures are not reachable from the disk device itself
+func (bd *BlockDevice) currentPartitions() []string {
+	res := []string{}
+
+	matches, err := filepath.Glob(filepath.Join(sysBlockDir, bd.Name, "*", "partition"))
+	if err != nil {
+		return res
+	}
+
+	for _, curr := range matches {
+		res = append(res, filepath.Join("/dev", filepath.Base(filepath.Dir(curr))))
+	}
+
+	sort.Strings(res)
+
+	return res
+}
+
+// wipeSignatures erases the signatures of bd's current partitions and then of bd
+func (bd *BlockDevice) wipeSignatures() error {
+	for _, curr := range append(bd.currentPartitions(), bd.GetDeviceFile()) {
+		if err := cmd.RunAndLog("wipefs", "--all", "--force", curr); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// zeroDisk overwrites the whole disk with zeros reporting the progress through prg
+func (bd *BlockDevice) zeroDisk(prg progress.Progress) error {
+	if plan.Enabled() {
+		plan.Add("zero %s", bd.GetDeviceFile())
+		return nil
+	}
+
+	size, err := bd.diskSize()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(bd.GetDeviceFile(), os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	chunk := make([]byte, zeroChunkSize)
+	step := 0
+
+	for written := uint64(0); written < size; {
+		n := uint64(len(chunk))
+		if size-written < n {
+			n = size - written
+		}
+
+		if _, err = f.Write(chunk[:n]); err != nil {
+			return errors.Wrap(err)
+		}
+
+		written = written + n
+
+		if curr := int(written * 100 / size); curr != step {
+			step = curr
+			prg.Partial(step)
+		}
+	}
+
+	if err = f.Sync(); err != nil {
+		return errors.Wrap(err)
+	}
+
+	return nil
+}
+
+// WipeDisk erases the data of bd according to its wipe method before its partition
+// table is written, no-op if no wipe method is set
+func (bd *BlockDevice) WipeDisk() error {
+	if bd.Wipe == "" {
+		return nil
+	}
+
+	steps := 1
+	if bd.Wipe == WipeDiscard {
+		steps = 2
+	} else if bd.Wipe == WipeZero {
+		steps = 100
+	}
+
+	prg := progress.MultiStep(steps, "Wiping %s (%s)", bd.Name, bd.Wipe)
+
+	var err error
+
+	switch bd.Wipe {
+	case WipeSignatures:
+		err = bd.wipeSignatures()
+	case WipeDiscard:
+		if err = bd.wipeSignatures(); err != nil {
+			break
+		}
+
+		prg.Partial(1)
+		if err = cmd.RunAndLog("blkdiscard", bd.GetDeviceFile()); err != nil {
+			err = errors.Wrap(err)
+		}
+	case WipeZero:
+		err = bd.zeroDisk(prg)
+	default:
+		err = errors.Errorf("Invalid wipe method for %s: %s", bd.Name, bd.Wipe)
+	}
+
+	if err != nil {
+		prg.Failure()
+		return err
+	}
+
+	prg.Partial(steps)
+	prg.Success()
+
+	return nil
+}
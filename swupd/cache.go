@@ -0,0 +1,168 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package swupd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/clearlinux/clr-installer/cmd"
+	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/log"
+	"github.com/clearlinux/clr-installer/utils"
+)
+
+// manifest is the subset of a swupd manifest needed to cache a version's content
+type manifest struct {
+	includes []string          // the bundles included by a bundle manifest
+	bundles  map[string]string // maps the bundles listed by the MoM to their version
+}
+
+// parseManifest parses the header and entries of a swupd manifest, entries
+// are lines like: M...\t<hash>\t<version>\t<name>
+func parseManifest(r io.Reader) (*manifest, error) {
+	mf := &manifest{bundles: map[string]string{}}
+	scanner := bufio.NewScanner(r)
+	header := true
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if header {
+			if line == "" {
+				header = false
+				continue
+			}
+
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "includes:" {
+				mf.includes = append(mf.includes, fields[1])
+			}
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 || !strings.HasPrefix(fields[0], "M") {
+			continue
+		}
+
+		mf.bundles[fields[3]] = fields[2]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	return mf, nil
+}
+
+// fetchContent downloads the file name of version from the content url to the same
+// relative path in dir, files already in the cache are not downloaded again
+func fetchContent(dir string, url string, version string, name string) (string, error) {
+	path := filepath.Join(dir, version, name)
+
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if err := utils.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	src := fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(url, "/"), version, name)
+	if err := cmd.RunAndLog("curl", "-fsSL", "-o", path, src); err != nil {
+		_ = os.Remove(path)
+		return "", errors.Errorf("Failed to fetch %s: %v", src, err)
+	}
+
+	return path, nil
+}
+
+// readManifest downloads and extracts the manifest name of version, the parsed
+// manifest is returned
+func readManifest(dir string, url string, version string, name string) (*manifest, error) {
+	path, err := fetchContent(dir, url, version, name+".tar")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cmd.RunAndLog("tar", "-C", filepath.Dir(path), "-xf", path); err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	f, err := os.Open(filepath.Join(filepath.Dir(path), name))
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return parseManifest(f)
+}
+
+// Cache populates the directory dir with the content of version needed to install
+// bundles and the core bundles, offline installations then read it with the url
+// returned by ContentURL(dir). The content is downloaded from url, the host's
+// mirror if empty
+func Cache(dir string, url string, version string, bundles []string) error {
+	var err error
+
+	if url == "" {
+		if url, err = GetHostMirror(); err != nil {
+			return err
+		}
+	}
+
+	log.Info("Caching version %s from %s in %s", version, url, dir)
+
+	mom, err := readManifest(dir, url, version, "Manifest.MoM")
+	if err != nil {
+		return err
+	}
+
+	// the MoM signature is only checked by swupd if present
+	if _, err = fetchContent(dir, url, version, "Manifest.MoM.sig"); err != nil {
+		log.Warning("The content will not be signed: %v", err)
+	}
+
+	pending := append(append([]string{}, CoreBundles...), bundles...)
+	cached := map[string]bool{}
+
+	for len(pending) > 0 {
+		bundle := pending[0]
+		pending = pending[1:]
+
+		if cached[bundle] {
+			continue
+		}
+		cached[bundle] = true
+
+		bver, ok := mom.bundles[bundle]
+		if !ok {
+			return errors.Errorf("Bundle %s not found in version %s", bundle, version)
+		}
+
+		log.Debug("Caching bundle %s from version %s", bundle, bver)
+
+		mf, err := readManifest(dir, url, bver, "Manifest."+bundle)
+		if err != nil {
+			return err
+		}
+
+		// swupd installs bundles from their zero pack, holding all their files
+		if _, err = fetchContent(dir, url, bver, fmt.Sprintf("pack-%s-from-0.tar", bundle)); err != nil {
+			return err
+		}
+
+		pending = append(pending, mf.includes...)
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright © 2018 Intel Corporation
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package swupd
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/clearlinux/clr-installer/progress"
+)
+
+// stage is a step of a swupd operation, recognized by the line swupd prints when
+// starting it, start and end are the operation's completion percentages at the
+// beginning and end of the stage
+type stage struct {
+	exp   *regexp.Regexp
+	start int
+	end   int
+}
+
+var (
+	// stages are the steps of the verify, update and bundle-add operations in the
+	// order swupd runs them, weighted after the time they usually take
+	stages = []stage{
+		{regexp.MustCompile(`^(Verifying version|Loading required manifests|Downloading missing manifests|Attempting to download version string)`), 0, 5},
+		{regexp.MustCompile(`^(Downloading packs|Starting download of remaining update content|Downloading files)`), 5, 60},
+		{regexp.MustCompile(`^(Extracting .* pack|Finishing packs extraction|Finishing download of update content)`), 60, 75},
+		{regexp.MustCompile(`^(Adding any missing files|Installing bundle\(s\) files|Installing files|Staging file content|Validate downloaded files)`), 75, 95},
+		{regexp.MustCompile(`^(Calling post-update helper scripts|Applying update|Update was applied)`), 95, 100},
+	}
+
+	// percentExp matches the completion swupd reports within a stage i.e ...45%
+	percentExp = regexp.MustCompile(`([0-9]+(\.[0-9]+)?)%`)
+
+	// counterExp matches the counters swupd reports within a stage i.e 3 of 10
+	counterExp = regexp.MustCompile(`([0-9]+) of ([0-9]+)`)
+)
+
+// progressWriter parses the swupd output as it's written and reports the operation's
+// completion, scaled from start to end, to a MultiStep progress of 100 steps
+type progressWriter struct {
+	prg     progress.Progress
+	start   int
+	end     int
+	stage   int
+	percent int
+	line    string
+	mutex   sync.Mutex
+}
+
+// newProgressWriter creates a writer reporting the progress of a swupd operation
+// in the range start to end of prg
+func newProgressWriter(prg progress.Progress, start int, end int) *progressWriter {
+	return &progressWriter{prg: prg, start: start, end: end, stage: -1}
+}
+
+// parseLine returns the completion of the operation, in the range 0 to 100, once
+// line is printed by swupd, -1 is returned if line gives no progress information
+func (pw *progressWriter) parseLine(line string) int {
+	line = strings.TrimSpace(line)
+
+	for idx, curr := range stages {
+		if idx > pw.stage && curr.exp.MatchString(line) {
+			pw.stage = idx
+			return curr.start
+		}
+	}
+
+	if pw.stage < 0 {
+		return -1
+	}
+
+	frac := -1.0
+
+	if match := percentExp.FindStringSubmatch(line); match != nil {
+		if perc, err := strconv.ParseFloat(match[1], 64); err == nil {
+			frac = perc / 100
+		}
+	} else if match := counterExp.FindStringSubmatch(line); match != nil {
+		step, _ := strconv.Atoi(match[1])
+		total, _ := strconv.Atoi(match[2])
+
+		if total > 0 {
+			frac = float64(step) / float64(total)
+		}
+	}
+
+	if frac < 0 {
+		return -1
+	}
+
+	if frac > 1 {
+		frac = 1
+	}
+
+	curr := stages[pw.stage]
+	return curr.start + int(float64(curr.end-curr.start)*frac)
+}
+
+// Write is part of the io.Writer implementation, swupd updates its progress lines
+// with carriage returns so both \r and \n end a line
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	pw.line = pw.line + string(p)
+
+	for {
+		idx := strings.IndexAny(pw.line, "\r\n")
+		if idx < 0 {
+			break
+		}
+
+		pw.report(pw.parseLine(pw.line[:idx]))
+		pw.line = pw.line[idx+1:]
+	}
+
+	return len(p), nil
+}
+
+// report notifies prg of the operation's completion percent, the progress never
+// goes back
+func (pw *progressWriter) report(percent int) {
+	if percent <= pw.percent {
+		return
+	}
+
+	pw.percent = percent
+	pw.prg.Partial(pw.start + (pw.end-pw.start)*percent/100)
+}
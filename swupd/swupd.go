@@ -8,7 +8,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -18,6 +20,12 @@ import (
 	"github.com/clearlinux/clr-installer/errors"
 	"github.com/clearlinux/clr-installer/log"
 	"github.com/clearlinux/clr-installer/network"
+	"github.com/clearlinux/clr-installer/progress"
+)
+
+const (
+	// localURLPrefix prefixes the urls of swupd content available locally
+	localURLPrefix = "file://"
 )
 
 var (
@@ -26,12 +34,27 @@ var (
 		"os-core",
 		"os-core-update",
 	}
+
+	// osReleaseFile is where the host's Clear Linux version is read from
+	osReleaseFile = "/usr/lib/os-release"
+
+	// bundleTrackingDir is where swupd tracks the bundles installed in a target
+	bundleTrackingDir = "usr/share/clear/bundles"
+
+	// bundleFailureExps match the bundle-add messages about a bundle not installed
+	bundleFailureExps = []*regexp.Regexp{
+		regexp.MustCompile(`[Bb]undle "?([^"\s]+?)"? (is )?invalid`),
+		regexp.MustCompile(`[Bb]undle "?([^"\s]+?)"? (was )?not found`),
+		regexp.MustCompile(`[Uu]nable to download manifest "?([^"\s]+?)"? version`),
+		regexp.MustCompile(`[Ff]ailed to install bundle "?([^"\s]+?)"?(\s|$)`),
+	}
 )
 
 // SoftwareUpdater abstracts the swupd executable, environment and operations
 type SoftwareUpdater struct {
 	rootDir  string
 	stateDir string
+	url      string // content url used instead of the mirror for offline installations
 }
 
 // Bundle maps a map name and description with the actual checkbox
@@ -52,16 +75,74 @@ func IsCoreBundle(bundle string) bool {
 
 // New creates a new instance of SoftwareUpdater with the rootDir properly adjusted
 func New(rootDir string) *SoftwareUpdater {
-	return &SoftwareUpdater{rootDir, filepath.Join(rootDir, "/var/lib/swupd")}
+	return &SoftwareUpdater{rootDir, filepath.Join(rootDir, "/var/lib/swupd"), ""}
+}
+
+// NewOffline creates a SoftwareUpdater installing the content found at url, usually
+// a local directory as returned by ContentURL(), instead of the mirror's
+func NewOffline(rootDir string, url string) *SoftwareUpdater {
+	s := New(rootDir)
+	s.url = url
+	return s
+}
+
+// IsLocalURL returns true if url refers to swupd content available locally i.e file://
+func IsLocalURL(url string) bool {
+	return strings.HasPrefix(url, localURLPrefix)
+}
+
+// ContentURL returns the url of the swupd content stored in the directory dir
+func ContentURL(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+
+	return localURLPrefix + abs, nil
+}
+
+// HostVersion returns the Clear Linux version of the host, the installations are
+// bootstrapped with the same version the host's swupd is based on
+func HostVersion() (string, error) {
+	content, err := ioutil.ReadFile(osReleaseFile)
+	if err != nil {
+		return "", errors.Errorf("Read version file %s: %v", osReleaseFile, err)
+	}
+
+	versionExp := regexp.MustCompile(`VERSION_ID=([0-9][0-9]*)`)
+	match := versionExp.FindSubmatch(content)
+
+	if len(match) < 2 {
+		return "", errors.Errorf("Version not found in %s", osReleaseFile)
+	}
+
+	return string(match[1]), nil
+}
+
+// IsOffline returns true if s installs local content
+func (s *SoftwareUpdater) IsOffline() bool {
+	return s.url != ""
 }
 
-// Verify runs "swupd verify" operation
-func (s *SoftwareUpdater) Verify(version string, mirror string) error {
+// urlArgs returns the arguments pointing swupd to the offline content, if any
+func (s *SoftwareUpdater) urlArgs() []string {
+	if s.url == "" {
+		return []string{}
+	}
+
+	return []string{fmt.Sprintf("--url=%s", s.url)}
+}
+
+// Verify runs "swupd verify" operation, its progress is reported to prg, a MultiStep
+// progress of 100 steps
+func (s *SoftwareUpdater) Verify(version string, mirror string, prg progress.Progress) error {
 	args := []string{
 		"swupd",
 		"verify",
 	}
-	if mirror != "" {
+	if s.url != "" {
+		args = append(args, s.urlArgs()...)
+	} else if mirror != "" {
 		args = append(args, fmt.Sprintf("--url=%s", mirror))
 	}
 	args = append(args,
@@ -75,12 +156,13 @@ func (s *SoftwareUpdater) Verify(version string, mirror string) error {
 			"--no-scripts",
 		}...)
 
-	err := cmd.RunAndLog(args...)
+	err := cmd.RunAndWatch(newProgressWriter(prg, 0, 90), args...)
 	if err != nil {
 		return errors.Wrap(err)
 	}
 
-	if mirror != "" {
+	// local content is not reachable from the installed system
+	if mirror != "" && !IsLocalURL(mirror) {
 		args = []string{
 			"swupd",
 			"mirror",
@@ -98,12 +180,15 @@ func (s *SoftwareUpdater) Verify(version string, mirror string) error {
 	args = []string{
 		"swupd",
 		"bundle-add",
+	}
+	args = append(args, s.urlArgs()...)
+	args = append(args,
 		fmt.Sprintf("--path=%s", s.rootDir),
 		fmt.Sprintf("--statedir=%s", s.stateDir),
 		"os-core-update",
-	}
+	)
 
-	err = cmd.RunAndLog(args...)
+	err = cmd.RunAndWatch(newProgressWriter(prg, 90, 100), args...)
 	if err != nil {
 		return errors.Wrap(err)
 	}
@@ -111,8 +196,9 @@ func (s *SoftwareUpdater) Verify(version string, mirror string) error {
 	return nil
 }
 
-// Update executes the "swupd update" operation
-func (s *SoftwareUpdater) Update() error {
+// Update executes the "swupd update" operation, its progress is reported to prg, a
+// MultiStep progress of 100 steps
+func (s *SoftwareUpdater) Update(prg progress.Progress) error {
 	args := []string{
 		filepath.Join(s.rootDir, "/usr/bin/swupd"),
 		"update",
@@ -120,7 +206,7 @@ func (s *SoftwareUpdater) Update() error {
 		fmt.Sprintf("--statedir=%s", s.stateDir),
 	}
 
-	err := cmd.RunAndLog(args...)
+	err := cmd.RunAndWatch(newProgressWriter(prg, 0, 100), args...)
 	if err != nil {
 		return errors.Wrap(err)
 	}
@@ -206,8 +292,16 @@ func setMirror(swupdArgs []string, t string) (string, error) {
 	return url, nil
 }
 
-// SetHostMirror executes the "swupd mirror" to set the Host's mirror
+// SetHostMirror executes the "swupd mirror" to set the Host's mirror, local content
+// is only checked to exist since it is handed to swupd directly
 func SetHostMirror(url string) (string, error) {
+	if IsLocalURL(url) {
+		if _, err := os.Stat(strings.TrimPrefix(url, localURLPrefix)); err != nil {
+			return "", errors.Errorf("Local content not found: %s", url)
+		}
+
+		return url, nil
+	}
 
 	if urlErr := network.CheckURL(url); urlErr != nil {
 		return "", fmt.Errorf("Server not responding")
@@ -321,22 +415,84 @@ func parseSwupdMirror(data []byte) (string, error) {
 	return string(match[1]), nil
 }
 
-// BundleAdd executes the "swupd bundle-add" operation for a single bundle
-func (s *SoftwareUpdater) BundleAdd(bundle string) error {
+// parseBundleFailures returns the bundles, out of the requested bundles, swupd reported
+// as failed in its output
+func parseBundleFailures(output string, bundles []string) []string {
+	failed := map[string]bool{}
+
+	for _, exp := range bundleFailureExps {
+		for _, match := range exp.FindAllStringSubmatch(output, -1) {
+			failed[match[1]] = true
+		}
+	}
+
+	res := []string{}
+	for _, curr := range bundles {
+		if failed[curr] {
+			res = append(res, curr)
+		}
+	}
+
+	return res
+}
+
+// isBundleInstalled returns true if swupd tracks bundle as installed in the target
+func (s *SoftwareUpdater) isBundleInstalled(bundle string) bool {
+	_, err := os.Stat(filepath.Join(s.rootDir, bundleTrackingDir, bundle))
+	return err == nil
+}
+
+// BundleAdd executes the "swupd bundle-add" operation for all the bundles at once so
+// the manifests are only downloaded once, its progress is reported to prg, a MultiStep
+// progress of 100 steps. The bundles swupd failed to install are returned, an error is
+// returned if swupd failed for another reason or without reporting the failed bundles
+func (s *SoftwareUpdater) BundleAdd(bundles []string, prg progress.Progress) ([]string, error) {
 	args := []string{
 		filepath.Join(s.rootDir, "/usr/bin/swupd"),
 		"bundle-add",
+	}
+	args = append(args, s.urlArgs()...)
+	args = append(args,
 		fmt.Sprintf("--path=%s", s.rootDir),
 		fmt.Sprintf("--statedir=%s", s.stateDir),
-		bundle,
+	)
+	args = append(args, bundles...)
+
+	w := bytes.NewBuffer(nil)
+
+	err := cmd.RunAndWatch(io.MultiWriter(newProgressWriter(prg, 0, 100), w), args...)
+	failed := parseBundleFailures(w.String(), bundles)
+
+	if err == nil {
+		return failed, nil
 	}
 
-	err := cmd.RunAndLog(args...)
-	if err != nil {
-		return errors.Wrap(err)
+	reported := map[string]bool{}
+	for _, curr := range failed {
+		reported[curr] = true
 	}
 
-	return nil
+	// swupd exits with an error if any bundle failed, the error is only explained by
+	// the bundle failures if every bundle missing from the target was reported
+	failed = []string{}
+	unreported := false
+
+	for _, curr := range bundles {
+		if s.isBundleInstalled(curr) {
+			continue
+		}
+
+		failed = append(failed, curr)
+		if !reported[curr] {
+			unreported = true
+		}
+	}
+
+	if len(failed) == 0 || unreported {
+		return failed, errors.Wrap(err)
+	}
+
+	return failed, nil
 }
 
 // LoadBundleList loads the bundle definitions
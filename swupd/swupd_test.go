@@ -5,8 +5,15 @@
 package swupd
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/clearlinux/clr-installer/progress"
 	"github.com/clearlinux/clr-installer/utils"
 )
 
@@ -75,3 +82,333 @@ func TestIsCoreBundle(t *testing.T) {
 		}
 	}
 }
+
+func TestLocalContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clr-installer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	url, err := ContentURL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if url != "file://"+dir || !IsLocalURL(url) {
+		t.Fatalf("Invalid content url %s for %s", url, dir)
+	}
+
+	if IsLocalURL("https://download.clearlinux.org/update/") {
+		t.Fatal("A remote mirror should not be local")
+	}
+
+	if res, err := SetHostMirror(url); err != nil || res != url {
+		t.Fatalf("SetHostMirror() failed for the local content %s: %v", url, err)
+	}
+
+	if _, err := SetHostMirror(url + "/missing"); err == nil {
+		t.Fatal("SetHostMirror() should fail for missing local content")
+	}
+
+	sw := NewOffline(dir, url)
+	if !sw.IsOffline() || New(dir).IsOffline() {
+		t.Fatal("Only the offline software updater should be offline")
+	}
+
+	args := sw.urlArgs()
+	if len(args) != 1 || args[0] != "--url="+url {
+		t.Fatalf("Invalid offline swupd arguments: %v", args)
+	}
+}
+
+func TestHostVersion(t *testing.T) {
+	file, err := ioutil.TempFile("", "clr-installer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+
+	if _, err = file.WriteString("NAME=\"Clear Linux OS\"\nVERSION_ID=26240\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	prev := osReleaseFile
+	defer func() {
+		osReleaseFile = prev
+	}()
+
+	osReleaseFile = file.Name()
+	if version, err := HostVersion(); err != nil || version != "26240" {
+		t.Fatalf("HostVersion() returned %q, %v expected 26240", version, err)
+	}
+
+	osReleaseFile = file.Name() + ".missing"
+	if _, err := HostVersion(); err == nil {
+		t.Fatal("HostVersion() should fail without an os-release file")
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	content := "MANIFEST\t25\n" +
+		"version:\t26240\n" +
+		"previous:\t26230\n" +
+		"includes:\tos-core\n" +
+		"includes:\tlib-openssl\n" +
+		"\n" +
+		"M...\t0123abcd\t26240\tos-core\n" +
+		"M.o.\t4567ef01\t26200\teditors\n" +
+		"F...\t89abcdef\t26240\t/usr/bin/vim\n"
+
+	mf, err := parseManifest(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mf.includes) != 2 || mf.includes[0] != "os-core" || mf.includes[1] != "lib-openssl" {
+		t.Fatalf("Invalid manifest includes: %v", mf.includes)
+	}
+
+	if len(mf.bundles) != 2 || mf.bundles["os-core"] != "26240" || mf.bundles["editors"] != "26200" {
+		t.Fatalf("Invalid manifest bundles: %v", mf.bundles)
+	}
+}
+
+// writeTestContent writes the manifest or pack name of version to the swupd
+// content directory dir, archived as swupd does
+func writeTestContent(t *testing.T, dir string, version string, name string, content string) {
+	vdir := filepath.Join(dir, version)
+
+	if err := os.MkdirAll(vdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(vdir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := exec.Command("tar", "-C", vdir, "-cf", filepath.Join(vdir, name+".tar"),
+		name).CombinedOutput(); err != nil {
+		t.Fatalf("tar failed: %s", out)
+	}
+}
+
+func TestCache(t *testing.T) {
+	for _, curr := range []string{"curl", "tar"} {
+		if _, err := exec.LookPath(curr); err != nil {
+			t.Skipf("%s not found, skipping test", curr)
+		}
+	}
+
+	src, err := ioutil.TempDir("", "clr-installer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(src)
+	}()
+
+	bundles := map[string]string{
+		"os-core":        "26240",
+		"os-core-update": "26240",
+		"editors":        "26200",
+		"lib-openssl":    "26230",
+		"games":          "26240",
+	}
+
+	mom := "MANIFEST\t25\nversion:\t26240\n\n"
+	for name, version := range bundles {
+		mom += fmt.Sprintf("M...\t0123abcd\t%s\t%s\n", version, name)
+	}
+	writeTestContent(t, src, "26240", "Manifest.MoM", mom)
+
+	for name, version := range bundles {
+		header := "MANIFEST\t25\n"
+		if name == "editors" {
+			header += "includes:\tlib-openssl\n"
+		}
+
+		writeTestContent(t, src, version, "Manifest."+name, header+"\n")
+		writeTestContent(t, src, version, fmt.Sprintf("pack-%s-from-0", name), name)
+	}
+
+	dir := filepath.Join(src, "cache")
+	if err = Cache(dir, "file://"+src, "26240", []string{"editors"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, version := range bundles {
+		_, err = os.Stat(filepath.Join(dir, version, fmt.Sprintf("pack-%s-from-0.tar", name)))
+		if name == "games" && err == nil {
+			t.Fatal("Bundle games should not be cached")
+		} else if name != "games" && err != nil {
+			t.Fatalf("Bundle %s was not cached: %v", name, err)
+		}
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "26240", "Manifest.MoM.tar")); err != nil {
+		t.Fatalf("The MoM was not cached: %v", err)
+	}
+
+	if err = Cache(dir, "file://"+src, "26240", []string{"missing"}); err == nil {
+		t.Fatal("Caching a missing bundle should fail")
+	}
+}
+
+// testProgress records the steps reported to a MultiStep progress
+type testProgress struct {
+	steps []int
+}
+
+func (tp *testProgress) Partial(step int) {
+	tp.steps = append(tp.steps, step)
+}
+
+func (tp *testProgress) Success() {}
+
+func (tp *testProgress) Failure() {}
+
+func TestProgressWriter(t *testing.T) {
+	var _ progress.Progress = &testProgress{}
+
+	output := "Verifying version 26240\n" +
+		"Downloading packs...\n" +
+		"\n" +
+		"Extracting os-core pack for version 26240\n" +
+		"\t...50%\r\t...100%\n" +
+		"Extracting os-core-update pack for version 26240\n" +
+		"\t...100%\n" +
+		"Adding any missing files\n" +
+		"    15 of 30 missing files were replaced\n" +
+		"    30 of 30 missing files were replaced\n" +
+		"Calling post-update helper scripts.\n" +
+		"Fix successful\n"
+
+	prg := &testProgress{}
+	pw := newProgressWriter(prg, 0, 100)
+
+	// swupd's output is split at arbitrary points
+	for _, chunk := range []string{output[:30], output[30:100], output[100:]} {
+		if _, err := pw.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []int{5, 60, 67, 75, 85, 95}
+	if fmt.Sprint(prg.steps) != fmt.Sprint(expected) {
+		t.Fatalf("Reported progress %v, expected %v", prg.steps, expected)
+	}
+
+	// the range of a second operation sharing the same progress
+	prg = &testProgress{}
+	pw = newProgressWriter(prg, 90, 100)
+
+	if _, err := pw.Write([]byte("Downloading packs...\nInstalling bundle(s) files...\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(prg.steps) != "[90 97]" {
+		t.Fatalf("Reported progress %v, expected [90 97]", prg.steps)
+	}
+}
+
+func TestParseBundleFailures(t *testing.T) {
+	output := "Warning: Bundle \"editorz\" is invalid, skipping it...\n" +
+		"Bundle \"git\" is already installed, skipping it...\n" +
+		"Error: Unable to download manifest games version 26240, exiting now\n" +
+		"Error: Unable to download manifest Manifest.MoM version 26240\n" +
+		"Failed to install 2 of 4 bundles\n"
+
+	bundles := []string{"editorz", "git", "games", "go-basic"}
+	failed := parseBundleFailures(output, bundles)
+
+	if fmt.Sprint(failed) != "[editorz games]" {
+		t.Fatalf("Parsed failed bundles %v, expected [editorz games]", failed)
+	}
+}
+
+func TestBundleAdd(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "clr-installer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(rootDir)
+	}()
+
+	if err = os.MkdirAll(filepath.Join(rootDir, "usr/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.MkdirAll(filepath.Join(rootDir, bundleTrackingDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// a swupd failing without reporting which bundle failed
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(rootDir, "args") + "\n" +
+		"echo 'Downloading packs...'\n" +
+		"touch " + filepath.Join(rootDir, bundleTrackingDir, "editors") + "\n" +
+		"echo 'Failed to install 1 of 2 bundles'\nexit 1\n"
+
+	swupd := filepath.Join(rootDir, "usr/bin/swupd")
+	if err = ioutil.WriteFile(swupd, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sw := NewOffline(rootDir, "file:///run/content")
+	prg := &testProgress{}
+
+	failed, err := sw.BundleAdd([]string{"editors", "git"}, prg)
+	if err == nil {
+		t.Fatal("BundleAdd() should fail if a missing bundle was not reported")
+	}
+
+	if fmt.Sprint(failed) != "[git]" {
+		t.Fatalf("BundleAdd() failed bundles %v, expected [git]", failed)
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(rootDir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(args), "bundle-add --url=file:///run/content") ||
+		!strings.HasSuffix(strings.TrimSpace(string(args)), "editors git") {
+		t.Fatalf("All the bundles should be added at once: %s", args)
+	}
+
+	if len(prg.steps) == 0 {
+		t.Fatal("BundleAdd() should report its progress")
+	}
+
+	// a swupd reporting the bundle it failed to install
+	script = "#!/bin/sh\necho 'Warning: Bundle \"git\" is invalid, skipping it...'\n" +
+		"echo 'Failed to install 1 of 2 bundles'\nexit 1\n"
+
+	if err = ioutil.WriteFile(swupd, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err = sw.BundleAdd([]string{"editors", "git"}, prg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(failed) != "[git]" {
+		t.Fatalf("BundleAdd() failed bundles %v, expected [git]", failed)
+	}
+
+	// every bundle is installed but swupd fails anyway
+	if err = os.MkdirAll(filepath.Join(rootDir, bundleTrackingDir, "git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = sw.BundleAdd([]string{"editors", "git"}, prg); err == nil {
+		t.Fatal("BundleAdd() should fail if no bundle failure explains the swupd error")
+	}
+}
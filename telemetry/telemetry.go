@@ -21,6 +21,7 @@ import (
 	"github.com/clearlinux/clr-installer/errors"
 	"github.com/clearlinux/clr-installer/log"
 	"github.com/clearlinux/clr-installer/network"
+	"github.com/clearlinux/clr-installer/plan"
 	"github.com/clearlinux/clr-installer/utils"
 )
 
@@ -193,6 +194,11 @@ func (tl *Telemetry) IsUsingPrivateIP() bool {
 // CreateTelemetryConf create a custom Telemetry configuration file
 // using the customer server and ID
 func (tl *Telemetry) CreateTelemetryConf(rootDir string) error {
+	// the default configuration is only available once the target is installed
+	if plan.Enabled() {
+		plan.Add("write %s", filepath.Join(rootDir, customTelemetryConf))
+		return nil
+	}
 
 	defConfFile := filepath.Join(rootDir, defaultTelemetryConf)
 	// Make sure we can read the default Telemetry configuration file
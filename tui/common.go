@@ -329,6 +329,9 @@ func (page *BasePage) newWindow() {
 
 		page.window.SetPos(x, y)
 		page.window.PlaceChildren()
+
+		// a block devices change is notified as a resize, see blockDevicesChanged()
+		page.tui.refreshBlockDevices()
 	})
 }
 
@@ -7,6 +7,7 @@ package tui
 import (
 	"fmt"
 
+	"github.com/clearlinux/clr-installer/log"
 	"github.com/clearlinux/clr-installer/storage"
 
 	"github.com/VladimirMarkelov/clui"
@@ -15,13 +16,17 @@ import (
 // GuidedPartPage is the Page implementation for guided partitioning page
 type GuidedPartPage struct {
 	BasePage
-	bd       *storage.BlockDevice
-	bdFrames []*clui.Frame
+	bd        *storage.BlockDevice
+	bdFrames  []*clui.Frame
+	schemes   []*storage.PartitionScheme
+	group     *clui.RadioGroup
+	swapGroup *clui.RadioGroup
+	warning   *clui.Label
 }
 
 const (
-	guidedDesc = `Select a partition to modify its configuration and to define it as the
-target installation disk.`
+	guidedDesc = `Select a partition scheme and how to swap, then select a disk to apply it
+to and to define it as the target installation disk.`
 )
 
 // SetDone adds a new target media to installation model and sets the previous' page done flag
@@ -42,8 +47,16 @@ func (page *GuidedPartPage) SetDone(done bool) bool {
 		break
 	}
 
+	// the guided scheme uses a single disk, it replaces any previous layout
 	selected.Children = page.bd.Children
-	page.getModel().AddTargetMedia(selected)
+	page.getModel().TargetMedias = []*storage.BlockDevice{selected}
+
+	// a disk picked by the user is installed even if removable
+	if selected.RemovableDevice {
+		page.getModel().AllowRemovable = true
+	}
+	page.getModel().PartitionScheme = page.selectedScheme().Name
+	page.getModel().Swap = page.selectedSwap()
 	page.bd = nil
 
 	diskPage := page.tui.getPage(TuiPageDiskMenu)
@@ -74,13 +87,25 @@ func (page *GuidedPartPage) showGuidedDisk(bd *storage.BlockDevice) error {
 
 	labels := []*clui.Label{}
 	btn.OnClick(func(ev clui.Event) {
-		storage.NewStandardPartitions(bd)
+		scheme := page.selectedScheme()
+		if !page.selectedSwap().UsesPartitions() {
+			scheme = scheme.WithoutSwap()
+		}
 
 		for _, curr := range labels {
 			curr.Destroy()
 		}
-
 		labels = []*clui.Label{}
+
+		// a scheme may not fit the disk, i.e too small for the scheme's minimum sizes
+		if err := scheme.Apply(bd); err != nil {
+			page.warning.SetTitle(err.Error())
+			page.doneBtn.SetEnabled(false)
+			page.bd = nil
+			return
+		}
+		page.warning.SetTitle("")
+
 		for _, part := range bd.Children {
 			lbl, err := showGuidedPartition(frame, part)
 			if err != nil {
@@ -90,6 +115,15 @@ func (page *GuidedPartPage) showGuidedDisk(bd *storage.BlockDevice) error {
 			labels = append(labels, lbl)
 		}
 
+		for _, part := range bd.DestroyedPartitions() {
+			lbl, err := showDestroyedPartition(frame, part)
+			if err != nil {
+				page.Panic(err)
+			}
+
+			labels = append(labels, lbl)
+		}
+
 		page.doneBtn.SetEnabled(true)
 		clui.ActivateControl(page.window, page.doneBtn)
 		page.bd = bd
@@ -107,18 +141,56 @@ func (page *GuidedPartPage) showGuidedDisk(bd *storage.BlockDevice) error {
 	return nil
 }
 
+// selectedScheme returns the partition scheme currently selected
+func (page *GuidedPartPage) selectedScheme() *storage.PartitionScheme {
+	selected := page.group.Selected()
+	if selected < 0 || selected >= len(page.schemes) {
+		return page.schemes[0]
+	}
+
+	return page.schemes[selected]
+}
+
+// selectedSwap returns the swap configuration currently selected
+func (page *GuidedPartPage) selectedSwap() *storage.SwapConfig {
+	selected := page.swapGroup.Selected()
+	if selected < 0 || selected >= len(storage.SwapTypes) {
+		selected = 0
+	}
+
+	return &storage.SwapConfig{Type: storage.SwapTypes[selected]}
+}
+
 func showGuidedPartition(frame *clui.Frame, part *storage.BlockDevice) (*clui.Label, error) {
 	size, err := part.HumanReadableSize()
 	if err != nil {
 		return nil, err
 	}
 
-	txt := fmt.Sprintf("%10s %10s %s %s", part.Name, size, part.FsType, part.MountPoint)
+	txt := fmt.Sprintf("%10s %10s %-7s %s %s", part.Name, size, partitionAction(part),
+		part.FsType, part.MountPoint)
+	return clui.CreateLabel(frame, AutoSize, 1, txt, Fixed), nil
+}
+
+func showDestroyedPartition(frame *clui.Frame, part *storage.BlockDevice) (*clui.Label, error) {
+	size, err := part.HumanReadableSize()
+	if err != nil {
+		return nil, err
+	}
+
+	txt := fmt.Sprintf("%10s %10s %-7s %s", part.Name, size, "destroy", part.FsType)
 	return clui.CreateLabel(frame, AutoSize, 1, txt, Fixed), nil
 }
 
 // Activate updates the UI elements with the most current list of block devices
 func (page *GuidedPartPage) Activate() {
+	page.warning.SetTitle("")
+	page.refreshBlockDevices()
+}
+
+// refreshBlockDevices lists the block devices again, the disk the partition scheme
+// was applied to stays selected unless it was removed
+func (page *GuidedPartPage) refreshBlockDevices() {
 	for _, curr := range page.bdFrames {
 		curr.Destroy()
 	}
@@ -129,11 +201,26 @@ func (page *GuidedPartPage) Activate() {
 		page.Panic(err)
 	}
 
+	selected := false
+
 	for _, bd := range bds {
-		if err = page.showGuidedDisk(bd.Clone()); err != nil {
+		if page.bd != nil && bd.Equals(page.bd) {
+			bd = page.bd
+			selected = true
+		} else {
+			bd = bd.Clone()
+		}
+
+		if err = page.showGuidedDisk(bd); err != nil {
 			page.Panic(err)
 		}
 	}
+
+	if !selected {
+		page.bd = nil
+	}
+
+	page.doneBtn.SetEnabled(page.bd != nil)
 }
 
 func newGuidedPartitionPage(tui *Tui) (Page, error) {
@@ -146,6 +233,46 @@ func newGuidedPartitionPage(tui *Tui) (Page, error) {
 	lbl = clui.CreateLabel(page.content, 70, 3, guidedDesc, Fixed)
 	lbl.SetMultiline(true)
 
+	schemes, err := storage.LoadPartitionSchemes()
+	if err != nil || len(schemes) == 0 {
+		log.Warning("Could not load the partition schemes, using the default one: %v", err)
+		schemes = []*storage.PartitionScheme{storage.DefaultPartitionScheme}
+	}
+	page.schemes = schemes
+
+	schemeFrm := clui.CreateFrame(page.content, AutoSize, AutoSize, BorderNone, Fixed)
+	schemeFrm.SetPack(clui.Vertical)
+	schemeFrm.SetPaddings(2, 0)
+
+	page.group = clui.CreateRadioGroup()
+
+	for _, curr := range page.schemes {
+		radio := clui.CreateRadio(schemeFrm, AutoSize, fmt.Sprintf("%s: %s", curr.Name, curr.Desc),
+			AutoSize)
+		radio.SetPack(clui.Horizontal)
+		page.group.AddItem(radio)
+	}
+	page.group.SetSelected(0)
+
+	swapFrm := clui.CreateFrame(page.content, AutoSize, AutoSize, BorderNone, Fixed)
+	swapFrm.SetPack(clui.Horizontal)
+	swapFrm.SetPaddings(2, 0)
+
+	clui.CreateLabel(swapFrm, AutoSize, 1, "Swap:", Fixed)
+	page.swapGroup = clui.CreateRadioGroup()
+
+	for _, curr := range storage.SwapTypes {
+		radio := clui.CreateRadio(swapFrm, AutoSize, curr, AutoSize)
+		radio.SetPack(clui.Horizontal)
+		page.swapGroup.AddItem(radio)
+	}
+	page.swapGroup.SetSelected(0)
+
+	page.warning = clui.CreateLabel(page.content, AutoSize, 1, "", Fixed)
+	page.warning.SetMultiline(true)
+	page.warning.SetBackColor(errorLabelBg)
+	page.warning.SetTextColor(errorLabelFg)
+
 	page.doneBtn.SetEnabled(false)
 	return page, nil
 }
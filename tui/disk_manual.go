@@ -16,8 +16,9 @@ import (
 // ManualPartPage is the Page implementation for manual partitioning page
 type ManualPartPage struct {
 	BasePage
-	bds  []*storage.BlockDevice
-	btns []*SimpleButton
+	bds      []*storage.BlockDevice
+	btns     []*SimpleButton
+	modified []*storage.BlockDevice
 }
 
 // SelectedBlockDevice holds the shared date between the manual partitioning page and
@@ -29,8 +30,9 @@ type SelectedBlockDevice struct {
 }
 
 const (
-	manualDesc = `Select a partition to modify its configuration and to define it as the
-target installation disk.`
+	manualDesc = `Select a partition to modify its configuration and to define it as a
+target installation disk. Existing partitions are kept unless deleted or formatted.
+Partitions may be spread across disks, with a single /boot and / partition.`
 )
 
 var (
@@ -61,10 +63,10 @@ func (page *ManualPartPage) showManualDisk(bd *storage.BlockDevice, frame *clui.
 		}
 
 		// builds the fsmask to align fstype column, also give 2 char padding
-		fsMask := fmt.Sprintf("%%10s %%10s %%%ds %%s", lfs+2)
+		fsMask := fmt.Sprintf("%%10s %%10s %%-7s %%%ds %%s", lfs+2)
 
-		txt := fmt.Sprintf(fsMask, sel.part.Name, size, sel.part.FsType,
-			sel.part.MountPoint)
+		txt := fmt.Sprintf(fsMask, sel.part.Name, size, partitionAction(sel.part),
+			sel.part.FsType, sel.part.MountPoint)
 
 		btn = page.newPartBtn(frame, txt)
 		btn.OnClick(func(ev clui.Event) {
@@ -73,6 +75,16 @@ func (page *ManualPartPage) showManualDisk(bd *storage.BlockDevice, frame *clui.
 		})
 	}
 
+	for _, part := range bd.DestroyedPartitions() {
+		size, err = part.HumanReadableSize()
+		if err != nil {
+			return err
+		}
+
+		page.newPartBtn(frame, fmt.Sprintf("%10s %10s %-7s %s", part.Name, size,
+			"destroy", part.FsType))
+	}
+
 	freeSpace, err := bd.FreeSpace()
 	if err != nil {
 		return err
@@ -101,6 +113,23 @@ func (page *ManualPartPage) showManualDisk(bd *storage.BlockDevice, frame *clui.
 	return nil
 }
 
+// partitionAction describes what happens to part when the partition table is written
+func partitionAction(part *storage.BlockDevice) string {
+	if !part.Existing {
+		return "new"
+	}
+
+	if part.IsShrunk() {
+		return "resize"
+	}
+
+	if part.ShouldFormat() {
+		return "format"
+	}
+
+	return "keep"
+}
+
 func (page *ManualPartPage) newPartBtn(frame *clui.Frame, label string) *SimpleButton {
 	btn := CreateSimpleButton(frame, AutoSize, AutoSize, label, Fixed)
 	btn.SetStyle("Part")
@@ -121,26 +150,87 @@ func (page *ManualPartPage) showManualStorageList() error {
 	return nil
 }
 
+// findDisk returns the disk in bds equal to bd, nil if not found
+func findDisk(bds []*storage.BlockDevice, bd *storage.BlockDevice) *storage.BlockDevice {
+	for _, curr := range bds {
+		if curr.Equals(bd) {
+			return curr
+		}
+	}
+
+	return nil
+}
+
+// setModified records bd as modified by the user, replacing its previous copy. A
+// disk picked by the user is installed even if removable, as in the guided page
+func (page *ManualPartPage) setModified(bd *storage.BlockDevice) {
+	nList := []*storage.BlockDevice{bd}
+
+	if bd.RemovableDevice {
+		page.getModel().AllowRemovable = true
+	}
+
+	for _, curr := range page.modified {
+		if !curr.Equals(bd) {
+			nList = append(nList, curr)
+		}
+	}
+
+	page.modified = nList
+}
+
+// targetMedias returns the target medias resulting from the user's changes, the disks
+// modified in this page replace the ones already in the model
+func (page *ManualPartPage) targetMedias() []*storage.BlockDevice {
+	result := []*storage.BlockDevice{}
+
+	for _, curr := range page.getModel().TargetMedias {
+		if findDisk(page.modified, curr) == nil {
+			result = append(result, curr)
+		}
+	}
+
+	for _, curr := range page.modified {
+		if len(curr.Children) > 0 {
+			result = append(result, curr)
+		}
+	}
+
+	return result
+}
+
 // Activate is called when the manual disk partitioning page is activated and resets the
 // page's displayed data
 func (page *ManualPartPage) Activate() {
-	var err error
-	var selected *storage.BlockDevice
-
 	if sel, ok := page.data.(*SelectedBlockDevice); ok {
-		selected = sel.bd
+		page.setModified(sel.bd)
 	}
 
+	page.refreshBlockDevices()
+}
+
+// refreshBlockDevices lists the block devices again, the changes made by the user
+// are kept for the disks still present
+func (page *ManualPartPage) refreshBlockDevices() {
 	bds, err := storage.ListAvailableBlockDevices(page.getModel().TargetMedias)
 	if err != nil {
 		page.Panic(err)
 	}
 
+	// forget the changes to the disks removed meanwhile
+	modified := []*storage.BlockDevice{}
+	for _, curr := range page.modified {
+		if findDisk(bds, curr) != nil {
+			modified = append(modified, curr)
+		}
+	}
+	page.modified = modified
+
 	nList := []*storage.BlockDevice{}
 
 	for _, curr := range bds {
-		if curr.Equals(selected) {
-			nList = append(nList, selected)
+		if modified := findDisk(page.modified, curr); modified != nil {
+			nList = append(nList, modified)
 		} else {
 			nList = append(nList, curr)
 		}
@@ -151,40 +241,49 @@ func (page *ManualPartPage) Activate() {
 	for _, curr := range page.btns {
 		curr.Destroy()
 	}
+	page.btns = []*SimpleButton{}
 
 	if err = page.showManualStorageList(); err != nil {
 		page.Panic(err)
 	}
 
-	for _, bd := range page.bds {
-		if err = bd.Validate(); err == nil {
-			page.doneBtn.SetEnabled(true)
-		}
-	}
+	// the layout is validated as a whole, the partitions may be spread across disks
+	model := page.getModel()
+	err = storage.ValidateLayout(page.targetMedias(), model.VolumeGroups, model.RaidArrays,
+		model.AllowRemovable, model.LegacyBoot())
+	page.doneBtn.SetEnabled(err == nil)
 }
 
 // SetDone set's the configured disk into the model and sets the previous page
 // as done
 func (page *ManualPartPage) SetDone(done bool) bool {
 	if sel, ok := page.data.(*SelectedBlockDevice); ok {
-		var selected *storage.BlockDevice
+		page.setModified(sel.bd)
+	}
 
+	if len(page.modified) > 0 {
 		bds, err := storage.ListAvailableBlockDevices(page.getModel().TargetMedias)
 		if err != nil {
 			page.Panic(err)
 		}
 
-		for _, curr := range bds {
-			if !curr.Equals(sel.bd) {
+		targets := []*storage.BlockDevice{}
+
+		for _, curr := range page.targetMedias() {
+			selected := findDisk(bds, curr)
+			if selected == nil {
 				continue
 			}
 
-			selected = curr
-			break
+			if modified := findDisk(page.modified, curr); modified != nil {
+				selected.Children = modified.Children
+			}
+
+			targets = append(targets, selected)
 		}
 
-		selected.Children = sel.bd.Children
-		page.getModel().AddTargetMedia(selected)
+		page.getModel().TargetMedias = targets
+		page.modified = nil
 		page.data = nil
 	}
 
@@ -7,6 +7,7 @@ package tui
 import (
 	"fmt"
 
+	"github.com/clearlinux/clr-installer/log"
 	"github.com/clearlinux/clr-installer/storage"
 
 	"github.com/VladimirMarkelov/clui"
@@ -26,10 +27,15 @@ type DiskPartitionPage struct {
 	cancelBtn     *SimpleButton
 	sizeWarning   *clui.Label
 	sizeInfo      *clui.Label
+	encryptCheck  *clui.CheckBox
+	formatCheck   *clui.CheckBox
+	pwdEdit       *clui.EditField
+	pwdWarning    *clui.Label
 }
 
 const (
-	nPartitionHelp = "Set the new partition's file system, mount point and size."
+	nPartitionHelp = "Set the partition's file system, mount point, size, encryption and formatting.\n" +
+		"Existing partitions may be shrunk to make room for new ones."
 
 	// partConfirmBtn mask defines a partition configuration page will have a confirm button
 	partConfirmBtn = 1 << 1
@@ -60,7 +66,23 @@ func (page *DiskPartitionPage) setPartitionButtonsVisible(visible bool, mask int
 	}
 }
 
+// setFileSystems lists the available file systems plus current, the file system of an
+// existing partition which may be kept even if it can't be created i.e ntfs
+func (page *DiskPartitionPage) setFileSystems(current string) {
+	page.fsList.Clear()
+
+	for _, fs := range storage.AvailableFileSystems() {
+		page.fsList.AddItem(fs)
+	}
+
+	if current != "" && page.fsList.FindItem(current, true) == -1 {
+		page.fsList.AddItem(current)
+	}
+}
+
 func (page *DiskPartitionPage) setPartitionForm(part *storage.BlockDevice) {
+	page.setFileSystems(part.FsType)
+
 	idx := page.fsList.FindItem(part.FsType, true)
 	page.fsList.SelectItem(idx)
 
@@ -77,11 +99,46 @@ func (page *DiskPartitionPage) setPartitionForm(part *storage.BlockDevice) {
 		page.Panic(err)
 	}
 
+	if part.RelativeSize != "" {
+		size = part.RelativeSize
+	}
+
 	page.sizeEdit.SetTitle(size)
 
+	// existing partitions can only be shrunk, if supported by its file system
+	page.sizeEdit.SetEnabled(!part.Existing || page.canResize(part))
+	page.formatCheck.SetEnabled(part.Existing)
+
+	state := 0
+	if !part.Existing || part.Format {
+		state = 1
+	}
+
+	page.formatCheck.SetState(state)
+	page.validateFormat()
+
+	state = 0
+	if part.Encrypted {
+		state = 1
+	}
+
+	page.encryptCheck.SetState(state)
+	page.pwdEdit.SetTitle(part.Passphrase)
+	page.validatePassphrase()
+
 	page.setPartitionButtonsVisible(true, partAllBtns)
 }
 
+// canResize returns true if part can be resized, for existing partitions it
+// depends on the file system supporting shrinking and its used space being known
+func (page *DiskPartitionPage) canResize(part *storage.BlockDevice) bool {
+	if !part.Existing {
+		return true
+	}
+
+	return part.CanShrink() && part.MinimumSize() > 0
+}
+
 func (page *DiskPartitionPage) getSelectedBlockDevice() *SelectedBlockDevice {
 	var sel *SelectedBlockDevice
 	var ok bool
@@ -106,8 +163,24 @@ func (page *DiskPartitionPage) Activate() {
 	page.mPointEdit.SetTitle("")
 	page.mPointWarning.SetTitle("")
 	page.sizeEdit.SetTitle("")
-	page.sizeInfo.SetTitle("'+/=' to force Maximum size")
+	page.sizeInfo.SetTitle("'+/=' max size, or 50%, rest")
 	page.sizeWarning.SetTitle("")
+	page.pwdWarning.SetTitle("")
+
+	if sel.part.CanShrink() && sel.part.MinimumSize() == 0 {
+		if err := sel.part.ProbeMinimumSize(); err != nil {
+			log.Warning("Could not determine the used space of %s: %s", sel.part.Name, err)
+		}
+	}
+
+	if min := sel.part.MinimumSize(); sel.part.Existing && min > 0 {
+		minSize, err := storage.HumanReadableSize(min)
+		if err != nil {
+			page.Panic(err)
+		}
+
+		page.sizeInfo.SetTitle(fmt.Sprintf("Shrink to at least %s", minSize))
+	}
 
 	page.setPartitionForm(sel.part)
 
@@ -126,7 +199,8 @@ func (page *DiskPartitionPage) Activate() {
 }
 
 func (page *DiskPartitionPage) setConfirmButton() {
-	if page.mPointWarning.Title() == "" && page.sizeWarning.Title() == "" {
+	if page.mPointWarning.Title() == "" && page.sizeWarning.Title() == "" &&
+		page.pwdWarning.Title() == "" {
 		page.confirmBtn.SetEnabled(true)
 	} else {
 		page.confirmBtn.SetEnabled(false)
@@ -139,6 +213,29 @@ func (page *DiskPartitionPage) validateMountPoint() {
 	page.setConfirmButton()
 }
 
+func (page *DiskPartitionPage) validateFormat() {
+	format := page.formatCheck.State() == 1
+
+	page.fsList.SetEnabled(format)
+	page.encryptCheck.SetEnabled(format)
+
+	if !format && page.encryptCheck.State() == 1 {
+		page.encryptCheck.SetState(0)
+	}
+}
+
+func (page *DiskPartitionPage) validatePassphrase() {
+	warning := ""
+
+	page.pwdEdit.SetEnabled(page.encryptCheck.State() == 1)
+	if page.encryptCheck.State() == 1 {
+		warning = storage.IsValidPassphrase(page.pwdEdit.Title())
+	}
+
+	page.pwdWarning.SetTitle(warning)
+	page.setConfirmButton()
+}
+
 func newDiskPartitionPage(tui *Tui) (Page, error) {
 	page := &DiskPartitionPage{}
 
@@ -162,7 +259,16 @@ func newDiskPartitionPage(tui *Tui) (Page, error) {
 	lbl = clui.CreateLabel(lblFrm, AutoSize, 3, "Mount Point:", Fixed)
 	lbl.SetAlign(AlignRight)
 
-	lbl = clui.CreateLabel(lblFrm, AutoSize, 2, "Size:", Fixed)
+	lbl = clui.CreateLabel(lblFrm, AutoSize, 5, "Size:", Fixed)
+	lbl.SetAlign(AlignRight)
+
+	lbl = clui.CreateLabel(lblFrm, AutoSize, 1, "Encryption:", Fixed)
+	lbl.SetAlign(AlignRight)
+
+	lbl = clui.CreateLabel(lblFrm, AutoSize, 1, "Format:", Fixed)
+	lbl.SetAlign(AlignRight)
+
+	lbl = clui.CreateLabel(lblFrm, AutoSize, 2, "Passphrase:", Fixed)
 	lbl.SetAlign(AlignRight)
 
 	fldFrm := clui.CreateFrame(frm, 30, AutoSize, BorderNone, Fixed)
@@ -171,9 +277,7 @@ func newDiskPartitionPage(tui *Tui) (Page, error) {
 	page.fsList = clui.CreateListBox(fldFrm, 1, 2, Fixed)
 	page.fsList.SetAlign(AlignLeft)
 
-	for _, fs := range storage.SupportedFileSystems() {
-		page.fsList.AddItem(fs)
-	}
+	page.setFileSystems("")
 	page.fsList.SelectItem(0)
 
 	mPointFrm := clui.CreateFrame(fldFrm, 4, AutoSize, BorderNone, Fixed)
@@ -230,6 +334,30 @@ func newDiskPartitionPage(tui *Tui) (Page, error) {
 	page.sizeWarning.SetBackColor(errorLabelBg)
 	page.sizeWarning.SetTextColor(errorLabelFg)
 
+	page.encryptCheck = clui.CreateCheckBox(fldFrm, 1, "Encrypt", Fixed)
+	page.encryptCheck.OnChange(func(state int) {
+		page.validatePassphrase()
+	})
+
+	page.formatCheck = clui.CreateCheckBox(fldFrm, 1, "Format", Fixed)
+	page.formatCheck.OnChange(func(state int) {
+		page.validateFormat()
+	})
+
+	pwdFrm := clui.CreateFrame(fldFrm, 4, AutoSize, BorderNone, Fixed)
+	pwdFrm.SetPack(clui.Vertical)
+
+	page.pwdEdit = clui.CreateEditField(pwdFrm, 1, "", Fixed)
+	page.pwdEdit.SetPasswordMode(true)
+	page.pwdEdit.OnChange(func(ev clui.Event) {
+		page.validatePassphrase()
+	})
+
+	page.pwdWarning = clui.CreateLabel(pwdFrm, 1, 1, "", Fixed)
+	page.pwdWarning.SetMultiline(true)
+	page.pwdWarning.SetBackColor(errorLabelBg)
+	page.pwdWarning.SetTextColor(errorLabelFg)
+
 	btnFrm := clui.CreateFrame(fldFrm, 30, 1, BorderNone, Fixed)
 	btnFrm.SetPack(clui.Horizontal)
 	btnFrm.SetGaps(1, 1)
@@ -240,11 +368,33 @@ func newDiskPartitionPage(tui *Tui) (Page, error) {
 		sel := page.getSelectedBlockDevice()
 
 		if sel.part != nil {
-			sel.part.FsType = page.fsList.SelectedItemText()
 			sel.part.MountPoint = page.mPointEdit.Title()
-			size, err := storage.ParseVolumeSize(page.sizeEdit.Title())
-			if err == nil {
-				sel.part.Size = size
+
+			if sel.part.Existing {
+				sel.part.Format = page.formatCheck.State() == 1
+			}
+
+			// an existing partition not formatted keeps its file system
+			if !sel.part.Existing || sel.part.Format {
+				sel.part.FsType = page.fsList.SelectedItemText()
+			}
+
+			if page.canResize(sel.part) {
+				// the displayed size is rounded, don't shrink existing partitions
+				// unless the size was actually changed
+				current, _ := sel.part.HumanReadableSize()
+
+				if !sel.part.Existing || page.sizeEdit.Title() != current {
+					if err := sel.part.SetSize(page.sizeEdit.Title()); err != nil {
+						log.Warning("Invalid size for %s: %s", sel.part.Name, err)
+					}
+				}
+			}
+
+			sel.part.Encrypted = page.encryptCheck.State() == 1
+			sel.part.Passphrase = ""
+			if sel.part.Encrypted {
+				sel.part.Passphrase = page.pwdEdit.Title()
 			}
 		}
 
@@ -5,6 +5,8 @@
 package tui
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/clearlinux/clr-installer/controller"
@@ -24,6 +26,9 @@ type InstallPage struct {
 	prgBar    *clui.ProgressBar
 	prgLabel  *clui.Label
 	prgMax    int
+	allBar    *clui.ProgressBar
+	allLabel  *clui.Label
+	allMax    int
 }
 
 var (
@@ -74,9 +79,16 @@ func (page *InstallPage) Desc(desc string) {
 // Partial is part of the progress.Client implementation and adjusts the progress bar to the
 // current completion percentage
 func (page *InstallPage) Partial(total int, step int) {
-	perc := (step / total)
-	value := page.prgMax * perc
-	page.prgBar.SetValue(int(value))
+	page.prgBar.SetValue(page.prgMax * step / total)
+	clui.RefreshScreen()
+}
+
+// Overall is part of the progress.Client implementation and adjusts the overall progress
+// bar to the completion of the whole installation
+func (page *InstallPage) Overall(total int, step int) {
+	page.allBar.SetValue(page.allMax * step / total)
+	page.allLabel.SetTitle(fmt.Sprintf("Overall progress: %d%%", 100*step/total))
+	clui.RefreshScreen()
 }
 
 // LoopWaitDuration is part of the progress.Client implementation and returns the time duration
@@ -92,6 +104,11 @@ func (page *InstallPage) Activate() {
 
 		err := controller.Install(page.tui.rootDir, page.getModel())
 		if err != nil {
+			// release the target disks, a partially installed image is not finalized
+			if cerr := controller.Cleanup(page.tui.rootDir, true, false); cerr != nil {
+				log.ErrorError(cerr)
+			}
+
 			page.Panic(err)
 			return // In a panic state, do not continue
 		}
@@ -103,12 +120,17 @@ func (page *InstallPage) Activate() {
 		prg.Success()
 
 		prg = progress.NewLoop("Cleaning up install environment")
-		if err := controller.Cleanup(page.tui.rootDir, true); err != nil {
+		if err := controller.Cleanup(page.tui.rootDir, true, true); err != nil {
 			log.ErrorError(err)
 		}
 		prg.Success()
 
-		page.prgLabel.SetTitle("Installation complete")
+		if failed := page.getModel().FailedBundles; len(failed) > 0 {
+			page.prgLabel.SetTitle(fmt.Sprintf("Installation complete, bundles not installed: %s",
+				strings.Join(failed, ", ")))
+		} else {
+			page.prgLabel.SetTitle("Installation complete")
+		}
 		page.rebootBtn.SetEnabled(true)
 		page.exitBtn.SetEnabled(true)
 		clui.ActivateControl(page.GetWindow(), page.rebootBtn)
@@ -136,6 +158,17 @@ func newInstallPage(tui *Tui) (Page, error) {
 	page.prgLabel = clui.CreateLabel(progressFrame, 1, 1, "Installing", Fixed)
 	page.prgLabel.SetPaddings(0, 3)
 
+	overallFrame := clui.CreateFrame(page.content, AutoSize, 3, BorderNone, clui.Fixed)
+	overallFrame.SetPack(clui.Vertical)
+
+	page.allBar = clui.CreateProgressBar(overallFrame, AutoSize, AutoSize, clui.Fixed)
+
+	page.allMax, _ = page.allBar.Size()
+	page.allBar.SetLimits(0, page.allMax)
+
+	page.allLabel = clui.CreateLabel(overallFrame, 1, 1, "Overall progress: 0%", Fixed)
+	page.allLabel.SetPaddings(0, 3)
+
 	page.rebootBtn = CreateSimpleButton(page.cFrame, AutoSize, AutoSize, "Reboot", Fixed)
 	page.rebootBtn.OnClick(func(ev clui.Event) {
 		go clui.Stop()
@@ -7,6 +7,8 @@ package tui
 import (
 	"fmt"
 
+	"github.com/clearlinux/clr-installer/storage"
+
 	"github.com/VladimirMarkelov/clui"
 )
 
@@ -15,6 +17,7 @@ type MenuPage struct {
 	BasePage
 	btns       []*SimpleButton
 	installBtn *SimpleButton
+	problems   *clui.Label
 }
 
 func (page *MenuPage) addMenuItem(item Page) bool {
@@ -74,10 +77,21 @@ func (page *MenuPage) Activate() {
 		}
 	}
 
-	if page.getModel() != nil && page.getModel().Validate() == nil {
+	if page.getModel() == nil {
+		return
+	}
+
+	err := page.getModel().Validate()
+	if err == nil {
 		page.installBtn.SetEnabled(true)
 		page.activated = page.installBtn
 	}
+
+	// the storage problems are only known once the whole layout is defined
+	page.problems.SetTitle("")
+	if ve, ok := err.(*storage.ValidationError); ok {
+		page.problems.SetTitle(ve.Error())
+	}
 }
 
 const (
@@ -94,6 +108,11 @@ func newMenuPage(tui *Tui) (Page, error) {
 	lbl.SetMultiline(true)
 	lbl.SetPaddings(0, 2)
 
+	page.problems = clui.CreateLabel(page.content, 2, 3, "", Fixed)
+	page.problems.SetMultiline(true)
+	page.problems.SetBackColor(errorLabelBg)
+	page.problems.SetTextColor(errorLabelFg)
+
 	cancelBtn := CreateSimpleButton(page.cFrame, AutoSize, AutoSize, "Cancel", Fixed)
 	cancelBtn.OnClick(func(ev clui.Event) {
 		go clui.Stop()
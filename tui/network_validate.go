@@ -75,6 +75,10 @@ func (page *NetworkValidatePage) Desc(desc string) {
 func (page *NetworkValidatePage) Partial(total int, step int) {
 }
 
+// Overall is part of the progress.Client implementation, the network test has no phases
+func (page *NetworkValidatePage) Overall(total int, step int) {
+}
+
 // LoopWaitDuration is part of the progress.Client implementation and returns the time duration
 // each step should wait until calling Step again
 func (page *NetworkValidatePage) LoopWaitDuration() time.Duration {
@@ -8,11 +8,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/clearlinux/clr-installer/args"
 	"github.com/clearlinux/clr-installer/errors"
 	"github.com/clearlinux/clr-installer/log"
 	"github.com/clearlinux/clr-installer/model"
+	"github.com/clearlinux/clr-installer/storage"
 
 	"github.com/VladimirMarkelov/clui"
 	"github.com/nsf/termbox-go"
@@ -28,6 +30,15 @@ type Tui struct {
 	rootDir       string
 	paniced       chan error
 	installReboot bool
+
+	// devicesChanged notifies the UI loop of block devices plugged or removed
+	devicesChanged chan struct{}
+}
+
+// blockDevicesPage is implemented by the pages listing the block devices, they're
+// refreshed in place after a disk was plugged or removed
+type blockDevicesPage interface {
+	refreshBlockDevices()
 }
 
 var (
@@ -105,6 +116,7 @@ func (tui *Tui) Run(md *model.SystemInstall, rootDir string) (bool, error) {
 
 	tui.rootDir = rootDir
 	tui.paniced = make(chan error, 1)
+	tui.devicesChanged = make(chan struct{}, 1)
 
 	menus := []struct {
 		desc string
@@ -146,6 +158,17 @@ func (tui *Tui) Run(md *model.SystemInstall, rootDir string) (bool, error) {
 
 	tui.gotoPage(TuiPageMenu, tui.currPage)
 
+	// keep the disk pages up to date when disks are plugged or removed
+	if monitor, err := storage.NewHotplugMonitor(); err != nil {
+		log.Warning("Could not watch the block devices: %s", err)
+	} else {
+		monitor.Watch(tui.blockDevicesChanged)
+
+		defer func() {
+			_ = monitor.Close()
+		}()
+	}
+
 	var paniced error
 
 	go func() {
@@ -167,6 +190,42 @@ func (tui *Tui) Run(md *model.SystemInstall, rootDir string) (bool, error) {
 	return tui.installReboot, nil
 }
 
+// blockDevicesChanged is called by the hotplug monitor's goroutine after a disk was
+// plugged or removed. The pages must only be touched by the UI loop and clui has no
+// user events, so the UI loop is woken up with a terminal resize notification which
+// ends up calling refreshBlockDevices()
+func (tui *Tui) blockDevicesChanged() {
+	select {
+	case tui.devicesChanged <- struct{}{}:
+	default:
+		// a refresh is already pending
+		return
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGWINCH); err != nil {
+		log.Warning("Could not notify the block devices change: %s", err)
+	}
+}
+
+// refreshBlockDevices refreshes the block devices listed by the current page, if any,
+// once a change was notified by blockDevicesChanged(). The pages editing a disk are
+// left alone, they see the change once the listing page is activated again
+func (tui *Tui) refreshBlockDevices() {
+	select {
+	case <-tui.devicesChanged:
+	default:
+		return
+	}
+
+	page, ok := tui.currPage.(blockDevicesPage)
+	if !ok {
+		return
+	}
+
+	page.refreshBlockDevices()
+	clui.ActivateControl(tui.currPage.GetWindow(), tui.currPage.GetActivated())
+}
+
 func (tui *Tui) gotoPage(id int, currPage Page) {
 	if tui.currPage != nil {
 		tui.currPage.GetWindow().SetVisible(false)
@@ -15,6 +15,7 @@ import (
 	"github.com/clearlinux/clr-installer/conf"
 	"github.com/clearlinux/clr-installer/crypt"
 	"github.com/clearlinux/clr-installer/errors"
+	"github.com/clearlinux/clr-installer/plan"
 	"github.com/clearlinux/clr-installer/progress"
 	"github.com/clearlinux/clr-installer/utils"
 )
@@ -126,6 +127,11 @@ func setTempTargetPAMConfig(rootDir string) error {
 	}
 
 	targetPamFile := filepath.Join(pamDir, conf.ChpasswdPAMFile)
+	if plan.Enabled() {
+		plan.Add("copy %s to %s", chpasswdFile, targetPamFile)
+		return nil
+	}
+
 	if err = utils.CopyFile(chpasswdFile, targetPamFile); err != nil {
 		return err
 	}